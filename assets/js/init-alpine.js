@@ -24,6 +24,7 @@ function data() {
 	  servports: [], //[com1,com2...]
 	  bauds:[2400, 4800, 9600, 19200, 38400, 57600, 115200, 230400, 460800, 921600],	
 	  fnddkkm: [], //"baud":,"port":,"device","err"
+	  ofdstate: {}, //состояние обмена с ОФД по deviceID
 	getServPorts: function() { //поиск портов сервера
 		this.showSearchKKM=true;
 		fetch("/api/getPorts",
@@ -80,8 +81,32 @@ function data() {
 		})
 		.catch(err => {console.log(err);this.showSearchKKM=false;});
 	},
+	getOFDMonitor: function() { //состояние обмена с ОФД
+		fetch("/api/OFDMonitor/",
+			{
+			  method: "GET",
+			  headers: {
+				"Content-Type": "application/json;charset=UTF-8"
+			  },
+			  cache: "no-store", // no-store, reload, no-cache, force-cache или only-if-cached
+			}
+		)
+		.then(response => response.json())
+		.then(data => {if(!data.error)this.ofdstate=data.devices;})
+		.catch(err => console.log(err));
+	},
+	ofdclass: function(id) { //цвет состояния обмена с ОФД
+		let st=this.ofdstate[id];
+		if(!st)return "text-gray-600";
+		switch(st.level){
+			case "critical": case "error": return "text-red-600";
+			case "warning": return "text-orange-500";
+		}
+		return "text-green-600";
+	},
 	getServSettings: function() {
 		this.getServPorts();
+		this.getOFDMonitor();
 		fetch("/api/GetServSetting",
 			{
 			  method: "GET", // POST, PUT, DELETE, etc.
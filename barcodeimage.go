@@ -0,0 +1,374 @@
+package main
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"kkm-shtrih/drv"
+	"strconv"
+	"strings"
+
+	"github.com/boombuler/barcode/aztec"
+	"github.com/boombuler/barcode/code128"
+	"github.com/boombuler/barcode/code39"
+	"github.com/boombuler/barcode/code93"
+	"github.com/boombuler/barcode/datamatrix"
+	"github.com/boombuler/barcode/ean"
+	"github.com/boombuler/barcode/pdf417"
+	"github.com/boombuler/barcode/qr"
+	"github.com/boombuler/barcode/twooffive"
+	xdraw "golang.org/x/image/draw"
+)
+
+/*
+	Штрихкоды графикой: если ККТ не поддерживает тип штрихкода (команда CBH/DEH отвечает ошибкой
+	01H, 33H, 36H, 37H или драйвер возвращает drv.ErrBarcodeType) либо в kkmparam задано barcodegraphics,
+	штрихкод формируется программно и печатается как графика (C4H, C3H) с выравниванием barcodealign.
+	Линейный код с barcodealign влево (2) или вправо (3) печатается графикой: в команде CBH нет выравнивания.
+	Текст линейного кода - по barcodehri: 0 - под штрихкодом, 1 - над, 2 - под, 3 - над и под, 4 - не печатать.
+	Размеры по kkmparam: barcodew - ширина штриха, barcodeh - высота линейного кода,
+	qrdotsize, datamatrixdotsize, aztecdotsize, pdf417w - размер точки двумерного кода.
+	Программно формируются: EAN8, EAN13, EAN128, CODE39, Code93, Code128, ITF14, GS1DataBar,
+	GS1DataBarTruncated, PDF417, DataMatrix, QR, AZTEC.
+	GS1DataBar - GTIN: до 13 цифр без контрольной или 14 цифр с контрольной, можно с префиксом (01).
+*/
+
+//dataBarGTIN 13 цифр GTIN без контрольной для GS1 DataBar
+func dataBarGTIN(data string) (string, error) {
+	data = strings.TrimPrefix(data, "(01)")
+	for _, r := range data {
+		if r < '0' || r > '9' {
+			return "", errors.New("GS1 DataBar: GTIN должен состоять из цифр")
+		}
+	}
+	switch {
+	case len(data) == 14:
+		if gtinCheckDigit(data[:13]) != data[13] {
+			return "", errors.New("GS1 DataBar: неверная контрольная цифра GTIN")
+		}
+		return data[:13], nil
+	case len(data) > 0 && len(data) <= 13:
+		return strings.Repeat("0", 13-len(data)) + data, nil
+	}
+	return "", errors.New("GS1 DataBar: GTIN должен быть от 1 до 14 цифр")
+}
+
+//gtinCheckDigit контрольная цифра GTIN-14 по 13 цифрам
+func gtinCheckDigit(s string) byte {
+	sum := 0
+	for i := 0; i < len(s); i++ {
+		d := int(s[i] - '0')
+		if i%2 == 0 {
+			d *= 3
+		}
+		sum += d
+	}
+	return byte('0' + (10-sum%10)%10)
+}
+
+//combins число сочетаний из n по r
+func combins(n, r int) int {
+	minDenom, maxDenom := n-r, r
+	if n-r > r {
+		minDenom, maxDenom = r, n-r
+	}
+	val, j := 1, 1
+	for i := n; i > maxDenom; i-- {
+		val *= i
+		if j <= minDenom {
+			val /= j
+			j++
+		}
+	}
+	for ; j <= minDenom; j++ {
+		val /= j
+	}
+	return val
+}
+
+//rssWidths ширины elements элементов из n модулей для значения val (ISO/IEC 24724, приложение B)
+func rssWidths(val, n, elements, maxWidth int, noNarrow bool) []int {
+	widths := make([]int, elements)
+	narrowMask := 0
+	bar := 0
+	for ; bar < elements-1; bar++ {
+		elmWidth := 1
+		narrowMask |= 1 << uint(bar)
+		var subVal int
+		for {
+			subVal = combins(n-elmWidth-1, elements-bar-2)
+			if !noNarrow && narrowMask == 0 && n-elmWidth-(elements-bar-1) >= elements-bar-1 {
+				subVal -= combins(n-elmWidth-(elements-bar), elements-bar-2)
+			}
+			if elements-bar-1 > 1 {
+				lessVal := 0
+				for mxw := n - elmWidth - (elements - bar - 2); mxw > maxWidth; mxw-- {
+					lessVal += combins(n-elmWidth-mxw-1, elements-bar-3)
+				}
+				subVal -= lessVal * (elements - 1 - bar)
+			} else if n-elmWidth > maxWidth {
+				subVal--
+			}
+			val -= subVal
+			if val < 0 {
+				break
+			}
+			elmWidth++
+			narrowMask &^= 1 << uint(bar)
+		}
+		val += subVal
+		n -= elmWidth
+		widths[bar] = elmWidth
+	}
+	widths[bar] = n
+	return widths
+}
+
+//dataBarModules модули GS1 DataBar Omnidirectional (96 модулей, true - штрих)
+func dataBarModules(gtin string) []bool {
+	var (
+		gSum         = [9]int{0, 161, 961, 2015, 2715, 0, 336, 1036, 1516}
+		tTable       = [9]int{1, 10, 34, 70, 126, 4, 20, 48, 81}
+		modulesOdd   = [9]int{12, 10, 8, 6, 4, 5, 7, 9, 11}
+		modulesEven  = [9]int{4, 6, 8, 10, 12, 10, 8, 6, 4}
+		widestOdd    = [9]int{8, 6, 4, 3, 1, 2, 4, 6, 8}
+		widestEven   = [9]int{1, 3, 5, 6, 8, 7, 5, 3, 1}
+		checkWeights = [32]int{1, 3, 9, 27, 2, 6, 18, 54, 4, 12, 36, 29, 8, 24, 72, 58,
+			16, 48, 65, 37, 32, 17, 51, 74, 64, 34, 23, 69, 49, 68, 46, 59}
+		finder = [45]int{3, 8, 2, 1, 1, 3, 5, 5, 1, 1, 3, 3, 7, 1, 1, 3, 1, 9, 1, 1, 2, 7, 4, 1, 1,
+			2, 5, 6, 1, 1, 2, 3, 8, 1, 1, 1, 5, 7, 1, 1, 1, 3, 9, 1, 1}
+	)
+	value, _ := strconv.ParseInt(gtin, 10, 64)
+	left, right := int(value/4537077), int(value%4537077)
+	chars := [4]int{left / 1597, left % 1597, right / 1597, right % 1597}
+	//ширины элементов символов данных: [элемент][символ]
+	var widths [8][4]int
+	for i, v := range chars {
+		outside := i%2 == 0
+		group := 0
+		if outside {
+			for group < 4 && v >= gSum[group+1] {
+				group++
+			}
+		} else {
+			group = 5
+			for group < 8 && v >= gSum[group+1] {
+				group++
+			}
+		}
+		v -= gSum[group]
+		odd, even := v/tTable[group], v%tTable[group]
+		if !outside {
+			odd, even = even, odd
+		}
+		ow := rssWidths(odd, modulesOdd[group], 4, widestOdd[group], outside)
+		ew := rssWidths(even, modulesEven[group], 4, widestEven[group], !outside)
+		for k := 0; k < 4; k++ {
+			widths[2*k][i] = ow[k]
+			widths[2*k+1][i] = ew[k]
+		}
+	}
+	checksum := 0
+	for i := 0; i < 8; i++ {
+		for k := 0; k < 4; k++ {
+			checksum += checkWeights[i+8*k] * widths[i][k]
+		}
+	}
+	checksum %= 79
+	if checksum >= 8 {
+		checksum++
+	}
+	if checksum >= 72 {
+		checksum++
+	}
+	cLeft, cRight := checksum/9, checksum%9
+	var total [46]int
+	total[0], total[1], total[44], total[45] = 1, 1, 1, 1
+	for i := 0; i < 8; i++ {
+		total[i+2] = widths[i][0]
+		total[i+15] = widths[7-i][1]
+		total[i+23] = widths[i][3]
+		total[i+36] = widths[7-i][2]
+	}
+	for i := 0; i < 5; i++ {
+		total[i+10] = finder[i+5*cLeft]
+		total[i+31] = finder[4-i+5*cRight]
+	}
+	//первый элемент - пробел, далее штрихи и пробелы чередуются
+	var modules []bool
+	for i, w := range total {
+		for k := 0; k < w; k++ {
+			modules = append(modules, i%2 == 1)
+		}
+	}
+	return modules
+}
+
+//modulesImage изображение строки модулей шириной в 1 точку
+func modulesImage(modules []bool) image.Image {
+	img := newCanvas(len(modules), 1)
+	for x, bar := range modules {
+		if bar {
+			img.SetGray(x, 0, color.Gray{})
+		}
+	}
+	return img
+}
+
+//barcodeImage изображение штрихкода bartype (типы PrintBarCode) с размерами по параметрам ККТ,
+//maxWidth > 0 - модуль уменьшается, чтобы штрихкод поместился в ширину печати
+func barcodeImage(bartype string, data []byte, param drv.KkmParam, maxWidth int) (image.Image, error) {
+	var bc image.Image
+	var err error
+	//модуль - ширина штриха или точки двумерного кода в точках
+	module, height := int(param.BarCodeW), int(param.BarCodeH)
+	if module == 0 {
+		module = 2
+	}
+	if height == 0 {
+		height = 80
+	}
+	twoD := true
+	switch bartype {
+	case "EAN13", "EAN8":
+		bc, err = ean.Encode(string(data))
+		twoD = false
+	case "CODE39":
+		bc, err = code39.Encode(string(data), false, true)
+		twoD = false
+	case "Code93":
+		bc, err = code93.Encode(string(data), false, true)
+		twoD = false
+	case "Code128":
+		bc, err = code128.Encode(string(data))
+		twoD = false
+	case "EAN128":
+		//GS1-128: FNC1 в начале данных
+		bc, err = code128.Encode(string(code128.FNC1) + strings.Replace(string(data), "\x1d", string(code128.FNC1), -1))
+		twoD = false
+	case "ITF14":
+		bc, err = twooffive.Encode(string(data), true)
+		twoD = false
+	case "GS1DataBar", "GS1DataBarTruncated":
+		var gtin string
+		if gtin, err = dataBarGTIN(string(data)); err == nil {
+			bc = modulesImage(dataBarModules(gtin))
+			//высота по стандарту: 33 модуля, усеченный - 13
+			if param.BarCodeH == 0 {
+				height = 33 * module
+				if bartype == "GS1DataBarTruncated" {
+					height = 13 * module
+				}
+			}
+		}
+		twoD = false
+	case "QR":
+		bc, err = qr.Encode(string(data), qr.M, qr.Auto)
+		module = int(param.QRDotSize)
+	case "DataMatrix", "DATAMATRIX":
+		bc, err = datamatrix.Encode(string(data))
+		module = int(param.DMATRDotSize)
+	case "PDF417":
+		bc, err = pdf417.Encode(string(data), param.PDF417ErrLevel)
+		module = int(param.PDF417W)
+	case "AZTEC":
+		bc, err = aztec.Encode(data, 23, 0)
+		module = int(param.AZTECDotSize)
+	default:
+		return nil, errors.New("не поддерживаемый тип штрихкода " + bartype)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if twoD && module == 0 {
+		module = 4
+	}
+	b := bc.Bounds()
+	if maxWidth > 0 && b.Dx()*module > maxWidth {
+		if module = maxWidth / b.Dx(); module < 1 {
+			return nil, errors.New("штрихкод " + bartype + " не помещается в ширину печати")
+		}
+	}
+	if twoD {
+		height = b.Dy() * module
+	}
+	img := image.NewGray(image.Rect(0, 0, b.Dx()*module, height))
+	xdraw.NearestNeighbor.Scale(img, img.Bounds(), bc, b, draw.Src, nil)
+	return img, nil
+}
+
+//barcode2D двумерный штрихкод, подпись под ним не печатается
+func barcode2D(bartype string) bool {
+	switch bartype {
+	case "QR", "DataMatrix", "DATAMATRIX", "PDF417", "AZTEC":
+		return true
+	}
+	return false
+}
+
+//barcodeUnsupported ошибка ККТ означает, что команда или тип штрихкода не поддерживаются
+func barcodeUnsupported(errcode byte) bool {
+	switch errcode {
+	case 0x01, 0x33, 0x36, 0x37:
+		return true
+	}
+	return false
+}
+
+//printBarcode печать штрихкода командой ККТ, если ККТ не поддерживает тип - графикой
+func printBarcode(kkm *drv.KkmDrv, pass []byte, bartype string, data []byte) (byte, error) {
+	param := kkm.GetParam()
+	if !param.BarCodeGraphics {
+		errcode, err := kkm.PrintBarCode(pass, bartype, data)
+		if errcode == 0 && err == nil {
+			return 0, nil
+		}
+		fallback := err == drv.ErrBarcodeType || err == drv.ErrBarcodeAlign || (err == nil && barcodeUnsupported(errcode))
+		if !fallback {
+			return errcode, err
+		}
+	}
+	width := graphicsWidth(kkm)
+	img, err := barcodeImage(bartype, data, param, width)
+	if err != nil {
+		return 1, err
+	}
+	//выравнивание как у команды ККТ: 0 - центр, 2 - влево, 3 - вправо
+	line := newCanvas(width, img.Bounds().Dy())
+	x := (width - img.Bounds().Dx()) / 2
+	switch param.BarCodeAlign {
+	case 2:
+		x = 0
+	case 3:
+		x = width - img.Bounds().Dx()
+	}
+	draw.Draw(line, img.Bounds().Add(image.Pt(x, 0)), img, image.Point{}, draw.Src)
+	l, err := convertLogo(line, width)
+	if err != nil {
+		return 1, err
+	}
+	l.Name = bartype
+	//данные линейного кода текстом над и (или) под штрихкодом, как HRI команды ККТ
+	hri := param.HRIPosition()
+	if barcode2D(bartype) {
+		hri = 0
+	}
+	lenline := int(kkm.GetLenLine())
+	if lenline == 0 {
+		lenline = int(LENLINE)
+	}
+	text := centerLine(strings.Replace(string(data), "\x1d", "", -1), lenline)
+	if hri&1 > 0 {
+		if errcode, err := kkm.PrintString(pass, text); errcode > 0 || err != nil {
+			return errcode, err
+		}
+	}
+	if errcode, err := printLogo(kkm, pass, l); errcode > 0 || err != nil {
+		return errcode, err
+	}
+	if hri&2 > 0 {
+		return kkm.PrintString(pass, text)
+	}
+	return 0, nil
+}
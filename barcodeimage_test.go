@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+//modulesString модули штрихкода строкой: 1 - штрих, 0 - пробел
+func modulesString(m []bool) string {
+	var b strings.Builder
+	for _, v := range m {
+		if v {
+			b.WriteByte('1')
+		} else {
+			b.WriteByte('0')
+		}
+	}
+	return b.String()
+}
+
+//elementWidths ширины элементов (чередующихся пробелов и штрихов) по строке модулей
+func elementWidths(s string) []int {
+	var w []int
+	for i := 0; i < len(s); {
+		j := i
+		for j < len(s) && s[j] == s[i] {
+			j++
+		}
+		w = append(w, j-i)
+		i = j
+	}
+	return w
+}
+
+//rssValue значение по ширинам элементов, обратное rssWidths (алгоритм декодера ZXing RSSUtils.getRSSvalue)
+func rssValue(widths []int, maxWidth int, noNarrow bool) int {
+	elements := len(widths)
+	n := 0
+	for _, w := range widths {
+		n += w
+	}
+	val, narrowMask := 0, 0
+	for bar := 0; bar < elements-1; bar++ {
+		elmWidth := 1
+		narrowMask |= 1 << uint(bar)
+		for ; elmWidth < widths[bar]; elmWidth++ {
+			subVal := combins(n-elmWidth-1, elements-bar-2)
+			if noNarrow && narrowMask == 0 && n-elmWidth-(elements-bar-1) >= elements-bar-1 {
+				subVal -= combins(n-elmWidth-(elements-bar), elements-bar-2)
+			}
+			if elements-bar-1 > 1 {
+				lessVal := 0
+				for mxw := n - elmWidth - (elements - bar - 2); mxw > maxWidth; mxw-- {
+					lessVal += combins(n-elmWidth-mxw-1, elements-bar-3)
+				}
+				subVal -= lessVal * (elements - 1 - bar)
+			} else if n-elmWidth > maxWidth {
+				subVal--
+			}
+			val += subVal
+			narrowMask &^= 1 << uint(bar)
+		}
+		n -= elmWidth
+	}
+	return val
+}
+
+//decodeDataBarChar значение символа данных и его вклад в контрольную сумму
+func decodeDataBarChar(e []int, outside bool) (int, int) {
+	odd := []int{e[0], e[2], e[4], e[6]}
+	even := []int{e[1], e[3], e[5], e[7]}
+	oddSum, evenSum, oddCheck, evenCheck := 0, 0, 0, 0
+	for i := 3; i >= 0; i-- {
+		oddCheck = oddCheck*9 + odd[i]
+		evenCheck = evenCheck*9 + even[i]
+		oddSum += odd[i]
+		evenSum += even[i]
+	}
+	check := oddCheck + 3*evenCheck
+	if outside {
+		g := (12 - oddSum) / 2
+		ow := [5]int{8, 6, 4, 3, 1}[g]
+		return rssValue(odd, ow, false)*[5]int{1, 10, 34, 70, 126}[g] + rssValue(even, 9-ow, true) + [5]int{0, 161, 961, 2015, 2715}[g], check
+	}
+	g := (10 - evenSum) / 2
+	ow := [4]int{2, 4, 6, 8}[g]
+	return rssValue(even, 9-ow, false)*[4]int{4, 20, 48, 81}[g] + rssValue(odd, ow, true) + [4]int{0, 336, 1036, 1516}[g], check
+}
+
+func reversed(e []int) []int {
+	r := make([]int, len(e))
+	for i, v := range e {
+		r[len(e)-1-i] = v
+	}
+	return r
+}
+
+//decodeDataBar разбор GS1 DataBar Omnidirectional независимо от кодировщика: GTIN без контрольной цифры и проверка контрольной суммы
+func decodeDataBar(t *testing.T, s string) (int64, bool) {
+	t.Helper()
+	finders := [9][5]int{{3, 8, 2, 1, 1}, {3, 5, 5, 1, 1}, {3, 3, 7, 1, 1}, {3, 1, 9, 1, 1}, {2, 7, 4, 1, 1},
+		{2, 5, 6, 1, 1}, {2, 3, 8, 1, 1}, {1, 5, 7, 1, 1}, {1, 3, 9, 1, 1}}
+	e := elementWidths(s)
+	//охранные 1+1, символ 1, искатель, символ 2, символ 4, искатель, символ 3, охранные 1+1
+	if s[0] != '0' || len(e) != 46 || e[0] != 1 || e[1] != 1 || e[44] != 1 || e[45] != 1 {
+		t.Fatalf("неверная структура штрихкода: %v", e)
+	}
+	finder := func(w []int) int {
+		for i, f := range finders {
+			if w[0] == f[0] && w[1] == f[1] && w[2] == f[2] && w[3] == f[3] && w[4] == f[4] {
+				return i
+			}
+		}
+		t.Fatalf("неизвестный искатель %v", w)
+		return -1
+	}
+	v1, c1 := decodeDataBarChar(e[2:10], true)
+	lf := finder(e[10:15])
+	v2, c2 := decodeDataBarChar(reversed(e[15:23]), false)
+	v4, c4 := decodeDataBarChar(e[23:31], false)
+	rf := finder(reversed(e[31:36]))
+	v3, c3 := decodeDataBarChar(reversed(e[36:44]), true)
+	value := int64(v1*1597+v2)*4537077 + int64(v3*1597+v4)
+	target := 9*lf + rf
+	if target > 72 {
+		target--
+	}
+	if target > 8 {
+		target--
+	}
+	return value, target == (c1+4*c2+16*(c3+4*c4))%79
+}
+
+func TestDataBarModules(t *testing.T) {
+	tests := []struct {
+		gtin string
+		want string
+	}{
+		//(01)09501101530010
+		{"0950110153001", "010000010100000101000111110000010111101101011100100011011101000101100000000111001110110111001101"},
+		{"2001234567890", "010100011101000001001111111000010100110110111110110000010010100101100000000111000110110110001101"},
+		{"1234567890123", "010111010010000001001110000000010100001011111010110100011001100101111111110001011011000111000101"},
+		{"0000000000000", "010101001000000001000111111110010111111100101010101010110000000101111111110111011111111011010101"},
+	}
+	for _, tt := range tests {
+		got := modulesString(dataBarModules(tt.gtin))
+		if got != tt.want {
+			t.Errorf("dataBarModules(%s) =\n%s, want\n%s", tt.gtin, got, tt.want)
+		}
+	}
+}
+
+func TestDataBarRoundTrip(t *testing.T) {
+	for _, gtin := range []string{"0950110153001", "0000000000001", "4600000000000", "9999999999999", "0460123456789", "1000000000000"} {
+		value, ok := decodeDataBar(t, modulesString(dataBarModules(gtin)))
+		if got := fmt.Sprintf("%013d", value); got != gtin {
+			t.Errorf("dataBarModules(%s) разбирается как %s", gtin, got)
+		}
+		if !ok {
+			t.Errorf("dataBarModules(%s): неверная контрольная сумма", gtin)
+		}
+	}
+}
+
+func TestDataBarGTIN(t *testing.T) {
+	tests := []struct {
+		data string
+		want string
+		err  bool
+	}{
+		{"(01)09501101530010", "0950110153001", false},
+		{"09501101530010", "0950110153001", false},
+		{"09501101530011", "", true},
+		{"4600000000", "0004600000000", false},
+		{"12a4", "", true},
+		{"", "", true},
+		{"123456789012345", "", true},
+	}
+	for _, tt := range tests {
+		got, err := dataBarGTIN(tt.data)
+		if (err != nil) != tt.err || got != tt.want {
+			t.Errorf("dataBarGTIN(%q) = %q, %v; want %q, ошибка %v", tt.data, got, err, tt.want, tt.err)
+		}
+	}
+}
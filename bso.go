@@ -0,0 +1,193 @@
+package main
+
+import (
+	"errors"
+	"kkm-shtrih/drv"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+//checkDocumentType проверит, что тип документа допустим для режима регистрации ККТ:
+//ККТ в режиме АС БСО формирует только БСО, остальные только кассовые чеки.
+//Параметры регистрации берутся из кэша RegInfo, из ФН читаются только если кэш пуст
+func checkDocumentType(kkm *drv.KkmDrv, doctype int) error {
+	reg, ok := RegInfo.Get(kkm.DeviceID)
+	if !ok {
+		var errcode byte
+		var err error
+		reg, errcode, err = kkm.FNGetRegistration()
+		if err != nil {
+			return err
+		}
+		if errcode > 0 {
+			return errors.New(kkm.ParseErrState(errcode))
+		}
+		RegInfo.Set(kkm.DeviceID, reg)
+	}
+	switch doctype {
+	case DocTypeCheck, DocTypeCorrection:
+		if reg.BSO() {
+			return errors.New("ККТ зарегистрирована в режиме АС БСО, кассовый чек сформировать нельзя, используйте DocumentType=4")
+		}
+	case DocTypeBSO, DocTypeBSOCorrection:
+		if !reg.BSO() {
+			return errors.New("ККТ не зарегистрирована в режиме АС БСО, бланк строгой отчетности сформировать нельзя")
+		}
+	default:
+		return errors.New("неизвестный тип документа " + strconv.Itoa(doctype))
+	}
+	return nil
+}
+
+//documentHeaderLines наименование документа для БСО
+func documentHeaderLines(doctype int) []string {
+	switch doctype {
+	case DocTypeBSO:
+		return []string{"БЛАНК СТРОГОЙ ОТЧЕТНОСТИ"}
+	case DocTypeBSOCorrection:
+		return []string{"БЛАНК СТРОГОЙ ОТЧЕТНОСТИ", "КОРРЕКЦИИ"}
+	}
+	return nil
+}
+
+//printDocumentHeader печать наименования документа для БСО
+func printDocumentHeader(kkm *drv.KkmDrv, pass []byte, doctype int) (byte, error) {
+	width := int(kkm.GetLenLine())
+	if width == 0 {
+		width = int(LENLINE)
+	}
+	for _, l := range documentHeaderLines(doctype) {
+		if errcode, err := kkm.PrintString(pass, centerLine(l, width)); errcode > 0 || err != nil {
+			return errcode, err
+		}
+	}
+	return 0, nil
+}
+
+//fiscalizeCorrection формирует чек коррекции (БСО коррекции)
+func fiscalizeCorrection(kkm *drv.KkmDrv, chk *CheckPackage, doctype, optype int) (CheckOutputParameters, error) {
+	var out CheckOutputParameters
+	corr := chk.Parameters.CorrectionData
+	if len(corr.Description) == 0 || len(corr.Date) < 10 {
+		return out, errors.New("для коррекции обязательны CorrectionData Description и Date")
+	}
+	if corr.Type == 1 && len(corr.Number) == 0 {
+		return out, errors.New("для коррекции по предписанию обязателен номер предписания CorrectionData Number")
+	}
+	admpass := kkm.GetAdminPass()
+	//сессия документа фиксирует шаги и аннулирует документ при ошибке любого из них
+	sess := newCheckSession(kkm, 0, admpass, 0)
+	if err := sess.Open("начало чека коррекции", func() (byte, error) { return kkm.FNBeginCorrection(admpass) }); err != nil {
+		return out, err
+	}
+	if err := sess.Do("заголовок документа", func() (byte, error) { return printDocumentHeader(kkm, admpass, doctype) }); err != nil {
+		return out, err
+	}
+	tags := checkTags(&chk.Parameters)
+	//основание для коррекции 1174: описание 1177, дата 1178, номер предписания 1179
+	base := map[string]interface{}{"1177": corr.Description, "1178": corr.Date[:10]}
+	if len(corr.Number) > 0 {
+		base["1179"] = corr.Number
+	}
+	tags = append(tags, tagValue{1174, base})
+	for _, t := range tags {
+		if err := sess.Do("тег "+strconv.Itoa(int(t.tag)), func() (byte, error) { return kkm.FNSendTag(admpass, t.tag, t.val) }); err != nil {
+			return out, err
+		}
+	}
+	p := drv.FNCorrectionParam{
+		Type:          byte(corr.Type),
+		OperationType: byte(optype),
+		Cash:          chk.Payments.Cash,
+		Electronic:    chk.Payments.ElectronicPayment,
+		PrePayment:    chk.Payments.PrePayment,
+		PostPayment:   chk.Payments.PostPayment,
+		Barter:        chk.Payments.Barter,
+		Tax:           make(map[string]float64),
+		TaxSystem:     byte(chk.Parameters.TaxationSystem),
+	}
+	for _, fs := range chk.Positions.FiscalString {
+		p.Total = p.Total + fs.AmountWithDiscount
+		p.Tax[fs.VATRate] = p.Tax[fs.VATRate] + correctionTax(fs)
+	}
+	if len(chk.Positions.FiscalString) == 0 {
+		p.Total = p.Cash + p.Electronic + p.PrePayment + p.PostPayment + p.Barter
+	}
+	var res drv.FNResult
+	err := sess.Close("формирование чека коррекции", func() (errcode byte, err error) {
+		res, errcode, err = kkm.FNCorrectionCheck(admpass, p)
+		return errcode, err
+	})
+	if err != nil {
+		return out, err
+	}
+	out.CheckNumber = int(res.DocumentNumber)
+	out.FiscalSign = strconv.FormatUint(uint64(res.FiscalSign), 10)
+	out.DateTime = res.DateTime.Format("2006-01-02 15:04:05")
+	return out, nil
+}
+
+//correctionTax сумма налога по позиции для чека коррекции: для ставок 0 и без НДС - оборот
+func correctionTax(fs FiscalString) float64 {
+	switch fs.VATRate {
+	case "0", "none", "3", "4":
+		return fs.AmountWithDiscount
+	}
+	if fs.VATAmount > 0 {
+		return fs.VATAmount
+	}
+	rate, err := strconv.ParseFloat(strings.Split(fs.VATRate, "/")[0], 64)
+	if err != nil {
+		return 0
+	}
+	return math.Round(fs.AmountWithDiscount*rate/(100+rate)*100) / 100
+}
+
+//processBSO бланк строгой отчетности (json), тело - CheckPackage в json, DocumentType 4 или 41
+func processBSO(c *gin.Context) {
+	/*
+		{"Parameters":{"CashierName":"Иванов И.П.","OperationType":1,"TaxationSystem":1,"DocumentType":4},
+		 "Positions":{"FiscalString":[{"Name":"Услуга","Quantity":1,"PriceWithDiscount":100,"AmountWithDiscount":100,"VATRate":"none","CalculationSubject":4}]},
+		 "Payments":{"Cash":100}}
+	*/
+	var chk = CheckPackage{}
+	deviceID := c.Param("DeviceID")
+	kkm, err := KkmServ.GetDrv(deviceID)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"error": true, "message": "deviceID не зарегистрирован"})
+		return
+	}
+	if kkm.ChkBusy(0) {
+		c.JSON(http.StatusOK, gin.H{"error": true, "message": "ККТ занята"})
+		return
+	}
+	//займем ккм
+	procid := int(time.Now().Unix())
+	kkm.SetBusy(procid)
+	//освободим по завершению
+	defer kkm.SetBusy(0)
+
+	if err = c.ShouldBindJSON(&chk); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": true, "message": "bad request " + err.Error()})
+		return
+	}
+	switch chk.Parameters.DocumentType {
+	case 0:
+		chk.Parameters.DocumentType = DocTypeBSO
+	case DocTypeBSO, DocTypeBSOCorrection:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": true, "message": "DocumentType должен быть 4 (БСО) или 41 (БСО коррекции)"})
+		return
+	}
+	out, err := fiscalizeOnce(kkm, requestKey(c), &chk)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"error": true, "message": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"error": false, "message": "ok", "DocumentType": chk.Parameters.DocumentType, "CheckNumber": out.CheckNumber, "FiscalSign": out.FiscalSign, "DateTime": out.DateTime})
+}
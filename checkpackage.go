@@ -0,0 +1,522 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"kkm-shtrih/drv"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//Тип фискального документа (код документа ФФД)
+const (
+	//DocTypeCheck кассовый чек
+	DocTypeCheck = 3
+	//DocTypeBSO бланк строгой отчетности
+	DocTypeBSO = 4
+	//DocTypeCorrection кассовый чек коррекции
+	DocTypeCorrection = 31
+	//DocTypeBSOCorrection бланк строгой отчетности коррекции
+	DocTypeBSOCorrection = 41
+)
+
+//CorrectionData данные по операции коррекции (обязательны только для чека коррекции)
+type CorrectionData struct {
+	Type        int    `xml:"Type,attr" json:"Type" binding:"-"`               //Тип коррекции 0 - самостоятельно 1 - по предписанию
+	Description string `xml:"Description,attr" json:"Description" binding:"-"` //Описание коррекции
+	Date        string `xml:"Date,attr" json:"Date" binding:"-"`               //datetime	Дата совершения корректируемого расчета
+	Number      string `xml:"Number,attr" json:"Number" binding:"-"`           //Номер предписания налогового органа
+}
+
+//AgentData данные агента
+type AgentData struct {
+	//	Операция платежного агента
+	AgentOperation string `xml:"AgentOperation,attr" json:"AgentOperation" binding:"-"`
+	//Телефон платежного агента. Допустимо несколько значений через разделитель ",".
+	AgentPhone string `xml:"AgentPhone,attr" json:"AgentPhone" binding:"-"`
+	//Телефон оператора по приему платежей. Допустимо несколько значений через разделитель ",".
+	PaymentProcessorPhone string `xml:"PaymentProcessorPhone,attr" json:"PaymentProcessorPhone" binding:"-"`
+	//Телефон оператора перевода. Допустимо несколько значений через разделитель ",".
+	AcquirerOperatorPhone string `xml:"AcquirerOperatorPhone,attr" json:"AcquirerOperatorPhone" binding:"-"`
+	//Наименование оператора перевода
+	AcquirerOperatorName string `xml:"AcquirerOperatorName,attr" json:"AcquirerOperatorName" binding:"-"`
+	//Адрес оператора перевода
+	AcquirerOperatorAddress string `xml:"AcquirerOperatorAddress,attr" json:"AcquirerOperatorAddress" binding:"-"`
+	//ИНН оператора перевода
+	AcquirerOperatorINN string `xml:"AcquirerOperatorINN,attr" json:"AcquirerOperatorINN" binding:"-"`
+}
+
+//VendorData данные поставщика
+type VendorData struct {
+	VendorPhone string `xml:"VendorPhone,attr" json:"VendorPhone" binding:"-"` //Телефон поставщика. Допустимо несколько значений через разделитель ",".
+	VendorName  string `xml:"VendorName,attr" json:"VendorName" binding:"-"`   //Наименование поставщика
+	VendorINN   string `xml:"VendorINN,attr" json:"VendorINN" binding:"-"`     //ИНН поставщика
+}
+
+//GoodCodeData данные кода товарной номенклатуры
+type GoodCodeData struct {
+	MarkingCode string `xml:"MarkingCode,attr" json:"MarkingCode" binding:"-"` //Значение реквизита кода товара (Значение тэга 1162). Кодируется текстом в кодировке Base64.
+}
+
+//UserAttribute дополнительный реквизит пользователя
+type UserAttribute struct {
+	Name  string `xml:"Name,attr" json:"Name" binding:"-"`   //Имя реквизита
+	Value string `xml:"Value,attr" json:"Value" binding:"-"` //Значение реквизита
+}
+
+//CheckParameters параметры чека
+type CheckParameters struct {
+	CashierName   string `xml:"CashierName,attr" json:"CashierName" binding:"required"` //ФИО и должность уполномоченного лица для проведения операции	Формирование нового чека с заданным атрибутами. При формирование чека ККТ должен проверять, что передаваемый код системы налогообложения доступен для данного фискализированного ФН.
+	CashierINN    string `xml:"CashierINN,attr" json:"CashierINN" binding:"-"`          //ИНН уполномоченного лица для проведения операции
+	OperationType int    `xml:"OperationType,attr" json:"OperationType" binding:"-"`    //Тип операции (Таблица 25 документа ФФД):
+	//аналог OperationType
+	//1 - приход денежных средств
+	//2 - возврат прихода денежных средств
+	//3 - расход денежных средств
+	//4 - возврат расхода денежных средств
+	PaymentType int `xml:"PaymentType,attr" json:"PaymentType" binding:"-"`
+	//Тип документа (код документа ФФД): 3 или 0 - кассовый чек, 4 - бланк строгой отчетности,
+	//31 - кассовый чек коррекции, 41 - бланк строгой отчетности коррекции
+	DocumentType int `xml:"DocumentType,attr" json:"DocumentType" binding:"-"`
+	//Код системы налогообложения. Коды системы налогообложения приведены в таблице "Системы налогообложения".
+	//0	Общая
+	//1	Упрощенная (Доход)
+	//2	Упрощенная (Доход минус Расход)
+	//3	Единый налог на вмененный доход
+	//4	Единый сельскохозяйственный налог
+	//5	Патентная система налогообложения
+	TaxationSystem int `xml:"TaxationSystem,attr" json:"TaxationSystem" binding:"-"`
+	//Покупатель (клиент) - наименование организации или фамилия, имя, отчество (при наличии), серия и номер паспорта покупателя (клиента).
+	CustomerInfo string `xml:"CustomerInfo,attr" json:"CustomerInfo" binding:"-"`
+	//ИНН организации или покупателя (клиента)
+	CustomerINN string `xml:"CustomerINN,attr" json:"CustomerINN" binding:"-"`
+	//Email покупателя (клиента)
+	CustomerEmail string `xml:"CustomerEmail,attr" json:"CustomerEmail" binding:"-"`
+	//Телефонный номер покупателя (клиента)
+	CustomerPhone       string                                                 `xml:"CustomerPhone,attr" json:"CustomerPhone" binding:"-"`
+	SenderEmail         string                                                 `xml:"SenderEmail,attr" json:"SenderEmail" binding:"-"`                 //Адрес электронной почты отправителя чека
+	SaleAddress         string                                                 `xml:"SaleAddress,attr" json:"SaleAddress" binding:"-"`                 //Адрес проведения расчетов
+	SaleLocation        string                                                 `xml:"SaleLocation,attr" json:"SaleLocation" binding:"-"`               //Место проведения расчетов
+	AgentType           int                                                    `xml:"AgentType,attr" json:"AgentType" binding:"-"`                     //Признак агента. См. таблицу "Признаки агента"
+	AdditionalAttribute string                                                 `xml:"AdditionalAttribute,attr" json:"AdditionalAttribute" binding:"-"` //Дополнительный реквизит чека
+	AgentData           `xml:"AgentData" json:"AgentData" binding:"-"`         //Вложенная структура	Данные агента
+	VendorData          `xml:"VendorData" json:"VendorData" binding:"-"`       //Вложенная структура	Данные поставщика
+	UserAttribute       `xml:"UserAttribute" json:"UserAttribute" binding:"-"` //Вложенная структура	Дополнительный реквизит пользователя
+	CorrectionData      CorrectionData                                         `xml:"CorrectionData" json:"CorrectionData" binding:"-"` //Да* Вложенная структура	Данные по операции коррекции.Данное поле обязательно только для чека коррекции.
+	//Округление суммы чека: none, ruble, 10, 50; не указано - по настройке ККТ (kkmparam rounding)
+	Rounding string `xml:"Rounding,attr" json:"Rounding" binding:"-"`
+	//Формирование чека только в электронном виде, печать чека не осуществляется.
+	//Обязателен email или телефон покупателя, чек отправляется через ОФД.
+	Electronically bool `xml:"Electronically,attr" json:"Electronically" binding:"-"`
+	//Имя логотипа ККТ для печати в заголовке чека (POST Logo)
+	Logo string `xml:"Logo,attr" json:"Logo" binding:"-"`
+	//Данные шаблонов заголовка и подвала чека (PUT Template), например номер заказа, баланс баллов
+	TemplateData []TemplateValue `xml:"TemplateData>Value" json:"TemplateData" binding:"-"`
+	//Номер ФД исходного чека для чека возврата: возвращенные количества учитываются в журнале чеков (ReturnCheck)
+	ReturnOf int `xml:"ReturnOf,attr" json:"ReturnOf" binding:"-"`
+}
+
+//CheckBarcode штрихкод чека
+type CheckBarcode struct {
+	Type string `xml:"Type" json:"Type" binding:"-"`
+	//Значение штрихкода.
+	ValueBase64 string `xml:"ValueBase64,attr" json:"ValueBase64" binding:"-"`
+}
+
+//FiscalString фискальная строка (предмет расчета)
+type FiscalString struct {
+	//Наименование товара	Регистрирует фискальную строку с переданными реквизитами.
+	//При печати длинных фискальных строк необходимо делать перенос на следующую строку.
+	Name string `xml:"Name,attr" json:"Name" binding:"required"`
+	//Количество товара
+	Quantity float64 `xml:"Quantity,attr" json:"Quantity" binding:"required"`
+	//Цена единицы товара с учетом скидок/наценок
+	PriceWithDiscount float64 `xml:"PriceWithDiscount,attr" json:"PriceWithDiscount" binding:"required"`
+	//Конечная сумма по предмету расчета с учетом всех скидок/наценок
+	AmountWithDiscount float64 `xml:"AmountWithDiscount,attr" json:"AmountWithDiscount" binding:"required"`
+	DiscountAmount     float64 `xml:"DiscountAmount,attr" json:"DiscountAmount" binding:"-"` //Сумма скидок и наценок (если значение > 0 то в чеке выводиться скидка, если значение < 0 то наценка
+	Department         int     `xml:"Department,attr" json:"Department" binding:"-"`         //Отдел, по которому ведется продажа
+	VATRate            string  `xml:"VATRate,attr" json:"VATRate" binding:"required"`        //Ставка НДС:
+	//"none" - БЕЗ НДС
+	//"20" - НДС 20
+	//"18" - НДС 18
+	//"10" - НДС 10
+	//"0" - НДС 0
+	//"20/120" - расчетная ставка 20/120
+	//"18/118" - расчетная ставка 18/118
+	//"10/110" - расчетная ставка 10/110
+
+	//Сумма НДС за предмет расчета.
+	//В ККТ должен быть отключен расчет налогов, и в чеке выводиться сумма НДС рассчитанная в 1С.
+	//Итоговые суммы НДС по чеку должны рассчитывать по строкам.
+	VATAmount float64 `xml:"VATAmount,attr" json:"VATAmount" binding:"-"`
+	//Признак способа расчета. См. таблицу "Признаки способа расчета" Признаки способа расчета
+	//Код	Описание
+	//1	Предоплата полная
+	//2	Предоплата частичная
+	//3	Аванс
+	//4	Полный расчет
+	//5	Частичный расчет и кредит
+	//6	Передача в кредит
+	//7	Оплата кредита
+	PaymentMethod int `xml:"PaymentMethod,attr" json:"PaymentMethod" binding:"-"`
+	//Признак предмета расчета. См. таблицу "Признаки предмета расчета" Признаки предмета расчета
+	//1	Товар, 2	Подакцизный товар, 3	Работа, 4	Услуга, 5	Ставка азартной игры
+	//6	Выигрыш азартной игры, 7	Лотерейный билет, 8	Выигрыш лотереи, 9	Предоставление результатов интеллектуальной деятельности
+	//10	Платеж,	11	Агентское вознаграждение, 12	Выплата, 13	Иной предмет расчета, 14	Имущественное право
+	//15	Внереализационный доход, 16	Страховые взносы, 17	Торговый сбор, 18	Курортный сбор
+	//19	Залог,20	Расход,	21	Взносы на обязательное пенсионное страхование ИП,	22	Взносы на обязательное пенсионное страхование,		23	Взносы на обязательное медицинское страхование ИП
+	//24	Взносы на обязательное медицинское страхование,	25	Взносы на обязательное социальное страхование,		26	Платеж казино
+	CalculationSubject int `xml:"CalculationSubject,attr" json:"CalculationSubject" binding:"-"`
+	//Признак агента по предмету расчета См. таблицу "Признаки агента по предмету расчета"
+	CalculationAgent int `xml:"CalculationAgent,attr" json:"CalculationAgent" binding:"-"`
+	//Вложенная структура	Данные агента
+	AgentData AgentData `xml:"AgentData" json:"AgentData" binding:"-"`
+	//	Вложенная структура	Данные поставщика
+	VendorData VendorData `xml:"VendorData" json:"VendorData" binding:"-"`
+	//Единица измерения предмета расчета
+	MeasurementUnit     string       `xml:"MeasurementUnit,attr" json:"MeasurementUnit" binding:"-"`
+	GoodCodeData        GoodCodeData `xml:"GoodCodeData" json:"GoodCodeData" binding:"-"`                    //Вложенная структура	Данные кода товарной номенклатуры
+	CountryOfOrigin     string       `xml:"CountryOfOrigin,attr" json:"CountryOfOrigin" binding:"-"`         //Цифровой код страны происхождения товара в соответствии с Общероссийским классификатором стран мира
+	CustomsDeclaration  string       `xml:"CustomsDeclaration,attr" json:"CustomsDeclaration" binding:"-"`   //Регистрационный номер таможенной декларации
+	AdditionalAttribute string       `xml:"AdditionalAttribute,attr" json:"AdditionalAttribute" binding:"-"` //Дополнительный реквизит предмета расчета
+	ExciseAmount        float64      `xml:"ExciseAmount,attr" json:"ExciseAmount" binding:"-"`               //Cумма акциза с учетом копеек, включенная в стоимость предмета расчета
+}
+
+//CheckPositions позиции чека
+type CheckPositions struct {
+	FiscalString []FiscalString `xml:"FiscalString" json:"FiscalString"`
+	//Строка с произвольным текстом	Печать текстовой строки.
+	TextString string `xml:"TextString,attr" json:"TextString" binding:"-"`
+	//Печать штрихкода. Осуществляется с автоматическим размером с выравниванием по центру чека. Тип штрихкода может иметь одно из следующих значений: EAN8, EAN13, CODE39, QR. В случае, если модель устройства не поддерживает печать штрихкода вышеуказанных типов, драйвер должен вернуть ошибку.
+	Barcode CheckBarcode `xml:"Barcode" json:"Barcode" binding:"-"`
+}
+
+//CheckPayments оплаты чека
+type CheckPayments struct {
+	Cash              float64 `xml:"Cash,attr" json:"Cash" binding:"-"`                           //Сумма оплаты наличными денежными средствами	Параметры закрытия чека. Сумма всех видов оплат должна быть больше суммы открытого чека.
+	ElectronicPayment float64 `xml:"ElectronicPayment,attr" json:"ElectronicPayment" binding:"-"` //Сумма оплаты безналичными средствами платежа
+	PrePayment        float64 `xml:"PrePayment,attr" json:"PrePayment" binding:"-"`               //Сумма зачтенной предоплаты или аванса
+	PostPayment       float64 `xml:"PostPayment,attr" json:"PostPayment" binding:"-"`             //Сумма оплаты в кредит (постоплаты)
+	Barter            float64 `xml:"Barter,attr" json:"Barter" binding:"-"`                       //Сумма оплаты встречным предоставлением
+}
+
+//CheckPackage пакет чека 1c ProcessCheck
+type CheckPackage struct {
+	XMLName    xml.Name        `xml:"CheckPackage" json:"-"`
+	Parameters CheckParameters `xml:"Parameters" json:"Parameters"`
+	Positions  CheckPositions  `xml:"Positions" json:"Positions"`
+	Payments   CheckPayments   `xml:"Payments" json:"Payments"`
+}
+
+//CheckOutputParameters результат формирования чека
+type CheckOutputParameters struct {
+	XMLName xml.Name `xml:"Parameters" json:"-"`
+	//Номер открытой смены/Номер закрытой смены
+	ShiftNumber int `xml:"ShiftNumber,attr" json:"ShiftNumber" binding:"required"`
+	//Номер фискального документа
+	CheckNumber             int    `xml:"CheckNumber,attr" json:"CheckNumber" binding:"required"`
+	ShiftClosingCheckNumber int    `xml:"ShiftClosingCheckNumber,attr" json:"ShiftClosingCheckNumber" binding:"required"` //Номер чека за смену
+	AddressSiteInspections  string `xml:"AddressSiteInspections,attr" json:"AddressSiteInspections" binding:"required"`   //Адрес сайта проверки
+	FiscalSign              string `xml:"FiscalSign,attr" json:"FiscalSign" binding:"required"`                           //Фискальный признак
+	DateTime                string `xml:"DateTime,attr" json:"DateTime" binding:"required"`                               //datetime	//Дата и время формирования документа
+	//Скидка округления суммы чека
+	Rounding float64 `xml:"Rounding,attr,omitempty" json:"Rounding,omitempty"`
+	//Чек напечатан на бумаге, false - только электронный чек
+	Printed bool `xml:"Printed,attr" json:"Printed"`
+}
+
+/*
+	Признаки способа расчета
+	Код	Описание
+	1	Предоплата полная
+	2	Предоплата частичная
+	3	Аванс
+	4	Полный расчет
+	5	Частичный расчет и кредит
+	6	Передача в кредит
+	7	Оплата кредита
+	Признаки предмета расчета
+	Код	Описание
+	1	Товар
+	2	Подакцизный товар
+	3	Работа
+	4	Услуга
+	5	Ставка азартной игры
+	6	Выигрыш азартной игры
+	7	Лотерейный билет
+	8	Выигрыш лотереи
+	9	Предоставление результатов интеллектуальной деятельности
+	10	Платеж
+	11	Агентское вознаграждение
+	12	Выплата
+	13	Иной предмет расчета
+	14	Имущественное право
+	15	Внереализационный доход
+	16	Страховые взносы
+	17	Торговый сбор
+	18	Курортный сбор
+	19	Залог
+	20	Расход
+	21	Взносы на обязательное пенсионное страхование ИП
+	22	Взносы на обязательное пенсионное страхование
+	23	Взносы на обязательное медицинское страхование ИП
+	24	Взносы на обязательное медицинское страхование
+	25	Взносы на обязательное социальное страхование
+	26	Платеж казино
+	Признак агента
+	Код	Описание
+	0	Банковский платежный агент
+	1	Банковский платежный субагент
+	2	Платежный агент
+	3	Платежный субагент
+	4	Поверенный
+	5	Комиссионер
+	6	Агент
+	Код типа маркированной продукции
+	Код	Описание
+	1	Изделия из меха
+	2	Табачная продукция
+	3	Обувные товары
+	4	Товары легкой промышленности и одежды
+	5	Шины и автопокрышки
+	6	Молоко и молочная продукция
+	7	Фотокамеры и лампы-вспышки
+	8	Велосипеды
+	9	Кресла-коляски
+	10	Духи и туалетная вода
+
+*/
+
+//checkOperationType тип операции чека (Таблица 25 документа ФФД), OperationType приоритетнее PaymentType
+func checkOperationType(p *CheckParameters) int {
+	if p.OperationType >= 1 && p.OperationType <= 4 {
+		return p.OperationType
+	}
+	if p.PaymentType >= 1 && p.PaymentType <= 4 {
+		return p.PaymentType
+	}
+	return 0
+}
+
+//fiscalizeCheck формирует кассовый чек (БСО, чек коррекции) по пакету чека, ккм должна быть занята вызывающим
+func fiscalizeCheck(kkm *drv.KkmDrv, chk *CheckPackage) (CheckOutputParameters, error) {
+	var out CheckOutputParameters
+	out.DateTime = time.Now().Format("2006-01-02") //time.Parse(("2006-01-02", strDate)
+
+	//проверка пакета до обращения к ККТ
+	v := validateCheck(kkm.DeviceID, chk)
+	if !v.Valid {
+		return out, errors.New(strings.Join(v.Errors, "; "))
+	}
+	admpass := kkm.GetAdminPass()
+	errcode, err := kkm.FNGetStatus()
+	if err != nil {
+		return out, err
+	}
+	if errcode > 0 {
+		return out, errors.New(kkm.ParseErrState(errcode))
+	}
+	fnstate := kkm.FNGetFNState()
+	ShiftState := int(fnstate.FNSessionState + 1) //1 - Закрыта 2 - Открыта 3 - Истекла
+	if ShiftState == 2 && shiftExpired(kkm) {
+		ShiftState = 3
+	}
+	if ShiftState == 3 {
+		//истекшая смена: сообщение или переоткрытие по политике ККТ
+		if err = handleExpiredShift(kkm); err != nil {
+			return out, err
+		}
+		ShiftState = 2
+	}
+	if ShiftState != 2 {
+		return out, errors.New("Смена закрыта")
+	}
+	doctype := chk.Parameters.DocumentType
+	if doctype == 0 {
+		doctype = DocTypeCheck
+	}
+	if err = checkDocumentType(kkm, doctype); err != nil {
+		return out, err
+	}
+	//параметры регистрации прочитаны заново, повторим проверку по ним до открытия документа
+	if msgs := registrationProblems(kkm.DeviceID, chk); len(msgs) > 0 {
+		return out, errors.New(strings.Join(msgs, "; "))
+	}
+	//1 - приход денежных средств 		2 - возврат прихода денежных средств
+	//3 - расход денежных средств		//4 - возврат расхода денежных средств
+	optype := checkOperationType(&chk.Parameters)
+	if optype == 0 {
+		return out, errors.New("не указан тип операции")
+	}
+	printed := !chk.Parameters.Electronically
+	if !printed {
+		//печать отключаем только на этот документ и восстанавливаем прежнюю настройку после него, в т.ч. при ошибке
+		prev, _, err := kkm.GetPrintMode(admpass)
+		if err != nil {
+			return out, errors.New("электронный чек: настройка печати не прочитана: " + err.Error())
+		}
+		if _, err = kkm.SetPrintMode(admpass, drv.PrintOffNext); err != nil {
+			return out, errors.New("электронный чек: печать не отключена: " + err.Error())
+		}
+		defer func() {
+			if _, err := kkm.SetPrintMode(admpass, prev); err != nil {
+				log.Printf("%s: настройка печати не восстановлена: %v", kkm.DeviceID, err)
+			}
+		}()
+	}
+	if doctype == DocTypeCorrection || doctype == DocTypeBSOCorrection {
+		out, err = fiscalizeCorrection(kkm, chk, doctype, optype)
+		out.Printed = printed && err == nil
+		return out, err
+	}
+	//возврат по исходному чеку: не больше проданного, после формирования учитывается в журнале чеков
+	var orig ReceiptRecord
+	var retidx []int
+	if chk.Parameters.ReturnOf > 0 {
+		if orig, err = loadReceipt(kkm, chk.Parameters.ReturnOf); err != nil {
+			return out, err
+		}
+		if retidx, err = returnIndexes(&orig, chk); err != nil {
+			return out, err
+		}
+	}
+	//«0» – продажа  «1» – покупка  «2» – возврат продажи  «3» – возврат покупки
+	chktype := map[int]byte{1: 0, 2: 2, 3: 1, 4: 3}[optype]
+	pass := kkm.GetPass()
+	var logo Logo
+	var header, footer []TextLine
+	if printed {
+		if len(chk.Parameters.Logo) > 0 {
+			if logo, err = loadLogo(kkm.DeviceID, chk.Parameters.Logo); err != nil {
+				return out, err
+			}
+		}
+		//шаблоны заполняем до открытия чека, ошибка шаблона не должна аннулировать чек
+		tctx := checkTemplateContext(kkm.DeviceID, chk, v.Total)
+		if header, err = renderTemplate(kkm.DeviceID, TemplateHeader, tctx); err != nil {
+			return out, err
+		}
+		if footer, err = renderTemplate(kkm.DeviceID, TemplateFooter, tctx); err != nil {
+			return out, err
+		}
+	}
+	//сессия чека фиксирует шаги и аннулирует чек при ошибке любого из них
+	sess := newCheckSession(kkm, 0, pass, 0)
+	if err = sess.Open("открытие чека", func() (byte, error) { return kkm.OpenCheck(admpass, chktype) }); err != nil {
+		return out, err
+	}
+	//формируем заголовок, для электронного чека текст не печатаем
+	if printed && len(chk.Parameters.Logo) > 0 {
+		if err = sess.Do("печать логотипа", func() (byte, error) { return printLogo(kkm, pass, logo) }); err != nil {
+			return out, err
+		}
+	}
+	if printed {
+		if err = sess.Do("заголовок документа", func() (byte, error) { return printDocumentHeader(kkm, pass, doctype) }); err != nil {
+			return out, err
+		}
+	}
+	if len(header) > 0 {
+		if err = sess.Do("шаблон заголовка", func() (byte, error) { return printMarkup(kkm, pass, drv.TapeBoth, header) }); err != nil {
+			return out, err
+		}
+	}
+	if printed && len(chk.Parameters.SenderEmail) > 0 {
+		if err = sess.Do("печать SenderEmail", func() (byte, error) { return kkm.PrintString(pass, chk.Parameters.SenderEmail) }); err != nil {
+			return out, err
+		}
+	}
+	for _, t := range checkTags(&chk.Parameters) {
+		if err = sess.Do("тег "+strconv.Itoa(int(t.tag)), func() (byte, error) { return kkm.FNSendTag(pass, t.tag, t.val) }); err != nil {
+			return out, err
+		}
+	}
+	//налоги для закрытия чека по итогам проверки: по ставкам НДС сумма налога, по 0% и без НДС - оборот
+	vta := make(map[string]float64)
+	for _, t := range v.Taxes {
+		if vatRates[t.VATRate] == 0 {
+			vta[t.VATRate] = t.Amount
+		} else {
+			vta[t.VATRate] = t.VATAmount
+		}
+	}
+	for _, fs := range chk.Positions.FiscalString {
+		if fs.PaymentMethod == 0 {
+			fs.PaymentMethod = 4
+		}
+		if fs.CalculationSubject == 0 {
+			fs.CalculationSubject = 1
+		}
+		if len(fs.MeasurementUnit) > 0 {
+			fs.Name = fs.Name + " " + fs.MeasurementUnit
+		}
+		if err = sess.Do("операция "+fs.Name, func() (byte, error) {
+			return kkm.FNOperation(pass, optype, fs.Quantity, fs.PriceWithDiscount, fs.AmountWithDiscount, fs.VATAmount, fs.VATRate, fs.Department, fs.PaymentMethod, fs.CalculationSubject, fs.Name)
+		}); err != nil {
+			return out, err
+		}
+		//отправим теги предмета расчета
+		for _, t := range positionTags(&fs) {
+			if err = sess.Do(fs.Name+": тег "+strconv.Itoa(int(t.tag)), func() (byte, error) { return kkm.FNSendTag(pass, t.tag, t.val) }); err != nil {
+				return out, err
+			}
+		}
+	}
+
+	//доп реквизит пользователя 1084
+	if len(chk.Parameters.UserAttribute.Name) > 0 {
+
+	}
+
+	if len(footer) > 0 {
+		if err = sess.Do("шаблон подвала", func() (byte, error) { return printMarkup(kkm, pass, drv.TapeBoth, footer) }); err != nil {
+			return out, err
+		}
+	}
+
+	//округление суммы чека показываем отдельной строкой перед итогом
+	rnd := byte(math.Round(v.Rounding * 100))
+	if rnd > 0 && printed {
+		width := int(kkm.GetLenLine())
+		if width == 0 {
+			width = int(LENLINE)
+		}
+		for _, l := range textLine("ОКРУГЛЕНИЕ", "-"+strconv.FormatFloat(v.Rounding, 'f', 2, 64), width) {
+			if err = sess.Do("печать округления", func() (byte, error) { return kkm.PrintString(pass, l) }); err != nil {
+				return out, err
+			}
+		}
+	}
+
+	summa := make(map[int]float64)
+	summa[1] = chk.Payments.Cash
+	summa[2] = chk.Payments.ElectronicPayment
+	summa[14] = chk.Payments.PrePayment
+	summa[15] = chk.Payments.PostPayment
+	summa[16] = chk.Payments.Barter
+	err = sess.Close("закрытие чека", func() (errcode byte, err error) {
+		_, out.CheckNumber, out.FiscalSign, out.DateTime, errcode, err = kkm.CloseCheck(pass, summa, vta, byte(chk.Parameters.TaxationSystem), rnd, "")
+		return errcode, err
+	})
+	if err != nil {
+		return out, err
+	}
+	if printed {
+		//конец чека печатается после закрытия: дождемся печати, в т.ч. после замены рулона
+		if err = kkm.WaitPrint(0); err != nil {
+			log.Printf("%s: чек %d сформирован, печать не завершена: %v", kkm.DeviceID, out.CheckNumber, err)
+		}
+	}
+	out.Rounding = v.Rounding
+	out.Printed = printed
+	//чек нужен для последующего возврата по номеру ФД
+	journalReceipt(kkm.DeviceID, chk, out)
+	if chk.Parameters.ReturnOf > 0 {
+		recordReturn(&orig, chk, retidx, out.CheckNumber)
+	}
+	return out, nil
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"kkm-shtrih/drv"
+	"kkm-shtrih/drv/tlv"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	bolt "go.etcd.io/bbolt"
+)
+
+// CHECKREQUESTDAYS сколько дней хранить результаты запросов чеков по ключу
+var CHECKREQUESTDAYS = 30
+
+// Состояние запроса чека
+const (
+	//CheckRequestPending чек формируется или исход неизвестен
+	CheckRequestPending = "pending"
+	//CheckRequestDone чек сформирован
+	CheckRequestDone = "done"
+	//CheckRequestFailed чек не сформирован
+	CheckRequestFailed = "failed"
+)
+
+// CheckRequest результат запроса чека по ключу идемпотентности клиента
+type CheckRequest struct {
+	Key      string    `json:"key"`
+	DeviceID string    `json:"deviceID"`
+	State    string    `json:"state"`
+	Started  time.Time `json:"started"`
+	//Хэш пакета чека, ключ нельзя использовать для другого чека
+	Hash string `json:"hash"`
+	//Номер последнего ФД перед формированием чека
+	LastFD uint32 `json:"lastFD"`
+	//Тип операции, число позиций и их сумма для сверки с документом в архиве ФН
+	OperationType int                   `json:"operationType"`
+	Positions     int                   `json:"positions"`
+	Amount        float64               `json:"amount"`
+	Result        CheckOutputParameters `json:"result"`
+	Error         string                `json:"error"`
+	//Исход определен по архиву ФН
+	Recovered bool `json:"recovered"`
+}
+
+// requestKey ключ идемпотентности: заголовок Idempotency-Key или параметр ?RequestKey=
+func requestKey(c *gin.Context) string {
+	if key := c.GetHeader("Idempotency-Key"); len(key) > 0 {
+		return key
+	}
+	return c.Query("RequestKey")
+}
+
+// initCheckRequests создаст хранилище запросов и удалит устаревшие записи
+func initCheckRequests() error {
+	border := time.Now().AddDate(0, 0, -CHECKREQUESTDAYS)
+	return DB.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("CheckRequests"))
+		if err != nil {
+			return err
+		}
+		var old [][]byte
+		b.ForEach(func(k, v []byte) error {
+			var r CheckRequest
+			if json.Unmarshal(v, &r) == nil && r.State != CheckRequestPending && r.Started.Before(border) {
+				old = append(old, k)
+			}
+			return nil
+		})
+		for _, k := range old {
+			b.Delete(k)
+		}
+		return nil
+	})
+}
+
+func loadCheckRequest(deviceID, key string) (CheckRequest, bool, error) {
+	var r CheckRequest
+	found := false
+	err := DB.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket([]byte("CheckRequests")).Get([]byte(deviceID + "/" + key))
+		if v == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(v, &r)
+	})
+	return r, found, err
+}
+
+func saveCheckRequest(r *CheckRequest) error {
+	v, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return DB.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("CheckRequests")).Put([]byte(r.DeviceID+"/"+r.Key), v)
+	})
+}
+
+// checkHash хэш пакета чека
+func checkHash(chk *CheckPackage) string {
+	b, _ := json.Marshal(chk)
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+// lastDocumentNumber номер последнего ФД по статусу ФН
+func lastDocumentNumber(kkm *drv.KkmDrv) (uint32, error) {
+	errcode, err := kkm.FNGetStatus()
+	if err != nil {
+		return 0, err
+	}
+	if errcode > 0 {
+		return 0, errors.New(kkm.ParseErrState(errcode))
+	}
+	return kkm.FNGetFNState().DocumentNumber, nil
+}
+
+// positionsAmount сумма позиций чека в копейках
+func positionsAmount(list []FiscalString) float64 {
+	var sum float64
+	for _, fs := range list {
+		sum += math.Round(fs.AmountWithDiscount * 100)
+	}
+	return sum / 100
+}
+
+// matchesRequest документ архива ФН совпадает с чеком запроса: тип операции, число позиций и их сумма.
+// Чек коррекции в архиве может быть без позиций, тогда сверяется только тип операции.
+// Запись без типа операции не совпадает ни с одним документом: исход такого запроса не восстанавливается
+func (r *CheckRequest) matchesRequest(rec ReceiptRecord, doctype uint16) bool {
+	if rec.Check.Parameters.OperationType != r.OperationType {
+		return false
+	}
+	list := rec.Check.Positions.FiscalString
+	if len(list) == 0 && (doctype == DocTypeCorrection || doctype == DocTypeBSOCorrection) {
+		return true
+	}
+	return len(list) == r.Positions && math.Abs(positionsAmount(list)-r.Amount) < 0.005
+}
+
+// claimedFD номер ФД уже отдан как результат другого запроса ККТ
+func claimedFD(deviceID, key string, fd int) bool {
+	claimed := false
+	DB.View(func(tx *bolt.Tx) error {
+		prefix := []byte(deviceID + "/")
+		c := tx.Bucket([]byte("CheckRequests")).Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			var o CheckRequest
+			if json.Unmarshal(v, &o) == nil && o.Key != key && o.State == CheckRequestDone && o.Result.CheckNumber == fd {
+				claimed = true
+				return nil
+			}
+		}
+		return nil
+	})
+	return claimed
+}
+
+// resolveCheckRequest определит исход запроса по архиву ФН: чек после LastFD с тем же типом операции,
+// числом и суммой позиций, не отданный другому запросу, означает, что он сформирован.
+// Чек повторно не печатается, незавершенный документ аннулируется.
+func resolveCheckRequest(kkm *drv.KkmDrv, r *CheckRequest) error {
+	last, err := lastDocumentNumber(kkm)
+	if err != nil {
+		return err
+	}
+	admpass := kkm.GetAdminPass()
+	for n := r.LastFD + 1; n <= last && n > r.LastFD; n++ {
+		doctype, data, _, err := kkm.FNReadDocument(admpass, n)
+		if err != nil {
+			return err
+		}
+		switch doctype {
+		case DocTypeCheck, DocTypeBSO, DocTypeCorrection, DocTypeBSOCorrection:
+		default:
+			continue
+		}
+		if !r.matchesRequest(receiptFromFN(tlv.DecodeAll(data, kkm.TLVCodePage())), doctype) || claimedFD(kkm.DeviceID, r.Key, int(n)) {
+			//документ другого чека, сформированного после этого запроса
+			continue
+		}
+		r.Result = CheckOutputParameters{CheckNumber: int(n)}
+		for _, f := range tlv.DecodeAll(data, kkm.TLVCodePage()) {
+			switch f.Tag {
+			case 1038:
+				if v, ok := f.Value.(uint64); ok {
+					r.Result.ShiftNumber = int(v)
+				}
+			case 1042:
+				if v, ok := f.Value.(uint64); ok {
+					r.Result.ShiftClosingCheckNumber = int(v)
+				}
+			case 1077:
+				if v, ok := f.Value.(uint64); ok {
+					r.Result.FiscalSign = strconv.FormatUint(v, 10)
+				}
+			case 1012:
+				if v, ok := f.Value.(string); ok {
+					r.Result.DateTime = v
+				}
+			}
+		}
+		r.State = CheckRequestDone
+		r.Recovered = true
+		r.Error = ""
+		return nil
+	}
+	//чек не сформирован, незавершенный документ аннулируем
+	if kkm.FNGetFNState().FNCurrentDocument != 0 {
+		kkm.CancelCheck(admpass)
+	}
+	r.State = CheckRequestFailed
+	if len(r.Error) == 0 {
+		r.Error = "чек не сформирован"
+	}
+	return nil
+}
+
+// fiscalizeOnce формирует чек не более одного раза на ключ запроса, ккм должна быть занята вызывающим
+func fiscalizeOnce(kkm *drv.KkmDrv, key string, chk *CheckPackage) (CheckOutputParameters, error) {
+	if len(key) == 0 {
+		return fiscalizeCheck(kkm, chk)
+	}
+	hash := checkHash(chk)
+	r, found, err := loadCheckRequest(kkm.DeviceID, key)
+	if err != nil {
+		return CheckOutputParameters{}, err
+	}
+	if found {
+		if r.Hash != hash {
+			return CheckOutputParameters{}, errors.New("ключ запроса " + key + " уже использован для другого чека")
+		}
+		if r.State == CheckRequestPending {
+			//прежняя попытка прервана, исход определяем по ФН
+			if err = resolveCheckRequest(kkm, &r); err != nil {
+				return CheckOutputParameters{}, errors.New("исход предыдущего запроса не определен: " + err.Error())
+			}
+			if err = saveCheckRequest(&r); err != nil {
+				return CheckOutputParameters{}, err
+			}
+			log.Printf("запрос чека %s/%s: исход определен по ФН: %s", kkm.DeviceID, key, r.State)
+		}
+		if r.State == CheckRequestDone {
+			return r.Result, nil
+		}
+	}
+	last, err := lastDocumentNumber(kkm)
+	if err != nil {
+		return CheckOutputParameters{}, err
+	}
+	r = CheckRequest{Key: key, DeviceID: kkm.DeviceID, State: CheckRequestPending, Started: time.Now(), Hash: hash, LastFD: last,
+		OperationType: checkOperationType(&chk.Parameters), Positions: len(chk.Positions.FiscalString), Amount: positionsAmount(chk.Positions.FiscalString)}
+	if err = saveCheckRequest(&r); err != nil {
+		//без записи ключа чек не формируем, иначе повтор может его задвоить
+		return CheckOutputParameters{}, err
+	}
+	out, ferr := fiscalizeCheck(kkm, chk)
+	if ferr == nil {
+		r.State = CheckRequestDone
+		r.Result = out
+	} else {
+		//ошибка могла произойти после формирования чека в ФН (обрыв связи на закрытии)
+		r.Error = ferr.Error()
+		if err = resolveCheckRequest(kkm, &r); err != nil {
+			//исход неизвестен, запись остается pending до повтора запроса
+			log.Printf("запрос чека %s/%s: %v", kkm.DeviceID, key, err)
+			return out, ferr
+		}
+		if r.State == CheckRequestDone {
+			out, ferr = r.Result, nil
+		}
+	}
+	if err = saveCheckRequest(&r); err != nil {
+		log.Printf("запрос чека %s/%s: %v", kkm.DeviceID, key, err)
+	}
+	return out, ferr
+}
+
+// getCheckRequest исход запроса чека по ключу: ?RequestKey= или заголовок Idempotency-Key
+func getCheckRequest(c *gin.Context) {
+	deviceID := c.Param("DeviceID")
+	if _, err := KkmServ.GetDrv(deviceID); err != nil {
+		c.JSON(http.StatusOK, gin.H{"error": true, "message": "deviceID не зарегистрирован"})
+		return
+	}
+	key := requestKey(c)
+	if len(key) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": true, "message": "не указан ключ запроса"})
+		return
+	}
+	r, found, err := loadCheckRequest(deviceID, key)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"error": true, "message": err.Error()})
+		return
+	}
+	if !found {
+		c.JSON(http.StatusOK, gin.H{"error": true, "message": "запрос " + key + " не найден"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"error": false, "message": "ok", "request": r})
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"kkm-shtrih/drv"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+//CHECKSESSIONLEASE время жизни сессии чека без обращений клиента, после него чек аннулируется
+var CHECKSESSIONLEASE = 60 * time.Second
+
+//CheckStep шаг сессии чека
+type CheckStep struct {
+	Num     int       `json:"num"`
+	Name    string    `json:"name"`
+	Time    time.Time `json:"time"`
+	Error   bool      `json:"error"`
+	Message string    `json:"message"`
+}
+
+//StepError ошибка шага сессии чека
+type StepError struct {
+	Step CheckStep
+	//Документ аннулирован в ККТ
+	Canceled bool
+}
+
+func (e *StepError) Error() string {
+	msg := "шаг " + strconv.Itoa(e.Step.Num) + " \"" + e.Step.Name + "\": " + e.Step.Message
+	if e.Canceled {
+		msg = msg + ", документ аннулирован"
+	}
+	return msg
+}
+
+//CheckSession сессия формирования документа: фиксирует каждый шаг и аннулирует документ при ошибке
+type CheckSession struct {
+	mu     sync.Mutex
+	kkm    *drv.KkmDrv
+	pass   []byte
+	ProcID int `json:"procid"`
+	//Документ открыт в ККТ
+	Opened bool `json:"opened"`
+	//Документ закрыт (сформирован) или аннулирован
+	Done bool `json:"done"`
+	//Срок аренды сессии, нулевое значение - без ограничения
+	Expires time.Time   `json:"expires"`
+	Steps   []CheckStep `json:"steps"`
+	failed  *StepError
+	lease   time.Duration
+	//inflight шаг выполняется (1), сессию нельзя аннулировать по аренде
+	inflight int32
+}
+
+//newCheckSession новая сессия документа, lease > 0 - время жизни без обращений клиента
+func newCheckSession(kkm *drv.KkmDrv, procid int, pass []byte, lease time.Duration) *CheckSession {
+	s := &CheckSession{kkm: kkm, pass: pass, ProcID: procid, lease: lease}
+	s.touch()
+	return s
+}
+
+func (s *CheckSession) touch() {
+	if s.lease > 0 {
+		s.Expires = time.Now().Add(s.lease)
+	}
+}
+
+//run выполнит шаг и зафиксирует результат, при ошибке аннулирует документ
+func (s *CheckSession) run(name string, f func() (byte, error)) error {
+	if s.failed != nil {
+		return s.failed
+	}
+	s.touch()
+	atomic.StoreInt32(&s.inflight, 1)
+	defer atomic.StoreInt32(&s.inflight, 0)
+	st := CheckStep{Num: len(s.Steps) + 1, Name: name, Time: time.Now()}
+	errcode, err := f()
+	//шаг мог долго ждать заправки бумаги, аренда отсчитывается от его окончания
+	s.touch()
+	if errcode > 0 || err != nil {
+		st.Error = true
+		if errcode > 0 {
+			st.Message = s.kkm.ParseErrState(errcode)
+		} else {
+			st.Message = err.Error()
+		}
+		s.Steps = append(s.Steps, st)
+		s.failed = &StepError{Step: st}
+		s.failed.Canceled = s.cancel("ошибка шага " + strconv.Itoa(st.Num))
+		return s.failed
+	}
+	st.Message = "ok"
+	s.Steps = append(s.Steps, st)
+	return nil
+}
+
+//cancel аннулирует открытый документ, вернет true если документ аннулирован
+func (s *CheckSession) cancel(reason string) bool {
+	if !s.Opened || s.Done {
+		return false
+	}
+	st := CheckStep{Num: len(s.Steps) + 1, Name: "аннулирование документа", Time: time.Now(), Message: reason}
+	errcode, err := s.kkm.CancelCheck(s.pass)
+	if errcode > 0 || err != nil {
+		st.Error = true
+		if errcode > 0 {
+			st.Message = reason + ": " + s.kkm.ParseErrState(errcode)
+		} else {
+			st.Message = reason + ": " + err.Error()
+		}
+		log.Printf("сессия чека %s: не удалось аннулировать документ: %s", s.kkm.DeviceID, st.Message)
+	} else {
+		s.Done = true
+		journalDone(s.kkm.DeviceID)
+	}
+	s.Steps = append(s.Steps, st)
+	return s.Done
+}
+
+//Open выполнит шаг открытия документа
+func (s *CheckSession) Open(name string, f func() (byte, error)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	//журнал пишется до открытия, чтобы после сбоя найти брошенный документ
+	journalWrite(s.kkm.DeviceID, s.ProcID, name)
+	if err := s.run(name, f); err != nil {
+		//документ не открыт, аннулировать нечего - запись журнала закроем сразу
+		journalDone(s.kkm.DeviceID)
+		return err
+	}
+	s.Opened = true
+	return nil
+}
+
+//Do выполнит шаг формирования открытого документа
+func (s *CheckSession) Do(name string, f func() (byte, error)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.run(name, f)
+}
+
+//Close выполнит шаг закрытия документа
+func (s *CheckSession) Close(name string, f func() (byte, error)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	journalWrite(s.kkm.DeviceID, s.ProcID, name)
+	if err := s.run(name, f); err != nil {
+		return err
+	}
+	s.Done = true
+	journalDone(s.kkm.DeviceID)
+	return nil
+}
+
+//Cancel аннулирует документ по запросу
+func (s *CheckSession) Cancel(reason string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cancel(reason)
+}
+
+//cancelExpired аннулирует документ, если аренда сессии все еще истекла
+func (s *CheckSession) cancelExpired(now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Done || s.Expires.IsZero() || !now.After(s.Expires) {
+		return false
+	}
+	return s.cancel("истекла аренда сессии")
+}
+
+//Report копия шагов сессии
+func (s *CheckSession) Report() gin.H {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	steps := make([]CheckStep, len(s.Steps))
+	copy(steps, s.Steps)
+	return gin.H{"procid": s.ProcID, "opened": s.Opened, "done": s.Done, "expires": s.Expires, "steps": steps}
+}
+
+//CheckSessionList сессии документов низкоуровневого api по ККТ
+type CheckSessionList struct {
+	mu   sync.Mutex
+	sess map[string]*CheckSession
+}
+
+//CheckSessions экземпляр списка сессий
+var CheckSessions = CheckSessionList{sess: make(map[string]*CheckSession)}
+
+//Begin зарегистрирует сессию ККТ, брошенная прежняя сессия аннулируется
+func (l *CheckSessionList) Begin(deviceID string, s *CheckSession) {
+	l.mu.Lock()
+	prev := l.sess[deviceID]
+	l.sess[deviceID] = s
+	l.mu.Unlock()
+	if prev != nil {
+		prev.Cancel("начата новая сессия")
+	}
+}
+
+//Get вернет незавершенную сессию ККТ для процесса procid
+func (l *CheckSessionList) Get(deviceID string, procid int) (*CheckSession, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s, ok := l.sess[deviceID]
+	if !ok || s.ProcID != procid {
+		return nil, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s, !s.Done
+}
+
+//Last вернет последнюю сессию ККТ
+func (l *CheckSessionList) Last(deviceID string) (*CheckSession, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s, ok := l.sess[deviceID]
+	return s, ok
+}
+
+//expired сессии с истекшей арендой
+func (l *CheckSessionList) expired(now time.Time) map[string]*CheckSession {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ret := make(map[string]*CheckSession)
+	for id, s := range l.sess {
+		if atomic.LoadInt32(&s.inflight) == 1 {
+			//шаг еще выполняется, например ждет заправки бумаги
+			continue
+		}
+		s.mu.Lock()
+		if !s.Done && !s.Expires.IsZero() && now.After(s.Expires) {
+			ret[id] = s
+		}
+		s.mu.Unlock()
+	}
+	return ret
+}
+
+//runCheckSessionReaper аннулирует документы брошенных сессий
+func runCheckSessionReaper() {
+	for {
+		time.Sleep(5 * time.Second)
+		now := time.Now()
+		for id, s := range CheckSessions.expired(now) {
+			st := s.kkm.GetState()
+			if st.Busy && st.ProcID != s.ProcID {
+				//ККТ занята другим процессом, аннулируем на следующем опросе
+				continue
+			}
+			//аннулируем, заняв ККТ, чтобы между командами не вклинились другие процессы
+			s.kkm.SetBusy(s.ProcID)
+			if s.cancelExpired(now) {
+				log.Printf("сессия чека %s: аренда истекла, документ аннулирован", id)
+			}
+			//вернем прежнюю занятость: ККТ могла быть занята самим процессом сессии
+			if st.Busy {
+				s.kkm.SetBusy(st.ProcID)
+			} else {
+				s.kkm.SetBusy(0)
+			}
+		}
+	}
+}
+
+//sessionStep выполнит шаг низкоуровневого api в сессии процесса (если она есть) и ответит клиенту при ошибке
+func sessionStep(c *gin.Context, kkm *drv.KkmDrv, procid int, name string, f func() (byte, error)) bool {
+	s, ok := CheckSessions.Get(kkm.DeviceID, procid)
+	if !ok {
+		errcode, err := f()
+		if errcode > 0 {
+			c.JSON(http.StatusOK, gin.H{"error": true, "message": kkm.ParseErrState(errcode)})
+			return false
+		}
+		if err != nil {
+			c.JSON(http.StatusOK, gin.H{"error": true, "message": err.Error()})
+			return false
+		}
+		return true
+	}
+	if err := s.Do(name, f); err != nil {
+		replyStepError(c, s, err)
+		return false
+	}
+	return true
+}
+
+//replyStepError ответ с отчетом о шагах сессии
+func replyStepError(c *gin.Context, s *CheckSession, err error) {
+	h := s.Report()
+	h["error"] = true
+	h["message"] = err.Error()
+	if se, ok := err.(*StepError); ok {
+		h["step"] = se.Step
+		h["canceled"] = se.Canceled
+	}
+	c.JSON(http.StatusOK, h)
+}
+
+//getCheckSession отчет о шагах текущей (последней) сессии документа ККТ
+func getCheckSession(c *gin.Context) {
+	deviceID := c.Param("DeviceID")
+	if _, err := KkmServ.GetDrv(deviceID); err != nil {
+		c.JSON(http.StatusOK, gin.H{"error": true, "message": "deviceID не зарегистрирован"})
+		return
+	}
+	s, ok := CheckSessions.Last(deviceID)
+	if !ok {
+		c.JSON(http.StatusOK, gin.H{"error": true, "message": "сессий документа нет"})
+		return
+	}
+	h := s.Report()
+	h["error"] = false
+	h["message"] = "ok"
+	c.JSON(http.StatusOK, h)
+}
@@ -144,6 +144,21 @@ func closeShift(c *gin.Context) {
 		return
 	}
 
+	//тег 1203 ИНН Кассира
+	//Тег 1021 — кассир. В печатных документах — «КАССИР». Сюда должны вноситься «должность и фамилия лица, осуществившего расчет с покупателем
+	//реквизиты проверяются до начала отчета: ошибка после него оставит отчет смены незавершенным
+	tags := cashierTags(inp.CashierName, inp.CashierINN)
+	if len(inp.SaleAddress) > 0 {
+		tags = append(tags, tagValue{1009, inp.SaleAddress})
+	}
+	if len(inp.SaleLocation) > 0 {
+		tags = append(tags, tagValue{1187, inp.SaleLocation})
+	}
+	if err = checkTagValues(kkm, tags); err != nil {
+		c.XML(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
 	/*
 		Начать закрытие смены
 		Код команды FF42h . Длина сообщения: 6 байт.
@@ -180,19 +195,10 @@ func closeShift(c *gin.Context) {
 		kkm.SetState(1, state.SubState, state.Flag, state.FlagFP)
 	} else {
 		//отправим tlv с параметрами и close смену ФН
-		//тег 1203 ИНН Кассира
-		//Тег 1021 — кассир. В печатных документах — «КАССИР». Сюда должны вноситься «должность и фамилия лица, осуществившего расчет с покупателем
-		if len(inp.CashierINN) > 0 {
-			kkm.FNSendTLV(admpass, 1203, []byte(inp.CashierINN))
-		}
-		if len(inp.CashierName) > 0 {
-			kkm.FNSendTLV(admpass, 021, []byte(encodeWindows1251(inp.CashierName)))
-		}
-		if len(inp.SaleAddress) > 0 {
-			kkm.FNSendTLV(admpass, 1009, []byte(encodeWindows1251(inp.SaleAddress)))
-		}
-		if len(inp.SaleLocation) > 0 {
-			kkm.FNSendTLV(admpass, 1187, []byte(encodeWindows1251(inp.SaleLocation)))
+		if err = sendTagValues(kkm, admpass, tags); err != nil {
+			log.Printf("kkmCloseShift: %v", err)
+			c.XML(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
 		}
 		//теперь close
 		/*Код ошибки: 1 байт
@@ -351,20 +357,17 @@ func closeShift(c *gin.Context) {
 	Номер документа для ОФД первого в очереди: 4 байта [4:8]
 	Дата и время документа для ОФД первого в очереди: 5 бай [8:13]
 	*/
-	errcode, _, err = kkm.SendCommand(0xff39, admpass)
+	ofd, errcode, err := kkm.FNGetOFDStatus()
 	if errcode > 0 {
 		c.XML(http.StatusBadRequest, gin.H{"error": kkm.ParseErrState(errcode)})
 		return
 	}
-	/*Количество непереданных документов
-	BacklogDocumentsCounter int `xml:"BacklogDocumentsCounter,attr" binding:"-"`
-	//Номер первого непереданного документа
-	BacklogDocumentFirstNumber int `xml:"BacklogDocumentFirstNumber,attr" binding:"-"`
-	//Дата и время первого из непереданных документов
-	BacklogDocumentFirstDateTime string `xml:"BacklogDocumentFirstDateTime,attr" binding:"-"`*/
-	out.BacklogDocumentsCounter = int(btoi(data[2:4]))
-	out.BacklogDocumentFirstNumber = int(btoi(data[4:8]))
-	out.BacklogDocumentFirstDateTime = time.Unix(btoi(data[8:13]), 0).Format("2006-01-02 15:04:05")
+	OFDMon.Update(deviceID, ofd, err)
+	out.BacklogDocumentsCounter = ofd.Count
+	out.BacklogDocumentFirstNumber = int(ofd.FirstNumber)
+	if ofd.Count > 0 {
+		out.BacklogDocumentFirstDateTime = ofd.FirstDateTime.Format("2006-01-02 15:04:05")
+	}
 
 	c.XML(http.StatusBadRequest, out)
 }
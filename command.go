@@ -2,8 +2,10 @@ package main
 
 import (
 	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"kkm-shtrih/drv"
+	"kkm-shtrih/drv/tlv"
 	"log"
 	"math"
 	"net/http"
@@ -428,13 +430,13 @@ func release(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{"error": true, "message": "procid не верен"})
 		return
 	}
-	state, err := kkm.GetStatus()
-	if err != nil {
-		if state == 88 {
-			//ждем ппродолжить печать
-			kkm.ContinuePrint([]byte{})
-		}
-		kkm.SetBusy(0)
+	//незавершенный чек процесса аннулируем
+	if sess, ok := CheckSessions.Get(deviceID, procid); ok {
+		sess.Cancel("освобождение ККТ")
+	}
+	if _, err = kkm.GetStatus(); err == nil && kkm.GetState().SubState == drv.SubStateWaitContinue {
+		//бумага заправлена, ККТ ждет продолжения печати
+		kkm.ContinuePrint([]byte{})
 	}
 
 	//if state>=80 {
@@ -519,9 +521,12 @@ func openCheck(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{"error": true, "message": "CheckType не верен"})
 		return
 	}
-	errcode, err = kkm.OpenCheck(pass, chktype)
-	if errcode > 0 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": true, "message": kkm.ParseErrState(errcode)})
+	//сессия чека: при ошибке любого шага или истечении аренды (?lease=сек) чек аннулируется
+	lease, _ := getIntParam(c, "lease", int(CHECKSESSIONLEASE/time.Second))
+	sess := newCheckSession(kkm, procid, pass, time.Duration(lease)*time.Second)
+	CheckSessions.Begin(deviceID, sess)
+	if err = sess.Open("открытие чека", func() (byte, error) { return kkm.OpenCheck(pass, chktype) }); err != nil {
+		replyStepError(c, sess, err)
 		return
 	}
 
@@ -621,9 +626,9 @@ func fnOperation(c *gin.Context) {
 	7	Оплата кредита*/
 	//PaymentItemSign - признак предмета расчета,
 	//StringForPrinting - наименование товара.
-	errcode, _ := kkm.FNOperation(pass, checkType, quantity, price, summ1, taxval, tax1, department, paymentTypeSign, paymentItemSign, stringForPrinting)
-	if errcode > 0 {
-		c.JSON(http.StatusOK, gin.H{"error": true, "message": kkm.ParseErrState(errcode)})
+	if !sessionStep(c, kkm, procid, "операция "+stringForPrinting, func() (byte, error) {
+		return kkm.FNOperation(pass, checkType, quantity, price, summ1, taxval, tax1, department, paymentTypeSign, paymentItemSign, stringForPrinting)
+	}) {
 		return
 	}
 	hdata["procid"] = procid
@@ -649,21 +654,27 @@ func printString(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{"error": true, "message": "ККТ занята"})
 		return
 	}
-	var pass []byte
-	spass, ok := c.GetQuery("pass")
-	if !ok {
-		pass = kkm.GetAdminPass()
+	pass := kkm.GetAdminPass()
+	if spass, ok := c.GetQuery("pass"); ok {
+		ipass, err := strconv.Atoi(spass)
+		if err != nil {
+			c.JSON(http.StatusOK, gin.H{"error": true, "message": "Пароль должен быть числовым"})
+			return
+		}
+		pass = itob(int64(ipass))[:4]
 	}
-	ipass, err := strconv.Atoi(spass)
+	//строка может содержать разметку (textmarkup.go), ?tape= receipt, control, both
+	tape, err := tapeFlags(c.Query("tape"))
 	if err != nil {
-		c.JSON(http.StatusOK, gin.H{"error": true, "message": "Пароль должен быть числовым"})
+		c.JSON(http.StatusOK, gin.H{"error": true, "message": err.Error()})
 		return
 	}
-	pass = itob(int64(ipass))[:4]
-	str := c.Query("printstring")
-	errcode, err := kkm.PrintString(pass, str)
-	if errcode > 0 {
-		c.JSON(http.StatusOK, gin.H{"error": true, "message": kkm.ParseErrState(errcode)})
+	lines, err := parseMarkup(c.Query("printstring"))
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"error": true, "message": err.Error()})
+		return
+	}
+	if !sessionStep(c, kkm, procid, "печать строки", func() (byte, error) { return printMarkup(kkm, pass, tape, lines) }) {
 		return
 	}
 	hdata["procid"] = procid
@@ -700,10 +711,17 @@ func cancelCheck(c *gin.Context) {
 		return
 	}
 	pass = itob(int64(ipass))[:4]
-	errcode, err := kkm.CancelCheck(pass)
-	if errcode > 0 {
-		c.JSON(http.StatusOK, gin.H{"error": true, "message": kkm.ParseErrState(errcode)})
-		return
+	if sess, ok := CheckSessions.Get(deviceID, procid); ok {
+		if !sess.Cancel("по запросу клиента") {
+			replyStepError(c, sess, errors.New("чек не аннулирован"))
+			return
+		}
+	} else {
+		errcode, _ := kkm.CancelCheck(pass)
+		if errcode > 0 {
+			c.JSON(http.StatusOK, gin.H{"error": true, "message": kkm.ParseErrState(errcode)})
+			return
+		}
 	}
 	hdata["procid"] = procid
 	hdata["error"] = false
@@ -778,9 +796,19 @@ func closeCheck(c *gin.Context) {
 	}
 	printstring := c.Query("printstring")
 
-	retsum, checkNumber, fiscalSign, dtime, errcode, err := kkm.CloseCheck(pass, summa, vta, byte(taxsystem), 0, printstring)
-	if errcode > 0 {
-		c.JSON(http.StatusOK, gin.H{"error": true, "message": kkm.ParseErrState(errcode)})
+	var retsum float64
+	var checkNumber int
+	var fiscalSign, dtime string
+	closef := func() (errcode byte, err error) {
+		retsum, checkNumber, fiscalSign, dtime, errcode, err = kkm.CloseCheck(pass, summa, vta, byte(taxsystem), 0, printstring)
+		return errcode, err
+	}
+	if sess, ok := CheckSessions.Get(deviceID, procid); ok {
+		if err = sess.Close("закрытие чека", closef); err != nil {
+			replyStepError(c, sess, err)
+			return
+		}
+	} else if !sessionStep(c, kkm, procid, "закрытие чека", closef) {
 		return
 	}
 	hdata["retsum"] = retsum
@@ -794,6 +822,32 @@ func closeCheck(c *gin.Context) {
 	c.JSON(http.StatusOK, hdata)
 }
 
+//bindTag читает из тела запроса json {"tag": номер тега, "value": значение} и кодирует значение по словарю тегов
+func bindTag(c *gin.Context, kkm *drv.KkmDrv, scope tlv.Scope) (tlv.TLV, error) {
+	var inp struct {
+		Tag   uint16      `json:"tag" binding:"required"`
+		Value interface{} `json:"value" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&inp); err != nil {
+		return tlv.TLV{}, errors.New("bad request " + err.Error())
+	}
+	d, ok := tlv.Lookup(inp.Tag)
+	if !ok {
+		return tlv.TLV{}, errors.New("тег " + strconv.Itoa(int(inp.Tag)) + " не найден в словаре")
+	}
+	if d.Scope != scope {
+		switch d.Scope {
+		case tlv.ScopeOperation:
+			return tlv.TLV{}, errors.New("тег " + strconv.Itoa(int(inp.Tag)) + " относится к предмету расчета, используйте FNSendTagOperation")
+		case tlv.ScopeCheck:
+			return tlv.TLV{}, errors.New("тег " + strconv.Itoa(int(inp.Tag)) + " относится к чеку, используйте FNSendTag")
+		default:
+			return tlv.TLV{}, errors.New("тег " + strconv.Itoa(int(inp.Tag)) + " формирует ФН, передать его нельзя")
+		}
+	}
+	return kkm.EncodeTag(inp.Tag, inp.Value)
+}
+
 func fnSendTagOperation(c *gin.Context) {
 	hdata := make(map[string]interface{})
 	deviceID := c.Param("DeviceID")
@@ -822,6 +876,24 @@ func fnSendTagOperation(c *gin.Context) {
 		return
 	}
 	pass = itob(int64(ipass))[:4]
+	if c.ContentType() == "application/json" {
+		//{"tag":1229,"value":12.5} значение кодируется по словарю тегов
+		t, err := bindTag(c, kkm, tlv.ScopeOperation)
+		if err != nil {
+			c.JSON(http.StatusOK, gin.H{"error": true, "message": err.Error()})
+			return
+		}
+		if !sessionStep(c, kkm, procid, "тег "+strconv.Itoa(int(t.Tag)), func() (byte, error) { return kkm.FNSendTLVOperation(pass, t.Tag, t.Value) }) {
+			return
+		}
+		hdata["procid"] = procid
+		hdata["tag"] = t.Tag
+		hdata["tlv"] = hex.EncodeToString(t.Bytes())
+		hdata["error"] = false
+		hdata["message"] = "ok"
+		c.JSON(http.StatusOK, hdata)
+		return
+	}
 	steg, ok := c.GetQuery("teg")
 	if !ok {
 		c.JSON(http.StatusOK, gin.H{"error": true, "message": "Тег должен быть числовым"})
@@ -836,9 +908,7 @@ func fnSendTagOperation(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{"error": true, "message": "Не указано значение тега"})
 	}
 
-	errcode, err := kkm.FNSendTLVOperation(pass, uint16(teg), encodeWindows1251(val))
-	if errcode > 0 {
-		c.JSON(http.StatusOK, gin.H{"error": true, "message": kkm.ParseErrState(errcode)})
+	if !sessionStep(c, kkm, procid, "тег "+steg, func() (byte, error) { return kkm.FNSendTLVOperation(pass, uint16(teg), encodeWindows1251(val)) }) {
 		return
 	}
 	hdata["procid"] = procid
@@ -878,6 +948,24 @@ func fnSendTag(c *gin.Context) {
 		return
 	}
 	pass = itob(int64(ipass))[:4]
+	if c.ContentType() == "application/json" {
+		//{"tag":1008,"value":"alex2000@mail.ru"} значение кодируется по словарю тегов
+		t, err := bindTag(c, kkm, tlv.ScopeCheck)
+		if err != nil {
+			c.JSON(http.StatusOK, gin.H{"error": true, "message": err.Error()})
+			return
+		}
+		if !sessionStep(c, kkm, procid, "тег "+strconv.Itoa(int(t.Tag)), func() (byte, error) { return kkm.FNSendTLV(pass, t.Tag, t.Value) }) {
+			return
+		}
+		hdata["procid"] = procid
+		hdata["tag"] = t.Tag
+		hdata["tlv"] = hex.EncodeToString(t.Bytes())
+		hdata["error"] = false
+		hdata["message"] = "ok"
+		c.JSON(http.StatusOK, hdata)
+		return
+	}
 	steg, ok := c.GetQuery("teg")
 	if !ok {
 		c.JSON(http.StatusOK, gin.H{"error": true, "message": "Тег должен быть числовым"})
@@ -892,9 +980,7 @@ func fnSendTag(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{"error": true, "message": "Не указано значение тега"})
 	}
 
-	errcode, err := kkm.FNSendTLV(pass, uint16(teg), encodeWindows1251(val))
-	if errcode > 0 {
-		c.JSON(http.StatusOK, gin.H{"error": true, "message": kkm.ParseErrState(errcode)})
+	if !sessionStep(c, kkm, procid, "тег "+steg, func() (byte, error) { return kkm.FNSendTLV(pass, uint16(teg), encodeWindows1251(val)) }) {
 		return
 	}
 	hdata["procid"] = procid
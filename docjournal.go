@@ -0,0 +1,318 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"kkm-shtrih/drv"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	bolt "go.etcd.io/bbolt"
+)
+
+//RECOVERYPOLICY действие с незавершенным документом после сбоя:
+//auto - открытый документ аннулируется, остановленная печать продолжается; manual - только запись в журнал
+var RECOVERYPOLICY = "auto"
+
+//JournalEntry запись журнала незавершенного документа, пишется до открытия документа в ККТ
+type JournalEntry struct {
+	DeviceID string    `json:"deviceID"`
+	ProcID   int       `json:"procid"`
+	Started  time.Time `json:"started"`
+	Updated  time.Time `json:"updated"`
+	//Последний начатый шаг документа
+	Step string `json:"step"`
+}
+
+//RecoveryEvent запись журнала восстановления после сбоя
+type RecoveryEvent struct {
+	Time     time.Time     `json:"time"`
+	DeviceID string        `json:"deviceID"`
+	Trigger  string        `json:"trigger"`
+	Mode     int           `json:"mode"`
+	SubMode  int           `json:"submode"`
+	Journal  *JournalEntry `json:"journal,omitempty"`
+	//cancel - документ аннулирован, continue - продолжена печать, none - действий нет
+	Action  string `json:"action"`
+	Error   bool   `json:"error"`
+	Message string `json:"message"`
+}
+
+//recovering ККТ, для которых выполняется восстановление
+var recovering = struct {
+	sync.Mutex
+	dev map[string]bool
+}{dev: make(map[string]bool)}
+
+//initDocJournal создаст хранилища журнала документов и журнала восстановления
+func initDocJournal() error {
+	return DB.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists([]byte("DocJournal")); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists([]byte("RecoveryEvents"))
+		return err
+	})
+}
+
+//journalWrite запишет шаг документа ККТ до его выполнения
+func journalWrite(deviceID string, procid int, step string) {
+	now := time.Now()
+	err := DB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("DocJournal"))
+		e := JournalEntry{DeviceID: deviceID, ProcID: procid, Started: now}
+		if v := b.Get([]byte(deviceID)); v != nil {
+			json.Unmarshal(v, &e)
+		}
+		e.ProcID = procid
+		e.Updated = now
+		e.Step = step
+		v, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(deviceID), v)
+	})
+	if err != nil {
+		log.Printf("журнал документов %s: %v", deviceID, err)
+	}
+}
+
+//journalDone удалит запись завершенного (сформированного или аннулированного) документа
+func journalDone(deviceID string) {
+	err := DB.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("DocJournal")).Delete([]byte(deviceID))
+	})
+	if err != nil {
+		log.Printf("журнал документов %s: %v", deviceID, err)
+	}
+}
+
+func journalGet(deviceID string) *JournalEntry {
+	var e *JournalEntry
+	DB.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket([]byte("DocJournal")).Get([]byte(deviceID))
+		if v == nil {
+			return nil
+		}
+		e = &JournalEntry{}
+		return json.Unmarshal(v, e)
+	})
+	return e
+}
+
+//recordRecoveryEvent запишет действие восстановления в журнал
+func recordRecoveryEvent(ev RecoveryEvent) {
+	ev.Time = time.Now()
+	log.Printf("восстановление %s [%s/%s]: %s", ev.DeviceID, ev.Trigger, ev.Action, ev.Message)
+	v, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	err = DB.Update(func(tx *bolt.Tx) error {
+		return putEvent(tx.Bucket([]byte("RecoveryEvents")), ev.Time, ev.DeviceID, v)
+	})
+	if err != nil {
+		log.Printf("журнал восстановления: %v", err)
+	}
+}
+
+//recoverDocument сверит режим ККТ с журналом документов и завершит брошенный документ по политике policy.
+//Документ процесса, который сейчас занимает ККТ, не трогаем.
+func recoverDocument(kkm *drv.KkmDrv, trigger, policy string) {
+	recovering.Lock()
+	if recovering.dev[kkm.DeviceID] {
+		recovering.Unlock()
+		return
+	}
+	recovering.dev[kkm.DeviceID] = true
+	recovering.Unlock()
+	defer func() {
+		recovering.Lock()
+		delete(recovering.dev, kkm.DeviceID)
+		recovering.Unlock()
+	}()
+
+	if kkm.GetState().Busy {
+		return
+	}
+	//займем ккм
+	procid := int(time.Now().Unix())
+	kkm.SetBusy(procid)
+	//освободим по завершению
+	defer kkm.SetBusy(0)
+
+	ev := RecoveryEvent{DeviceID: kkm.DeviceID, Trigger: trigger, Action: "none", Journal: journalGet(kkm.DeviceID)}
+	mode, err := kkm.GetStatus()
+	if err != nil {
+		if ev.Journal != nil {
+			ev.Error = true
+			ev.Message = "режим ККТ не получен: " + err.Error()
+			recordRecoveryEvent(ev)
+		}
+		return
+	}
+	ev.Mode = mode
+	ev.SubMode = int(kkm.GetState().SubState)
+	opened := mode == 8
+	stopped := ev.SubMode == 2 || ev.SubMode == 3
+	if !opened && !stopped {
+		if ev.Journal != nil {
+			//документ завершен до сбоя или аннулирован ККТ
+			journalDone(kkm.DeviceID)
+			ev.Message = "открытых документов нет, запись журнала \"" + ev.Journal.Step + "\" закрыта"
+			recordRecoveryEvent(ev)
+		}
+		return
+	}
+	if policy != "auto" {
+		ev.Error = true
+		if opened {
+			ev.Message = "в ККТ открыт документ, требуется ручное завершение"
+		} else {
+			ev.Message = "печать документа остановлена, требуется ручное продолжение"
+		}
+		recordRecoveryEvent(ev)
+		return
+	}
+	if opened && ev.Journal == nil && trigger == "connect" {
+		//документ открыт не сервером (или до ведения журнала), при переподключении не аннулируем
+		ev.Error = true
+		ev.Message = "в ККТ открыт документ, которого нет в журнале"
+		recordRecoveryEvent(ev)
+		return
+	}
+	if ev.SubMode == 2 {
+		//нет бумаги, продолжить печать можно только после ее заправки
+		ev.Error = true
+		ev.Message = "печать документа остановлена: нет бумаги"
+		recordRecoveryEvent(ev)
+		return
+	}
+	if ev.SubMode == 3 {
+		ev.Action = "continue"
+		if !recoveryStep(kkm, &ev, "печать документа продолжена", kkm.ContinuePrint) {
+			return
+		}
+	}
+	if opened {
+		ev.Action = "cancel"
+		if !recoveryStep(kkm, &ev, "открытый документ аннулирован", kkm.CancelCheck) {
+			return
+		}
+	}
+	journalDone(kkm.DeviceID)
+	recordRecoveryEvent(ev)
+}
+
+//recoveryStep выполнит команду восстановления, при ошибке запишет ее в журнал и вернет false
+func recoveryStep(kkm *drv.KkmDrv, ev *RecoveryEvent, done string, f func(pass []byte) (byte, error)) bool {
+	errcode, err := f(kkm.GetAdminPass())
+	if err == nil && errcode > 0 {
+		err = errors.New(kkm.ParseErrState(errcode))
+	}
+	if err != nil {
+		ev.Error = true
+		ev.Message = ev.Message + err.Error()
+		recordRecoveryEvent(*ev)
+		return false
+	}
+	if len(ev.Message) > 0 {
+		ev.Message = ev.Message + ", "
+	}
+	ev.Message = ev.Message + done
+	return true
+}
+
+//recoverAll проверка незавершенных документов всех ККТ при старте сервера
+func recoverAll() {
+	for _, id := range KkmServ.GetKeys() {
+		kkm, err := KkmServ.GetDrv(id)
+		if err != nil {
+			continue
+		}
+		recoverDocument(kkm, "startup", RECOVERYPOLICY)
+	}
+}
+
+//runConnectRecovery проверка незавершенных документов после переподключения к ККТ.
+//Проверка идет не внутри команды, вызвавшей переподключение, а когда ККТ подключена и свободна
+func runConnectRecovery() {
+	seen := make(map[string]int)
+	for {
+		time.Sleep(5 * time.Second)
+		for _, id := range KkmServ.GetKeys() {
+			kkm, err := KkmServ.GetDrv(id)
+			if err != nil {
+				continue
+			}
+			n := kkm.ConnectCount()
+			last, ok := seen[id]
+			if !ok {
+				//первое подключение проверяется при старте (recoverAll)
+				seen[id] = n
+				continue
+			}
+			if n == last || !kkm.GetConnected() || kkm.GetState().Busy {
+				continue
+			}
+			seen[id] = n
+			recoverDocument(kkm, "connect", RECOVERYPOLICY)
+		}
+	}
+}
+
+//getDocJournal незавершенные документы и журнал восстановления, ?DeviceID= фильтр, ?limit= количество последних записей
+func getDocJournal(c *gin.Context) {
+	deviceID := c.Query("DeviceID")
+	limit, err := getIntParam(c, "limit", 100)
+	if err != nil || limit <= 0 {
+		limit = 100
+	}
+	entries := make([]JournalEntry, 0)
+	events := make([]RecoveryEvent, 0, limit)
+	err = DB.View(func(tx *bolt.Tx) error {
+		tx.Bucket([]byte("DocJournal")).ForEach(func(k, v []byte) error {
+			var e JournalEntry
+			if json.Unmarshal(v, &e) == nil && (len(deviceID) == 0 || e.DeviceID == deviceID) {
+				entries = append(entries, e)
+			}
+			return nil
+		})
+		cur := tx.Bucket([]byte("RecoveryEvents")).Cursor()
+		for k, v := cur.Last(); k != nil && len(events) < limit; k, v = cur.Prev() {
+			var ev RecoveryEvent
+			if err := json.Unmarshal(v, &ev); err != nil {
+				continue
+			}
+			if len(deviceID) == 0 || ev.DeviceID == deviceID {
+				events = append(events, ev)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"error": true, "message": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"error": false, "journal": entries, "events": events})
+}
+
+//recoverDocumentHandler ручная проверка и завершение брошенного документа ККТ независимо от RECOVERYPOLICY
+func recoverDocumentHandler(c *gin.Context) {
+	deviceID := c.Param("DeviceID")
+	kkm, err := KkmServ.GetDrv(deviceID)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"error": true, "message": "deviceID не зарегистрирован"})
+		return
+	}
+	if kkm.ChkBusy(0) {
+		c.JSON(http.StatusOK, gin.H{"error": true, "message": "ККТ занята"})
+		return
+	}
+	recoverDocument(kkm, "manual", "auto")
+	c.JSON(http.StatusOK, gin.H{"error": false, "message": "ok", "journal": journalGet(deviceID)})
+}
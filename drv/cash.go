@@ -0,0 +1,206 @@
+package drv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"time"
+)
+
+//Денежные регистры ККТ
+const (
+	//RegCashBalance накопление наличности в кассе
+	RegCashBalance = 241
+	//RegCashInShift накопление внесений за смену
+	RegCashInShift = 242
+	//RegCashOutShift накопление выплат за смену
+	RegCashOutShift = 243
+)
+
+//CashResult результат внесения/выплаты
+type CashResult struct {
+	//Сквозной номер документа
+	DocumentNumber uint16
+	//Номер смены
+	ShiftNumber uint16
+	//Наличность в кассе после операции
+	CashBalance float64
+	//Дата и время ККТ
+	DateTime time.Time
+}
+
+//CashInOutcome внесение (amount > 0) или выплата (amount < 0) наличных
+func (kkm *KkmDrv) CashInOutcome(pass []byte, amount float64) (CashResult, byte, error) {
+	/*
+		Внесение
+		Команда: 50H. Длина сообщения: 10 байт.
+		Пароль оператора (4 байта)
+		Сумма (5 байт)
+		Ответ: 50H. Длина сообщения: 5 байт.
+		Код ошибки (1 байт)
+		Порядковый номер оператора (1 байт) 1…30
+		Сквозной номер документа (2 байта)
+		Выплата
+		Команда: 51H. Длина сообщения: 10 байт.
+		Параметры и ответ как у 50H
+	*/
+	var res CashResult
+	if amount == 0 {
+		return res, 1, errors.New("сумма внесения/выплаты не должна быть нулевой")
+	}
+	if len(pass) == 0 {
+		pass = kkm.GetAdminPass()
+	}
+	cmd := uint16(0x50)
+	if amount < 0 {
+		cmd = 0x51
+		amount = -amount
+	}
+	param := make([]byte, 9)
+	copy(param, pass[:4])
+	copy(param[4:], money2byte(amount, Digit)[:5])
+	errcode, data, err := kkm.SendCommand(cmd, param)
+	if err != nil {
+		return res, 1, err
+	}
+	if errcode > 0 {
+		return res, errcode, errors.New(kkm.ParseErrState(errcode))
+	}
+	if len(data) >= 3 {
+		res.DocumentNumber = binary.LittleEndian.Uint16(data[1:3])
+	}
+	//итоги операции читаем после ее выполнения, ошибки чтения не отменяют внесение/выплату
+	res.CashBalance, _, _ = kkm.ReadCashRegister(pass, RegCashBalance)
+	res.ShiftNumber, _, _ = kkm.FNGetShiftNumber(pass)
+	res.DateTime, _, _ = kkm.GetDateTime(pass)
+	return res, 0, nil
+}
+
+//ReadCashRegister вернет значение денежного регистра в рублях
+func (kkm *KkmDrv) ReadCashRegister(pass []byte, reg uint16) (float64, byte, error) {
+	/*
+		Запрос денежного регистра
+		Команда: 1AH. Длина сообщения: 6 или 7 байт.
+		Пароль оператора (4 байта)
+		Номер [Ф-]регистра (1 байт) 0… 255 или Номер К-регистра (2 байт) 0…65535
+		Ответ: 1AH. Длина сообщения: 9 байт.
+		Код ошибки (1 байт)
+		Порядковый номер оператора (1 байт) 1…30
+		Содержимое регистра (6 байт)
+	*/
+	if len(pass) == 0 {
+		pass = kkm.GetAdminPass()
+	}
+	param := make([]byte, 5, 6)
+	copy(param, pass[:4])
+	param[4] = byte(reg)
+	if reg > 255 {
+		param = append(param, byte(reg>>8))
+	}
+	errcode, data, err := kkm.SendCommand(0x1a, param)
+	if err != nil {
+		return 0, 1, err
+	}
+	if errcode > 0 {
+		return 0, errcode, errors.New(kkm.ParseErrState(errcode))
+	}
+	if len(data) < 2 {
+		return 0, 1, errors.New("неверная длина ответа денежного регистра")
+	}
+	return float64(uintLE(data[1:])) / math.Pow10(Digit), 0, nil
+}
+
+//FNGetShiftNumber номер текущей (последней) смены ФН
+func (kkm *KkmDrv) FNGetShiftNumber(pass []byte) (uint16, byte, error) {
+	/*Запрос параметров текущей смены
+	Код команды FF40h . Длина сообщения: 6 байт.
+	Пароль системного администратора: 4 байта
+	Ответ: FF40h Длина сообщения: 6 байт.
+	Код ошибки: 1 байт
+	Состояние смены: 1 байт [0]
+	Номер смены : 2 байта  [1:3]
+	Номер чека: 2 байта	[3:]
+	*/
+	if len(pass) == 0 {
+		pass = kkm.GetAdminPass()
+	}
+	errcode, data, err := kkm.SendCommand(0xff40, pass[:4])
+	if err != nil {
+		return 0, 1, err
+	}
+	if errcode > 0 {
+		return 0, errcode, errors.New(kkm.ParseErrState(errcode))
+	}
+	if len(data) < 3 {
+		return 0, 1, errors.New("неверная длина ответа FF40")
+	}
+	return binary.LittleEndian.Uint16(data[1:3]), 0, nil
+}
+
+//GetDateTime дата и время ККТ из полного состояния (11H)
+func (kkm *KkmDrv) GetDateTime(pass []byte) (time.Time, byte, error) {
+	if len(pass) == 0 {
+		pass = kkm.GetAdminPass()
+	}
+	errcode, data, err := kkm.SendCommand(0x11, pass[:4])
+	if err != nil {
+		return time.Now(), 1, err
+	}
+	if errcode > 0 {
+		return time.Now(), errcode, errors.New(kkm.ParseErrState(errcode))
+	}
+	if len(data) < 22 {
+		return time.Now(), 1, errors.New("неверная длина ответа 11H")
+	}
+	//Дата (3 байта) ДД-ММ-ГГ data[16:19], Время (3 байта) ЧЧ-ММ-СС data[19:22]
+	return time.Date(2000+int(data[18]), time.Month(data[17]), int(data[16]), int(data[19]), int(data[20]), int(data[21]), 0, time.Local), 0, nil
+}
+
+//OpenCashDrawer открыть денежный ящик
+func (kkm *KkmDrv) OpenCashDrawer(pass []byte, num byte) (byte, error) {
+	/*
+		Открыть денежный ящик
+		Команда: 28H. Длина сообщения: 6 байт.
+		Пароль оператора (4 байта)
+		Номер денежного ящика (1 байт) 0, 1
+		Ответ: 28H. Длина сообщения: 3 байта.
+		Код ошибки (1 байт)
+		Порядковый номер оператора (1 байт) 1…30
+	*/
+	if len(pass) == 0 {
+		pass = kkm.GetAdminPass()
+	}
+	param := make([]byte, 5)
+	copy(param, pass[:4])
+	param[4] = num
+	errcode, _, err := kkm.SendCommand(0x28, param)
+	if err != nil {
+		return 1, err
+	}
+	if errcode > 0 {
+		return errcode, errors.New(kkm.ParseErrState(errcode))
+	}
+	return 0, nil
+}
+
+//SetOperatorName запишет имя оператора (кассира) в таблицу 2 для печати в нефискальных документах
+func (kkm *KkmDrv) SetOperatorName(pass []byte, operator uint16, name string) (byte, error) {
+	val := encodeWindows1251(name)
+	if len(val) > 21 {
+		val = val[:21]
+	}
+	return kkm.WriteTable(pass, 2, operator, 2, append(val, 0))
+}
+
+//OperatorName прочитает имя оператора (кассира) из таблицы 2
+func (kkm *KkmDrv) OperatorName(pass []byte, operator uint16) (string, byte, error) {
+	data, errcode, err := kkm.ReadTable(pass, 2, operator, 2)
+	if err != nil {
+		return "", errcode, err
+	}
+	if i := bytes.IndexByte(data, 0); i >= 0 {
+		data = data[:i]
+	}
+	return string(decodeWindows1251(data)), 0, nil
+}
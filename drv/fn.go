@@ -0,0 +1,651 @@
+package drv
+
+import (
+	"encoding/binary"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//FNResult результат формирования фискального документа
+type FNResult struct {
+	//Номер ФД
+	DocumentNumber uint32
+	//Фискальный признак
+	FiscalSign uint32
+	//Дата и время документа
+	DateTime time.Time
+}
+
+//FNRegParam параметры регистрации (перерегистрации) ККТ
+type FNRegParam struct {
+	//ИНН пользователя 12 байт ASCII
+	Inn string
+	//Регистрационный номер ККТ 20 байт ASCII
+	RNM string
+	//Код налогообложения Бит 0 – ОСН, Бит 1 – УСН доход, Бит 2 – УСН доход минус расход, Бит 3 – ЕНВД, Бит 4 – ЕСП, Бит 5 – ПСН
+	TaxCode byte
+	//Режим работы Бит 0 – Шифрование, Бит 1 – Автономный режим, Бит 2 – Автоматический режим, Бит 3 – Применение в сфере услуг, Бит 4 – Режим БСО, Бит 5 – Применение в Интернет
+	WorkMode byte
+}
+
+//ParseDateTime разбирает DATE_TIME ФН 5 байт: год, месяц, день, час, минута
+func ParseDateTime(b []byte) time.Time {
+	if len(b) < 5 {
+		return time.Time{}
+	}
+	return time.Date(2000+int(b[0]), time.Month(b[1]), int(b[2]), int(b[3]), int(b[4]), 0, 0, time.Local)
+}
+
+//parseFNResult разбирает ответ команды формирования документа: Номер ФД 4 байта, Фискальный признак 4 байта, [Дата и время 5 байт]
+func parseFNResult(data []byte) FNResult {
+	var res FNResult
+	if len(data) >= 8 {
+		res.DocumentNumber = binary.LittleEndian.Uint32(data[0:4])
+		res.FiscalSign = binary.LittleEndian.Uint32(data[4:8])
+	}
+	if len(data) >= 13 {
+		res.DateTime = ParseDateTime(data[8:13])
+	} else {
+		res.DateTime = time.Now()
+	}
+	return res
+}
+
+//uintLE целое little endian произвольной длины до 8 байт
+func uintLE(b []byte) uint64 {
+	var v uint64
+	if len(b) > 8 {
+		b = b[:8]
+	}
+	for i := len(b) - 1; i >= 0; i-- {
+		v = v<<8 | uint64(b[i])
+	}
+	return v
+}
+
+//padASCII дополняет строку пробелами до длины n
+func padASCII(s string, n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = ' '
+	}
+	copy(b, []byte(s))
+	return b
+}
+
+//ReadTable читает значение поля таблицы
+func (kkm *KkmDrv) ReadTable(pass []byte, table byte, row uint16, field byte) ([]byte, byte, error) {
+	/*
+		Чтение таблицы
+		Команда: 1FH. Длина сообщения: 9 байт.
+		Пароль системного администратора (4 байта)
+		Таблица (1 байт)
+		Ряд (2 байта)
+		Поле (1 байт)
+		Ответ: 1FH. Длина сообщения: (2+X) байт.
+		Код ошибки (1 байт)
+		Значение (X байт) до 40 или до 246 байт
+	*/
+	if len(pass) == 0 {
+		pass = kkm.GetAdminPass()
+	}
+	tabparam := make([]byte, 8)
+	copy(tabparam, pass[:4])
+	tabparam[4] = table
+	binary.LittleEndian.PutUint16(tabparam[5:7], row)
+	tabparam[7] = field
+	errcode, data, err := kkm.SendCommand(0x1f, tabparam)
+	if err != nil {
+		return nil, 1, err
+	}
+	if errcode > 0 {
+		return nil, errcode, errors.New(kkm.ParseErrState(errcode))
+	}
+	return data, 0, nil
+}
+
+//WriteTable запишет значение поля таблицы
+func (kkm *KkmDrv) WriteTable(pass []byte, table byte, row uint16, field byte, val []byte) (byte, error) {
+	/*
+		Запись таблицы
+		Команда: 1EH. Длина сообщения: (9+X) байт.
+		Пароль системного администратора (4 байта)
+		Таблица (1 байт)
+		Ряд (2 байта)
+		Поле (1 байт)
+		Значение (X байт) до 40 или до 246 байт
+		Ответ: 1EH. Длина сообщения: 2 байта.
+		Код ошибки (1 байт)
+	*/
+	if len(pass) == 0 {
+		pass = kkm.GetAdminPass()
+	}
+	tabparam := make([]byte, 8+len(val))
+	copy(tabparam, pass[:4])
+	tabparam[4] = table
+	binary.LittleEndian.PutUint16(tabparam[5:7], row)
+	tabparam[7] = field
+	copy(tabparam[8:], val)
+	errcode, _, err := kkm.SendCommand(0x1e, tabparam)
+	if err != nil {
+		return 1, err
+	}
+	if errcode > 0 {
+		return errcode, errors.New(kkm.ParseErrState(errcode))
+	}
+	return 0, nil
+}
+
+//Отключение печати документов: таблица 17 "Региональные настройки", ряд 1, поле 7
+const (
+	//PrintOn документы печатаются
+	PrintOn byte = 0
+	//PrintOffNext не печатать следующий документ, ККТ сбрасывает настройку после его закрытия
+	PrintOffNext byte = 1
+	//PrintOff не печатать все документы
+	PrintOff byte = 2
+)
+
+//GetPrintMode прочитает настройку отключения печати документов
+func (kkm *KkmDrv) GetPrintMode(pass []byte) (byte, byte, error) {
+	v, errcode, err := kkm.ReadTable(pass, 17, 1, 7)
+	if err != nil {
+		return 0, errcode, err
+	}
+	if len(v) == 0 {
+		return 0, 1, errors.New("пустое значение настройки печати")
+	}
+	return v[0], 0, nil
+}
+
+//SetPrintMode запишет настройку отключения печати документов (электронный чек без печати)
+func (kkm *KkmDrv) SetPrintMode(pass []byte, mode byte) (byte, error) {
+	return kkm.WriteTable(pass, 17, 1, 7, []byte{mode})
+}
+
+//fnDocumentотправит команду формирования документа ФН и разберет номер ФД и фискальный признак
+func (kkm *KkmDrv) fnDocument(cmd uint16, param []byte) (FNResult, byte, error) {
+	errcode, data, err := kkm.SendCommand(cmd, param)
+	if err != nil {
+		return FNResult{}, 1, err
+	}
+	if errcode > 0 {
+		return FNResult{}, errcode, errors.New(kkm.ParseErrState(errcode))
+	}
+	return parseFNResult(data), 0, nil
+}
+
+//FNBeginRegistration начать отчет о регистрации (перерегистрации) ККТ
+func (kkm *KkmDrv) FNBeginRegistration(pass []byte) (byte, error) {
+	/*Начать отчет о регистрации ККТ
+	Код команды FF05h . Длина сообщения: 6 байт.
+	Пароль системного администратора: 4 байта
+	Ответ: FF05h Длина сообщения: 1 байт.
+	Код ошибки: 1 байт*/
+	if len(pass) == 0 {
+		pass = kkm.GetAdminPass()
+	}
+	errcode, _, err := kkm.SendCommand(0xff05, pass[:4])
+	if err != nil {
+		return 1, err
+	}
+	if errcode > 0 {
+		return errcode, errors.New(kkm.ParseErrState(errcode))
+	}
+	return 0, nil
+}
+
+//FNRegistration сформировать отчёт о регистрации ККТ
+func (kkm *KkmDrv) FNRegistration(pass []byte, p FNRegParam) (FNResult, byte, error) {
+	/*Сформировать отчёт о регистрации ККТ
+	Код команды FF06h . Длина сообщения: 40 байт.
+	Пароль системного администратора: 4 байта [0:4]
+	ИНН : 12 байт ASCII [4:16]
+	Регистрационный номер ККТ: 20 байт ASCII [16:36]
+	Код налогообложения: 1 байт [36]
+	Режим работы: 1 байт [37]
+	Ответ: FF06h Длина сообщения: 9 байт.
+	Код ошибки: 1 байт
+	Номер ФД: 4 байта
+	Фискальный признак: 4 байта*/
+	if len(pass) == 0 {
+		pass = kkm.GetAdminPass()
+	}
+	param := make([]byte, 38)
+	copy(param, pass[:4])
+	copy(param[4:16], padASCII(p.Inn, 12))
+	copy(param[16:36], padASCII(p.RNM, 20))
+	param[36] = p.TaxCode
+	param[37] = p.WorkMode
+	return kkm.fnDocument(0xff06, param)
+}
+
+//FNReRegistration сформировать отчёт о перерегистрации ККТ
+func (kkm *KkmDrv) FNReRegistration(pass []byte, reason uint32, ffd11 bool) (FNResult, byte, error) {
+	/*Сформировать отчёт о перерегистрации ККТ
+	Код команды FF34h . Длина сообщения: 7 (10) байт.
+	Пароль системного администратора: 4 байта
+	Код причины перерегистрации: 1 байт (ФФД 1.05, тег 1101)
+		1 – Замена ФН
+		2 – Замена ОФД
+		3 – Изменение реквизитов
+		4 – Изменение настроек ККТ
+	Коды причин изменения сведений о ККТ: 4 байта (ФФД 1.1, тег 1205, битовая маска)
+	Ответ: FF34h Длина сообщения: 9 байт.
+	Код ошибки: 1 байт
+	Номер ФД: 4 байта
+	Фискальный признак: 4 байта*/
+	if len(pass) == 0 {
+		pass = kkm.GetAdminPass()
+	}
+	param := make([]byte, 5, 8)
+	copy(param, pass[:4])
+	if ffd11 {
+		b := make([]byte, 4)
+		binary.LittleEndian.PutUint32(b, reason)
+		param = append(param[:4], b...)
+	} else {
+		if reason > 255 {
+			return FNResult{}, 1, errors.New("код причины перерегистрации " + strconv.FormatUint(uint64(reason), 10) + " не поддерживается ФФД 1.05")
+		}
+		param[4] = byte(reason)
+	}
+	return kkm.fnDocument(0xff34, param)
+}
+
+//FNBeginCloseFiscalMode начать закрытие фискального режима ФН, после нее передаются реквизиты отчета (кассир)
+func (kkm *KkmDrv) FNBeginCloseFiscalMode(pass []byte) (byte, error) {
+	/*Начать закрытие фискального режима
+	Код команды FF3Dh . Длина сообщения: 6 байт.
+	Пароль системного администратора: 4 байта
+	Ответ: FF3Dh Длина сообщения: 1 байт.
+	Код ошибки: 1 байт*/
+	if len(pass) == 0 {
+		pass = kkm.GetAdminPass()
+	}
+	errcode, _, err := kkm.SendCommand(0xff3d, pass[:4])
+	if err != nil {
+		return 1, err
+	}
+	if errcode > 0 {
+		return errcode, errors.New(kkm.ParseErrState(errcode))
+	}
+	return 0, nil
+}
+
+//FNCloseFiscalMode закрыть фискальный режим ФН, перед ней выполняется FNBeginCloseFiscalMode
+func (kkm *KkmDrv) FNCloseFiscalMode(pass []byte) (FNResult, byte, error) {
+	/*Закрыть фискальный режим ФН
+	Код команды FF3Eh . Длина сообщения: 6 байт.
+	Пароль системного администратора: 4 байта
+	Ответ: FF3Eh Длина сообщения: 9 байт.
+	Код ошибки: 1 байт
+	Номер ФД: 4 байта
+	Фискальный признак: 4 байта*/
+	if len(pass) == 0 {
+		pass = kkm.GetAdminPass()
+	}
+	return kkm.fnDocument(0xff3e, pass[:4])
+}
+
+//FNRegInfo итоги последней регистрации (перерегистрации) ККТ
+type FNRegInfo struct {
+	FNRegParam
+	//Дата и время регистрации
+	DateTime time.Time
+	//Расширенные признаки работы ККТ (ФФД 1.1)
+	//Бит 0 – подакцизные товары, Бит 1 – азартные игры, Бит 2 – лотереи, Бит 3 – принтер в автомате
+	ExtWorkMode byte
+	//ФН зарегистрирован по ФФД 1.1
+	FFD11 bool
+	//Расширенные признаки получены (из FF09h для ФФД 1.1 или из таблицы 18)
+	ExtKnown bool
+	//Номер ФД и фискальный признак отчета о регистрации
+	DocumentNumber uint32
+	FiscalSign     uint32
+	//Признаки агента (тег 1057): Бит 0 – банк. пл. агент, Бит 1 – банк. пл. субагент, Бит 2 – пл. агент,
+	//Бит 3 – пл. субагент, Бит 4 – поверенный, Бит 5 – комиссионер, Бит 6 – агент
+	AgentTypes byte
+}
+
+//BSO ККТ зарегистрирована в режиме АС БСО
+func (r FNRegInfo) BSO() bool {
+	return r.WorkMode&0x10 > 0
+}
+
+//Automatic ККТ зарегистрирована в автоматическом режиме
+func (r FNRegInfo) Automatic() bool {
+	return r.WorkMode&0x04 > 0
+}
+
+//Internet ККТ зарегистрирована для расчетов только в Интернет
+func (r FNRegInfo) Internet() bool {
+	return r.WorkMode&0x20 > 0
+}
+
+//Excise ККТ зарегистрирована для продажи подакцизных товаров
+func (r FNRegInfo) Excise() bool {
+	return r.ExtWorkMode&0x01 > 0
+}
+
+//Gambling ККТ зарегистрирована для проведения азартных игр
+func (r FNRegInfo) Gambling() bool {
+	return r.ExtWorkMode&0x02 > 0
+}
+
+//Lottery ККТ зарегистрирована для проведения лотерей
+func (r FNRegInfo) Lottery() bool {
+	return r.ExtWorkMode&0x04 > 0
+}
+
+//FNGetRegistration запрос итогов последней регистрации (перерегистрации) ККТ
+func (kkm *KkmDrv) FNGetRegistration() (FNRegInfo, byte, error) {
+	/*Запрос итогов последней фискализации (перерегистрации)
+	Код команды FF09h . Длина сообщения: 6 байт.
+	Пароль системного администратора: 4 байта
+	Ответ: FF09h Длина сообщения: 48 (65) байт.
+	Код ошибки: 1 байт
+	Дата и время: 5 байт DATE_TIME [0:5]
+	ИНН : 12 байт ASCII [5:17]
+	Регистрационный номер ККT: 20 байт ASCII [17:37]
+	Код налогообложения: 1 байт [37]
+	Режим работы: 1 байт [38]
+	ФФД 1.05: Номер ФД: 4 байта [39:43], Фискальный признак: 4 байта [43:47]
+	ФФД 1.1: Расширенные признаки работы ККТ: 1 байт [39], ИНН ОФД: 12 байт [40:52],
+	Код причины изменения сведений о ККТ: 4 байта [52:56], Номер ФД: 4 байта [56:60], Фискальный признак: 4 байта [60:64]*/
+	var r FNRegInfo
+	errcode, data, err := kkm.SendCommand(0xff09, kkm.GetAdminPass())
+	if err != nil {
+		return r, 1, err
+	}
+	if errcode > 0 {
+		return r, errcode, errors.New(kkm.ParseErrState(errcode))
+	}
+	if len(data) < 47 {
+		return r, 1, errors.New("неверный ответ FF09h")
+	}
+	r.DateTime = ParseDateTime(data[0:5])
+	r.Inn = strings.TrimSpace(string(data[5:17]))
+	r.RNM = strings.TrimSpace(string(data[17:37]))
+	r.TaxCode = data[37]
+	r.WorkMode = data[38]
+	if len(data) >= 64 {
+		r.FFD11 = true
+		r.ExtKnown = true
+		r.ExtWorkMode = data[39]
+		r.DocumentNumber = binary.LittleEndian.Uint32(data[56:60])
+		r.FiscalSign = binary.LittleEndian.Uint32(data[60:64])
+	} else {
+		r.DocumentNumber = binary.LittleEndian.Uint32(data[39:43])
+		r.FiscalSign = binary.LittleEndian.Uint32(data[43:47])
+	}
+	//признаки агента (и расширенные признаки для ФФД 1.05) есть только в таблице 18 "Fiscal storage"
+	if v, errcode, err := kkm.ReadTable(nil, 18, 1, 16); err == nil && errcode == 0 && len(v) > 0 {
+		r.AgentTypes = v[0]
+	}
+	if !r.FFD11 {
+		if v, errcode, err := kkm.ReadTable(nil, 18, 1, 21); err == nil && errcode == 0 && len(v) > 0 {
+			r.ExtKnown = true
+			r.ExtWorkMode = v[0]
+		}
+	}
+	return r, 0, nil
+}
+
+//FNGetFFDVersion вернет true если ФН зарегистрирован по ФФД 1.1 (длина ответа FF09h)
+func (kkm *KkmDrv) FNGetFFDVersion() (bool, byte, error) {
+	r, errcode, err := kkm.FNGetRegistration()
+	return r.FFD11, errcode, err
+}
+
+//FNCorrectionParam параметры чека коррекции
+type FNCorrectionParam struct {
+	//Тип коррекции 0 – самостоятельно, 1 – по предписанию
+	Type byte
+	//Признак расчета 1 – приход, 2 – возврат прихода, 3 – расход, 4 – возврат расхода
+	OperationType byte
+	//Сумма расчета
+	Total float64
+	//Суммы по видам оплаты
+	Cash, Electronic, PrePayment, PostPayment, Barter float64
+	//Суммы налогов по ставкам ("20", "10", "0", "none", "20/120", "10/110")
+	Tax map[string]float64
+	//Система налогообложения 0..5
+	TaxSystem byte
+}
+
+//FNBeginCorrection начать формирование чека коррекции
+func (kkm *KkmDrv) FNBeginCorrection(pass []byte) (byte, error) {
+	/*Начать формирование чека коррекции
+	Код команды FF35h . Длина сообщения: 6 байт.
+	Пароль системного администратора: 4 байта
+	Ответ: FF35h Длина сообщения: 1 байт.
+	Код ошибки: 1 байт*/
+	if len(pass) == 0 {
+		pass = kkm.GetAdminPass()
+	}
+	errcode, _, err := kkm.SendCommand(0xff35, pass[:4])
+	if err != nil {
+		return 1, err
+	}
+	if errcode > 0 {
+		return errcode, errors.New(kkm.ParseErrState(errcode))
+	}
+	return 0, nil
+}
+
+//FNCorrectionCheck сформировать чек коррекции (после FNBeginCorrection и передачи тегов 1174, 1021, 1203)
+func (kkm *KkmDrv) FNCorrectionCheck(pass []byte, p FNCorrectionParam) (FNResult, byte, error) {
+	/*Сформировать чек коррекции V2
+	Код команды FF4Ah . Длина сообщения: 69 байт.
+	Пароль системного администратора: 4 байта [0:4]
+	Тип коррекции: 1 байт [4]
+	Признак расчета: 1 байт [5]
+	Сумма расчёта : 5 байт [6:11]
+	Сумма по чеку наличными: 5 байт [11:16]
+	Сумма по чеку электронными: 5 байт [16:21]
+	Сумма по чеку предоплатой: 5 байт [21:26]
+	Сумма по чеку постоплатой: 5 байт [26:31]
+	Сумма по чеку встречным представлением: 5 байт [31:36]
+	Сумма НДС 20%: 5 байт, Сумма НДС 10%: 5 байт, Сумма расчёта по ставке 0%: 5 байт,
+	Сумма расчёта по чеку без НДС: 5 байт, Сумма НДС 20/120: 5 байт, Сумма НДС 10/110: 5 байт [36:66]
+	Применяемая система налогообложения: 1 байт [66]
+	Ответ: FF4Ah Длина сообщения: 11 байт.
+	Код ошибки: 1 байт
+	Номер чека: 2 байта
+	Номер ФД: 4 байта
+	Фискальный признак: 4 байта*/
+	if len(pass) == 0 {
+		pass = kkm.GetAdminPass()
+	}
+	param := make([]byte, 67)
+	copy(param, pass[:4])
+	param[4] = p.Type
+	param[5] = p.OperationType
+	for i, v := range []float64{p.Total, p.Cash, p.Electronic, p.PrePayment, p.PostPayment, p.Barter} {
+		copy(param[6+i*5:11+i*5], money2byte(v, Digit))
+	}
+	copy(param[36:66], taxParam(p.Tax))
+	param[66] = 0b00000001 << p.TaxSystem
+	errcode, data, err := kkm.SendCommand(0xff4a, param)
+	if err != nil {
+		return FNResult{}, 1, err
+	}
+	if errcode > 0 {
+		return FNResult{}, errcode, errors.New(kkm.ParseErrState(errcode))
+	}
+	if len(data) < 10 {
+		return FNResult{}, 1, errors.New("неверный ответ FF4Ah")
+	}
+	return parseFNResult(data[2:]), 0, nil
+}
+
+//FNReadDocument прочитает фискальный документ из архива ФН в формате TLV
+func (kkm *KkmDrv) FNReadDocument(pass []byte, num uint32) (uint16, []byte, byte, error) {
+	/*Запросить фискальный документ в TLV формате
+	Код команды FF3Ah . Длина сообщения: 10 байт.
+	Пароль системного администратора: 4 байта
+	Номер фискального документа: 4 байта
+	Ответ: FF3Ah Длина сообщения: 5 байт.
+	Код ошибки: 1 байт
+	Тип фискального документа: 2 байта STLV
+	Длина фискального документа: 2 байта
+	Чтение TLV фискального документа
+	Код команды FF3Bh . Длина сообщения: 6 байт.
+	Пароль системного администратора: 4 байта
+	Ответ: FF3Bh Длина сообщения: 1+N байт.
+	Код ошибки: 1 байт
+	TLV структура: N байт
+	Команда FF3Bh повторяется до получения всего документа (ошибка 08h - нет запрошенных данных)*/
+	if len(pass) == 0 {
+		pass = kkm.GetAdminPass()
+	}
+	param := make([]byte, 8)
+	copy(param, pass[:4])
+	binary.LittleEndian.PutUint32(param[4:8], num)
+	errcode, data, err := kkm.SendCommand(0xff3a, param)
+	if err != nil {
+		return 0, nil, 1, err
+	}
+	if errcode > 0 {
+		return 0, nil, errcode, errors.New(kkm.ParseErrState(errcode))
+	}
+	if len(data) < 4 {
+		return 0, nil, 1, errors.New("неверный ответ FF3Ah")
+	}
+	doctype := binary.LittleEndian.Uint16(data[0:2])
+	doclen := int(binary.LittleEndian.Uint16(data[2:4]))
+	doc := make([]byte, 0, doclen)
+	for len(doc) < doclen {
+		errcode, data, err = kkm.SendCommand(0xff3b, pass[:4])
+		if err != nil {
+			return doctype, doc, 1, err
+		}
+		if errcode == 0x08 || (errcode == 0 && len(data) == 0) {
+			break
+		}
+		if errcode > 0 {
+			return doctype, doc, errcode, errors.New(kkm.ParseErrState(errcode))
+		}
+		doc = append(doc, data...)
+	}
+	//часть прошивок отдает документ целиком вместе с тегом типа документа
+	if len(doc) >= 4 && binary.LittleEndian.Uint16(doc[0:2]) == doctype && int(binary.LittleEndian.Uint16(doc[2:4])) == len(doc)-4 {
+		doc = doc[4:]
+	}
+	return doctype, doc, 0, nil
+}
+
+//OFDStatus статус информационного обмена с ОФД
+type OFDStatus struct {
+	//Статус информационного обмена
+	//Бит 0 – транспортное соединение установлено, Бит 1 – есть сообщение для передачи в ОФД,
+	//Бит 2 – ожидание ответного сообщения (квитанции) от ОФД, Бит 3 – есть команда от ОФД,
+	//Бит 4 – изменились настройки соединения с ОФД, Бит 5 – ожидание ответа на команду от ОФД
+	State byte
+	//Состояние чтения сообщения 1 – да, 0 – нет
+	ReadState byte
+	//Количество сообщений для ОФД
+	Count int
+	//Номер документа для ОФД первого в очереди
+	FirstNumber uint32
+	//Дата и время документа для ОФД первого в очереди
+	FirstDateTime time.Time
+}
+
+//FNGetOFDStatus получить статус информационного обмена с ОФД
+func (kkm *KkmDrv) FNGetOFDStatus() (OFDStatus, byte, error) {
+	/*Получить статус информационного обмена
+	Код команды FF39h . Длина сообщения: 6 байт.
+	Пароль системного администратора: 4 байта
+	Ответ: FF39h Длина сообщения: 14 байт.
+	Код ошибки: 1 байт
+	Статус информационного обмена: 1 байт [0]
+	Состояние чтения сообщения: 1 байт (1 – да, 0 –нет)	[1]
+	Количество сообщений для ОФД: 2 байта	[2:4]
+	Номер документа для ОФД первого в очереди: 4 байта [4:8]
+	Дата и время документа для ОФД первого в очереди: 5 байт [8:13]*/
+	var st OFDStatus
+	errcode, data, err := kkm.SendCommand(0xff39, kkm.GetAdminPass())
+	if err != nil {
+		return st, 1, err
+	}
+	if errcode > 0 {
+		return st, errcode, errors.New(kkm.ParseErrState(errcode))
+	}
+	if len(data) < 13 {
+		return st, 1, errors.New("неверный ответ FF39h")
+	}
+	st.State = data[0]
+	st.ReadState = data[1]
+	st.Count = int(binary.LittleEndian.Uint16(data[2:4]))
+	st.FirstNumber = binary.LittleEndian.Uint32(data[4:8])
+	if st.Count > 0 {
+		st.FirstDateTime = ParseDateTime(data[8:13])
+	}
+	return st, 0, nil
+}
+
+//SettlementsReport отчет о текущем состоянии расчетов
+type SettlementsReport struct {
+	FNResult
+	//Количество неподтвержденных (непереданных) документов
+	Backlog uint32
+	//Дата первого неподтвержденного документа
+	FirstDate time.Time
+}
+
+//FNBeginSettlementsReport начать отчет о текущем состоянии расчетов, после нее передаются реквизиты кассира
+func (kkm *KkmDrv) FNBeginSettlementsReport(pass []byte) (byte, error) {
+	/*Начать формирование отчёта о состоянии расчётов
+	Код команды FF37h . Длина сообщения: 6 байт.
+	Пароль системного администратора: 4 байта
+	Ответ: FF37h Длина сообщения: 1 байт.
+	Код ошибки: 1 байт*/
+	if len(pass) == 0 {
+		pass = kkm.GetAdminPass()
+	}
+	errcode, _, err := kkm.SendCommand(0xff37, pass[:4])
+	if err != nil {
+		return 1, err
+	}
+	if errcode > 0 {
+		return errcode, errors.New(kkm.ParseErrState(errcode))
+	}
+	return 0, nil
+}
+
+//FNSettlementsReport сформировать отчет о текущем состоянии расчетов
+func (kkm *KkmDrv) FNSettlementsReport(pass []byte) (SettlementsReport, byte, error) {
+	/*Сформировать отчёт о состоянии расчётов
+	Код команды FF38h . Длина сообщения: 6 байт.
+	Пароль системного администратора: 4 байта
+	Ответ: FF38h Длина сообщения: 16 байт.
+	Код ошибки: 1 байт
+	Номер ФД: 4 байта [0:4]
+	Фискальный признак: 4 байта [4:8]
+	Количество неподтверждённых документов: 4 байта [8:12]
+	Дата первого неподтверждённого документа: 3 байта ГГ,ММ,ДД [12:15]*/
+	var rep SettlementsReport
+	if len(pass) == 0 {
+		pass = kkm.GetAdminPass()
+	}
+	errcode, data, err := kkm.SendCommand(0xff38, pass[:4])
+	if err != nil {
+		return rep, 1, err
+	}
+	if errcode > 0 {
+		return rep, errcode, errors.New(kkm.ParseErrState(errcode))
+	}
+	if len(data) < 12 {
+		return rep, 1, errors.New("неверный ответ FF38h")
+	}
+	rep.FNResult = parseFNResult(data[:8])
+	rep.Backlog = binary.LittleEndian.Uint32(data[8:12])
+	if rep.Backlog > 0 && len(data) >= 15 {
+		rep.FirstDate = time.Date(2000+int(data[12]), time.Month(data[13]), int(data[14]), 0, 0, 0, 0, time.Local)
+	}
+	return rep, 0, nil
+}
@@ -9,8 +9,13 @@ import (
 	"math"
 	"runtime"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"kkm-shtrih/drv/tlv"
 
 	"github.com/tarm/serial"
 
@@ -62,6 +67,10 @@ type KkmDrv struct {
 	Param         KkmParam
 	State         KkmState
 	FNState       KkmFNState
+	//параметры шрифтов, читаются при подключении
+	fonts map[byte]FontParam
+	//число установленных подключений
+	connects int
 }
 
 //KkmParam параметры модели, серийный номер, ИНН и пр
@@ -73,12 +82,20 @@ type KkmParam struct {
 	RNM             string `json:"rnm"` //РНМ
 	//длина строки чека
 	LenLine uint8 `json:"lenline"`
+	//Rounding округление суммы чека в пользу покупателя: none, ruble - до рубля, 10, 50 - до 10 или 50 копеек
+	Rounding string `json:"rounding"`
+	//FontDH номер шрифта двойной высоты (зависит от модели, см. параметры шрифтов 26H), 0 - шрифт двойной ширины
+	FontDH uint8 `json:"fontdh"`
+	//FontBold номер жирного шрифта (зависит от модели), 0 - жирного шрифта нет, {b} печатается двойной шириной (12H)
+	FontBold uint8 `json:"fontbold"`
 	//BarCode height
 	BarCodeH uint8 `json:"barcodeh"`
 	//BarCode width
 	BarCodeW uint8 `json:"barcodew"`
 	//BarCodeAlign положение 2-лево, 0-центр, 3- право
 	BarCodeAlign uint8 `json:"barcodealign"`
+	//BarCodeHRI текст линейного штрихкода: 0 - под штрихкодом (по умолчанию), 1 - над, 2 - под, 3 - над и под, 4 - не печатать
+	BarCodeHRI uint8 `json:"barcodehri"`
 	//PDF417 Number column
 	PDF417NumCol   uint8 `json:"pdf417numcol"`
 	PDF417NumRow   uint8 `json:"pdf417numrow"`
@@ -102,6 +119,29 @@ type KkmParam struct {
 	QRDotSize uint8 `json:"qrdotsize"`
 	//QRErrLevel коррекция ошибок по умолчанию =0
 	QRErrLevel uint8 `json:"qrerrlevel"`
+	//BarCodeGraphics печатать штрихкоды графикой, без команд печати штрихкода ККТ
+	BarCodeGraphics bool `json:"barcodegraphics"`
+}
+
+//HRIPosition позиция текста линейного штрихкода для команды CBH: 0 - нет, 1 - над, 2 - под, 3 - над и под
+func (p KkmParam) HRIPosition() byte {
+	switch p.BarCodeHRI {
+	case 0:
+		return 2
+	case 4:
+		return 0
+	}
+	return p.BarCodeHRI
+}
+
+//copyBarcodeParam копирует параметры печати штрихкодов
+func copyBarcodeParam(dst *KkmParam, src KkmParam) {
+	dst.BarCodeH, dst.BarCodeW, dst.BarCodeAlign, dst.BarCodeHRI = src.BarCodeH, src.BarCodeW, src.BarCodeAlign, src.BarCodeHRI
+	dst.PDF417NumCol, dst.PDF417NumRow, dst.PDF417W, dst.PDF417H, dst.PDF417ErrLevel = src.PDF417NumCol, src.PDF417NumRow, src.PDF417W, src.PDF417H, src.PDF417ErrLevel
+	dst.DMATRScheme, dst.DMATRRotate, dst.DMATRDotSize, dst.DMATRSymbSize = src.DMATRScheme, src.DMATRRotate, src.DMATRDotSize, src.DMATRSymbSize
+	dst.AZTECScheme, dst.AZTECDotSize, dst.AZTECSymbSize, dst.AZTECErrLevel = src.AZTECScheme, src.AZTECDotSize, src.AZTECSymbSize, src.AZTECErrLevel
+	dst.QRVersion, dst.QRMask, dst.QRDotSize, dst.QRErrLevel = src.QRVersion, src.QRMask, src.QRDotSize, src.QRErrLevel
+	dst.BarCodeGraphics = src.BarCodeGraphics
 }
 
 /*
@@ -146,6 +186,8 @@ type KkmState struct {
 	Busy bool
 	//ProcID занята ли ккм
 	ProcID int
+	//BusyAt время занятия ккм или последнего продления занятости, unix
+	BusyAt int64
 	//состояние ккм
 	State byte
 	//состояние ккм
@@ -386,16 +428,140 @@ func (kkm *KkmDrv) CutCheck(pass []byte, tip uint8) (byte, error) {
 	return errcode, err
 }
 
-//PrintString печатает строку чека
+//Флаги ленты для команд печати
+const (
+	//TapeControl контрольная лента
+	TapeControl byte = 1
+	//TapeReceipt чековая лента
+	TapeReceipt byte = 2
+	//TapeBoth контрольная и чековая лента
+	TapeBoth byte = 3
+)
+
+//textParam пароль, параметры head и текст, дополненный нулями до size байт (или длины текста, если он длиннее)
+func textParam(pass []byte, str string, size int, head ...byte) []byte {
+	text := encodeWindows1251(str)
+	if len(text) > size {
+		size = len(text)
+	}
+	tabparam := make([]byte, 4+len(head)+size)
+	copy(tabparam, pass[:4])
+	copy(tabparam[4:], head)
+	copy(tabparam[4+len(head):], text)
+	return tabparam
+}
+
+//PrintString печатает строку чека, длинная строка переносится по длине строки основного шрифта
 func (kkm *KkmDrv) PrintString(pass []byte, str string) (byte, error) {
-	//Пароль оператора (4 байта)
-	//Флаги (1 байт) Бит 0 – контрольная лента, Бит 1 – чековая лента, Бит 2–подкладной документ, Бит 3– слип-чек, Бит 6– перенос строк, Бит 7–отложенная печать
-	//Печатаемые символы6,7,8,9,10 (40 или X байт)
-	tabparam := make([]byte, 45)
+	width := int(kkm.LineLength(1))
+	if width == 0 || utf8.RuneCountInString(str) <= width {
+		return kkm.PrintLine(pass, TapeBoth, 1, str)
+	}
+	for _, l := range WrapText(str, width) {
+		if errcode, err := kkm.PrintLine(pass, TapeBoth, 1, l); errcode > 0 || err != nil {
+			return errcode, err
+		}
+	}
+	return 0, nil
+}
+
+//WrapText перенос текста по словам на ширину width символов. Слово из букв длиннее строки
+//переносится с дефисом, остальные (коды, номера, адреса сайтов) делятся без дефиса.
+func WrapText(s string, width int) []string {
+	if width < 1 {
+		//ширина не известна, перенос невозможен
+		return []string{s}
+	}
+	lines := make([]string, 0, 2)
+	line := ""
+	for _, w := range strings.Fields(s) {
+		for utf8.RuneCountInString(w) > width {
+			if line != "" {
+				lines = append(lines, line)
+				line = ""
+			}
+			r := []rune(w)
+			n := width
+			if width > 2 && letters(r) {
+				n = width - 1
+				lines = append(lines, string(r[:n])+"-")
+			} else {
+				lines = append(lines, string(r[:n]))
+			}
+			w = string(r[n:])
+		}
+		switch {
+		case line == "":
+			line = w
+		case utf8.RuneCountInString(line)+1+utf8.RuneCountInString(w) <= width:
+			line = line + " " + w
+		default:
+			lines = append(lines, line)
+			line = w
+		}
+	}
+	if line != "" || len(lines) == 0 {
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func letters(r []rune) bool {
+	for _, c := range r {
+		if !unicode.IsLetter(c) {
+			return false
+		}
+	}
+	return true
+}
+
+//PrintLine печатает строку шрифтом font на ленте flags (TapeControl, TapeReceipt, TapeBoth)
+func (kkm *KkmDrv) PrintLine(pass []byte, flags, font byte, str string) (byte, error) {
+	/*Печать строки
+	Команда: 17H. Длина сообщения: 46 байт.
+	Пароль оператора (4 байта)
+	Флаги (1 байт) Бит 0 – контрольная лента, Бит 1 – чековая лента, Бит 2–подкладной документ, Бит 3– слип-чек, Бит 6– перенос строк, Бит 7–отложенная печать
+	Печатаемые символы (40 или X байт)
+	Печать строки данным шрифтом
+	Команда: 2FH. Длина сообщения: 47 байт.
+	Пароль оператора (4 байта)
+	Флаги (1 байт)
+	Номер шрифта (1 байт) 0…255
+	Печатаемые символы (40 или X байт)*/
+	if font <= 1 {
+		errcode, _, err := kkm.SendCommand(0x17, textParam(pass, str, 40, flags))
+		return errcode, err
+	}
+	errcode, _, err := kkm.SendCommand(0x2f, textParam(pass, str, 40, flags, font))
+	return errcode, err
+}
+
+//PrintWideLine печатает жирную строку (шрифт двойной ширины)
+func (kkm *KkmDrv) PrintWideLine(pass []byte, flags byte, str string) (byte, error) {
+	/*Печать жирной строки
+	Команда: 12H. Длина сообщения: 26 байт.
+	Пароль оператора (4 байта)
+	Флаги (1 байт) Бит 0 – контрольная лента, Бит 1 – чековая лента
+	Печатаемые символы (20 или X байт)*/
+	errcode, _, err := kkm.SendCommand(0x12, textParam(pass, str, 20, flags))
+	return errcode, err
+}
+
+//FeedDocument протяжка ленты на lines строк
+func (kkm *KkmDrv) FeedDocument(pass []byte, flags, lines byte) (byte, error) {
+	/*Протяжка
+	Команда: 29H. Длина сообщения: 7 байт.
+	Пароль оператора (4 байта)
+	Флаги (1 байт) Бит 0 – контрольная лента, Бит 1 – чековая лента, Бит 2 – подкладной документ
+	Количество строк (1 байт) 1…255
+	Ответ: 29H. Длина сообщения: 3 байта.
+	Код ошибки (1 байт)
+	Порядковый номер оператора (1 байт) 1…30*/
+	tabparam := make([]byte, 6)
 	copy(tabparam, pass[:4])
-	tabparam[4] = 1 //контрольная лента
-	copy(tabparam[5:], encodeWindows1251(string(str)))
-	errcode, _, err := kkm.SendCommand(0x17, tabparam)
+	tabparam[4] = flags
+	tabparam[5] = lines
+	errcode, _, err := kkm.SendCommand(0x29, tabparam)
 	return errcode, err
 }
 
@@ -532,10 +698,19 @@ func (kkm *KkmDrv) Print2dCode(pass []byte, bartype string, barcode []byte) (byt
 	return errcode, err
 }
 
+//ErrBarcodeType тип штрихкода не печатается командами ККТ
+var ErrBarcodeType = errors.New("Не поддерживаемый тип штрихкода")
+
+//ErrBarcodeAlign выравнивание штрихкода не задается командой ККТ
+var ErrBarcodeAlign = errors.New("Выравнивание штрихкода не поддерживается командой ККТ")
+
 //PrintBarCode Печать штрих-кода средствами принтера
 func (kkm *KkmDrv) PrintBarCode(pass []byte, bartype string, barcode []byte) (byte, error) {
 	/*
-		bartype = "EAN8","EAN13", "EAN128", "CODE39", "Code128","Code16k","Code93","PDF417","DataMatrix" ,"QR", "ITF14","EAN13Addon2","EAN13Addon5","GS1DataBarExpandedStacked"
+		bartype = "EAN8","EAN13", "EAN128", "CODE39", "Code128","Code16k","Code93","PDF417","DataMatrix" ,"QR", "AZTEC", "ITF14","EAN13Addon2","EAN13Addon5",
+			"GS1DataBar", "GS1DataBarTruncated", "GS1DataBarLimited", "GS1DataBarExpanded", "GS1DataBarStacked", "GS1DataBarStackedOmni", "GS1DataBarExpandedStacked"
+		типы без команды ККТ возвращают ErrBarcodeType
+		позиция HRI - KkmParam.BarCodeHRI, линейный код с barcodealign влево/вправо - ErrBarcodeAlign
 		barcode =
 				Команда: CBH. Длина сообщения: 57 байт или менее.
 				Пароль оператора (4 байта) 					[:4]
@@ -572,54 +747,53 @@ func (kkm *KkmDrv) PrintBarCode(pass []byte, bartype string, barcode []byte) (by
 				Код ошибки (1 байт)
 				Порядковый номер оператора (1 байт) 1…30
 	*/
-	/*Печать штрих-кода EAN-13
-	Команда: C2H. Длина сообщения: 10 байт.
-	Пароль оператора (4 байта)
-	Штрих-код (5 байт) 000000000000…999999999999
-	Ответ: С2H. Длина сообщения: 3 байта.
-	Код ошибки (1 байт)
-	Порядковый номер оператора (1 байт) 1…30*/
+	//в CBH нет поля выравнивания: линейный штрихкод с выравниванием влево или вправо
+	//печатается графикой (ErrBarcodeAlign), двумерные коды выравнивает команда DEH
 	parambc := kkm.GetParam()
-
-	if bartype == "EAN13" {
-		tabparam := make([]byte, 10)
-		copy(tabparam, pass[:4])
-		copy(tabparam[4:], encodeWindows1251(string(barcode)))
-		errcode, _, err := kkm.SendCommand(0xc2, tabparam)
-		return errcode, err
+	if parambc.BarCodeAlign == 2 || parambc.BarCodeAlign == 3 {
+		switch bartype {
+		case "PDF417", "DataMatrix", "DATAMATRIX", "QR", "AZTEC":
+		default:
+			return 0, ErrBarcodeAlign
+		}
 	}
 	tabparam := make([]byte, 57)
 	copy(tabparam, pass[:4])
 	tabparam[4] = parambc.BarCodeH
 	tabparam[5] = parambc.BarCodeW
-	tabparam[6] = 2
+	tabparam[6] = parambc.HRIPosition()
 	switch bartype {
+	case "EAN13":
+		tabparam[8] = 2
 	case "EAN8":
 		tabparam[8] = 3
-	case "EAN128":
-		return 1, errors.New("Не поддерживаемый тип штрихкода")
 	case "CODE39":
 		tabparam[8] = 4
 	case "Code128":
 		tabparam[8] = 8
-	case "Code16k":
-		return 1, errors.New("Не поддерживаемый тип штрихкода")
 	case "Code93":
 		tabparam[8] = 7
-	case "PDF417":
-		return kkm.Print2dCode(pass, bartype, barcode)
-	case "DataMatrix":
-		return kkm.Print2dCode(pass, bartype, barcode)
-	case "QR":
+	case "PDF417", "DataMatrix", "DATAMATRIX", "QR", "AZTEC":
 		return kkm.Print2dCode(pass, bartype, barcode)
 	case "ITF14":
 		tabparam[8] = 5
-	case "EAN13Addon2":
-		return 1, errors.New("Не поддерживаемый тип штрихкода")
-	case "EAN13Addon5":
-		return 1, errors.New("Не поддерживаемый тип штрихкода")
+	case "GS1DataBar":
+		tabparam[8] = 11
+	case "GS1DataBarTruncated":
+		tabparam[8] = 12
+	case "GS1DataBarLimited":
+		tabparam[8] = 13
+	case "GS1DataBarExpanded":
+		tabparam[8] = 14
+	case "GS1DataBarStacked":
+		tabparam[8] = 15
+	case "GS1DataBarStackedOmni":
+		tabparam[8] = 16
 	case "GS1DataBarExpandedStacked":
 		tabparam[8] = 17
+	default:
+		//EAN128, Code16k, EAN13Addon2, EAN13Addon5 и неизвестные типы
+		return 0, ErrBarcodeType
 	}
 	copy(tabparam[9:], encodeWindows1251(string(barcode)))
 	errcode, _, err := kkm.SendCommand(0xcb, tabparam)
@@ -636,6 +810,109 @@ func (kkm *KkmDrv) ContinuePrint(pass []byte) (byte, error) {
 	return errcode, err
 }
 
+//RepeatDocument повтор печати последнего закрытого чека
+func (kkm *KkmDrv) RepeatDocument(pass []byte) (byte, error) {
+	/*Повтор документа
+	Команда: 8CH. Длина сообщения: 5 байт.
+	Пароль оператора (4 байта)
+	Ответ: 8CH. Длина сообщения: 3 байта.
+	Код ошибки (1 байт)
+	Порядковый номер оператора (1 байт) 1…30
+	Команда выводит на печать копию последнего закрытого документа продажи, покупки, возврата продажи и возврата покупки.*/
+	if len(pass) == 0 {
+		pass = kkm.GetAdminPass()
+	}
+	errcode, _, err := kkm.SendCommand(0x8c, pass[:4])
+	return errcode, err
+}
+
+//FontParam параметры шрифта и ширина области печати
+type FontParam struct {
+	//Ширина области печати в точках
+	PrintWidth uint16 `json:"printWidth"`
+	//Ширина символа с учетом межсимвольного интервала в точках
+	CharWidth byte `json:"charWidth"`
+	//Высота символа с учетом межстрочного интервала в точках
+	CharHeight byte `json:"charHeight"`
+	//Количество шрифтов в ККТ
+	FontCount byte `json:"fontCount"`
+}
+
+//GetFontParam прочитает параметры шрифта font
+func (kkm *KkmDrv) GetFontParam(pass []byte, font byte) (FontParam, byte, error) {
+	/*Прочитать параметры шрифта
+	Команда: 26H. Длина сообщения: 6 байт.
+	Пароль системного администратора (4 байта)
+	Номер шрифта (1 байт)
+	Ответ: 26H. Длина сообщения: 7 байт.
+	Код ошибки (1 байт)
+	Ширина области печати в точках (2 байта)
+	Ширина символа с учетом межсимвольного интервала в точках (1 байт)
+	Высота символа с учетом межстрочного интервала в точках (1 байт)
+	Количество шрифтов в ККТ (1 байт)*/
+	if len(pass) == 0 {
+		pass = kkm.GetAdminPass()
+	}
+	tabparam := make([]byte, 5)
+	copy(tabparam, pass[:4])
+	tabparam[4] = font
+	errcode, data, err := kkm.SendCommand(0x26, tabparam)
+	if err != nil {
+		return FontParam{}, 1, err
+	}
+	if errcode > 0 {
+		return FontParam{}, errcode, errors.New(kkm.ParseErrState(errcode))
+	}
+	if len(data) < 5 {
+		return FontParam{}, 1, errors.New("короткий ответ параметров шрифта")
+	}
+	return FontParam{PrintWidth: binary.LittleEndian.Uint16(data[0:2]), CharWidth: data[2], CharHeight: data[3], FontCount: data[4]}, 0, nil
+}
+
+//Расширенная графика: линия 40 байт (320 точек), до 1200 линий
+const (
+	//GraphicsLineBytes длина линии графики в байтах
+	GraphicsLineBytes = 40
+	//GraphicsMaxLines количество линий в памяти графики
+	GraphicsMaxLines = 1200
+)
+
+//LoadGraphicsLine загрузит линию графики line (1...1200), первая точка линии - младший бит первого байта
+func (kkm *KkmDrv) LoadGraphicsLine(pass []byte, line uint16, data []byte) (byte, error) {
+	/*Загрузка расширенной графики
+	Команда: C4H. Длина сообщения: 47 байт.
+	Пароль оператора (4 байта)
+	Номер линии (2 байта) 1…1200
+	Графическая информация (40 байт)
+	Ответ: C4H. Длина сообщения: 3 байта.
+	Код ошибки (1 байт)
+	Порядковый номер оператора (1 байт) 1…30*/
+	tabparam := make([]byte, 6+GraphicsLineBytes)
+	copy(tabparam, pass[:4])
+	binary.LittleEndian.PutUint16(tabparam[4:6], line)
+	copy(tabparam[6:], data)
+	errcode, _, err := kkm.SendCommand(0xc4, tabparam)
+	return errcode, err
+}
+
+//PrintGraphics напечатает загруженные линии графики с first по last
+func (kkm *KkmDrv) PrintGraphics(pass []byte, first, last uint16) (byte, error) {
+	/*Печать расширенной графики
+	Команда: C3H. Длина сообщения: 9 байт.
+	Пароль оператора (4 байта)
+	Начальная линия (2 байта) 1…1200
+	Конечная линия (2 байта) 1…1200
+	Ответ: C3H. Длина сообщения: 3 байта.
+	Код ошибки (1 байт)
+	Порядковый номер оператора (1 байт) 1…30*/
+	tabparam := make([]byte, 8)
+	copy(tabparam, pass[:4])
+	binary.LittleEndian.PutUint16(tabparam[4:6], first)
+	binary.LittleEndian.PutUint16(tabparam[6:8], last)
+	errcode, _, err := kkm.SendCommand(0xc3, tabparam)
+	return errcode, err
+}
+
 //CancelCheck отменяет чек
 func (kkm *KkmDrv) CancelCheck(pass []byte) (byte, error) {
 	if len(pass) == 0 {
@@ -738,40 +1015,54 @@ func (kkm *KkmDrv) CloseCheck(pass []byte, summa map[int]float64, tax map[string
 		copy(param[79:], money2byte(barter, Digit))
 	}
 	param[84] = rnd
+	copy(param[85:115], taxParam(tax))
+	param[115] = 0b00000001 << taxsystem
+	if len(printstring) > 0 {
+		copy(param[116:180], encodeWindows1251(string(printstring)))
+	}
+	errcode, data, err := kkm.SendCommand(0xff45, param)
+	if err != nil || errcode > 0 {
+		return
+	}
+	if len(data) < 13 {
+		err = errors.New("неверный ответ FF45h")
+		return
+	}
+	retsum = float64(uintLE(data[:5])) / math.Pow10(Digit)
+	chknum = int(binary.LittleEndian.Uint32(data[5:9]))
+	fiscalsign = strconv.FormatUint(uint64(binary.LittleEndian.Uint32(data[9:13])), 10)
+	if len(data) >= 18 {
+		dtime = ParseDateTime(data[13:18]).Format("2006-01-02 15:04:05")
+	} else {
+		dtime = time.Now().Format("2006-01-02 15:04:05")
+	}
+	return
+}
+
+//taxParam суммы налогов для команд закрытия чека и чека коррекции, 6 налогов по 5 байт
+func taxParam(tax map[string]float64) []byte {
 	//Налог 1=НДС 18%,	Налог 2 =НДС 10%,налог 3 =НДС 0%,налог 4 =(Без НДС),Налог 5 = 18/118,	Налог 6 = (НДС расч. 10/110)
 	//"none","20","18","10","0","20/120","18/118","10/110"
+	param := make([]byte, 30)
 	if tax["20"] > 0 || tax["18"] > 0 || tax["1"] > 0 {
-		copy(param[85:], money2byte(tax["20"]+tax["18"]+tax["1"], Digit))
+		copy(param[0:], money2byte(tax["20"]+tax["18"]+tax["1"], Digit)[:5])
 	}
 	if tax["10"] > 0 || tax["2"] > 0 {
-		copy(param[90:], money2byte(tax["10"]+tax["2"], Digit))
+		copy(param[5:], money2byte(tax["10"]+tax["2"], Digit)[:5])
 	}
 	if tax["0"] > 0 || tax["3"] > 0 {
-		copy(param[95:], money2byte(tax["0"]+tax["3"], Digit))
+		copy(param[10:], money2byte(tax["0"]+tax["3"], Digit)[:5])
 	}
 	if tax["none"] > 0 || tax["4"] > 0 {
-		copy(param[100:], money2byte(tax["none"]+tax["4"], Digit))
+		copy(param[15:], money2byte(tax["none"]+tax["4"], Digit)[:5])
 	}
 	if tax["20/120"] > 0 || tax["18/118"] > 0 || tax["5"] > 0 {
-		copy(param[105:], money2byte(tax["20/120"]+tax["18/118"]+tax["5"], Digit))
+		copy(param[20:], money2byte(tax["20/120"]+tax["18/118"]+tax["5"], Digit)[:5])
 	}
 	if tax["10/110"] > 0 || tax["6"] > 0 {
-		copy(param[110:], money2byte(tax["10/110"]+tax["6"], Digit))
-	}
-	param[115] = 0b00000001 << taxsystem
-	if len(printstring) > 0 {
-		copy(param[116:], encodeWindows1251(string(printstring))[:64])
+		copy(param[25:], money2byte(tax["10/110"]+tax["6"], Digit)[:5])
 	}
-	errcode, data, err := kkm.SendCommand(0xff45, param)
-	retsum = float64(btoi(data[:5]) / 100)
-	chknum = int(btoi(data[5:9]))
-	fiscalsign = string(decodeWindows1251(data[9:13]))
-	if len(data) > 14 {
-		dtime = time.Unix(btoi(data[13:]), 0).Format("2006-01-02 15:04:05")
-	} else {
-		dtime = time.Now().Format("2006-01-02 15:04:05")
-	}
-	return
+	return param
 }
 
 //FNOperation Операция на ФН для печати чека
@@ -924,6 +1215,42 @@ func (kkm *KkmDrv) FNSendTLVOperation(pass []byte, teg uint16, val []byte) (uint
 	return 0, nil
 }
 
+//FNSendTag кодирует значение реквизита по словарю тегов и передает его в ФН
+//реквизиты чека уходят командой FF0Ch, реквизиты предмета расчета - FF4Dh
+//ошибка кодирования возвращается с кодом 0, чтобы ее не спутать с ошибкой ККТ 01h
+func (kkm *KkmDrv) FNSendTag(pass []byte, teg uint16, val interface{}) (uint8, error) {
+	t, err := kkm.EncodeTag(teg, val)
+	if err != nil {
+		return 0, err
+	}
+	return kkm.FNSendTLVStruct(pass, t)
+}
+
+//TLVCodePage кодировка строковых реквизитов ФФД ККТ, если не задана - tlv.DefaultCodePage
+func (kkm *KkmDrv) TLVCodePage() string {
+	if len(kkm.CodePage) == 0 {
+		return tlv.DefaultCodePage
+	}
+	return kkm.CodePage
+}
+
+//EncodeTag кодирует значение реквизита по словарю тегов в кодировке ККТ
+func (kkm *KkmDrv) EncodeTag(teg uint16, val interface{}) (tlv.TLV, error) {
+	return (&tlv.Encoder{CodePage: kkm.TLVCodePage()}).Encode(teg, val)
+}
+
+//FNSendTLVStruct передает в ФН готовую TLV (STLV) структуру
+func (kkm *KkmDrv) FNSendTLVStruct(pass []byte, t tlv.TLV) (uint8, error) {
+	d, _ := tlv.Lookup(t.Tag)
+	switch d.Scope {
+	case tlv.ScopeFN:
+		return 0, errors.New("реквизит " + strconv.Itoa(int(t.Tag)) + " формирует ФН, передать его нельзя")
+	case tlv.ScopeOperation:
+		return kkm.FNSendTLVOperation(pass, t.Tag, t.Value)
+	}
+	return kkm.FNSendTLV(pass, t.Tag, t.Value)
+}
+
 //Serialize преобразует данные в json byte
 func (kkm *KkmDrv) Serialize() ([]byte, error) {
 	return json.Marshal(kkm.GetStruct())
@@ -948,7 +1275,7 @@ func (kkm *KkmDrv) ChkBusy(procid int) bool {
 		return false
 	}
 	//если ккм занята давно, то освободим
-	if MaxTimeKKMBusy < time.Since(time.Unix(int64(st.ProcID), 0)).Seconds() {
+	if MaxTimeKKMBusy < time.Since(time.Unix(st.BusyAt, 0)).Seconds() {
 		kkm.SetBusy(0)
 	}
 	for i := 0; i < MaxAttempBusy; i++ {
@@ -970,9 +1297,20 @@ func (kkm *KkmDrv) SetBusy(procid int) {
 	if procid > 0 {
 		kkm.State.Busy = true
 		kkm.State.ProcID = procid
+		kkm.State.BusyAt = time.Now().Unix()
 	} else {
 		kkm.State.Busy = false
 		kkm.State.ProcID = 0
+		kkm.State.BusyAt = 0
+	}
+	kkm.mu.Unlock()
+}
+
+//TouchBusy продлит занятость ккм текущим процессом, чтобы долгая операция не была освобождена через MaxTimeKKMBusy
+func (kkm *KkmDrv) TouchBusy() {
+	kkm.mu.Lock()
+	if kkm.State.Busy {
+		kkm.State.BusyAt = time.Now().Unix()
 	}
 	kkm.mu.Unlock()
 }
@@ -1007,12 +1345,50 @@ func (kkm *KkmDrv) SetLenLine(ll uint8) {
 	kkm.mu.Unlock()
 }
 
-//GetLenLine dthytn длину строки
+//GetLenLine вернет длину строки основного шрифта
 func (kkm *KkmDrv) GetLenLine() uint8 {
+	return kkm.LineLength(1)
+}
+
+//LineLength длина строки шрифта font в символах по параметрам шрифта, если они не прочитаны - LenLine
+func (kkm *KkmDrv) LineLength(font byte) uint8 {
 	kkm.mu.RLock()
-	ll := kkm.Param.LenLine
-	kkm.mu.RUnlock()
-	return ll
+	defer kkm.mu.RUnlock()
+	if fp, ok := kkm.fonts[font]; ok && fp.CharWidth > 0 {
+		if n := int(fp.PrintWidth) / int(fp.CharWidth); n > 0 && n < 256 {
+			return uint8(n)
+		}
+	}
+	return kkm.Param.LenLine
+}
+
+//LoadFonts прочитает параметры всех шрифтов ККТ (команда 26H)
+func (kkm *KkmDrv) LoadFonts() (byte, error) {
+	fp, errcode, err := kkm.GetFontParam(nil, 1)
+	if err != nil {
+		return errcode, err
+	}
+	fonts := map[byte]FontParam{1: fp}
+	for f := 2; f <= int(fp.FontCount); f++ {
+		if p, errcode, err := kkm.GetFontParam(nil, byte(f)); err == nil && errcode == 0 {
+			fonts[byte(f)] = p
+		}
+	}
+	kkm.mu.Lock()
+	kkm.fonts = fonts
+	kkm.mu.Unlock()
+	return 0, nil
+}
+
+//GetFonts параметры шрифтов, прочитанные при подключении
+func (kkm *KkmDrv) GetFonts() map[byte]FontParam {
+	kkm.mu.RLock()
+	defer kkm.mu.RUnlock()
+	fonts := make(map[byte]FontParam, len(kkm.fonts))
+	for f, p := range kkm.fonts {
+		fonts[f] = p
+	}
+	return fonts
 }
 
 //SetParam установит RNM и SerialNumber ккм mutex-op
@@ -1138,6 +1514,10 @@ func (kkm *KkmDrv) GetStruct() KkmDrvSer {
 	param.Inn = kkm.Param.Inn
 	param.KKMSerialNumber = kkm.Param.KKMSerialNumber
 	param.RNM = kkm.Param.RNM
+	param.Rounding = kkm.Param.Rounding
+	param.FontDH = kkm.Param.FontDH
+	param.FontBold = kkm.Param.FontBold
+	copyBarcodeParam(&param, kkm.Param)
 
 	res := binary.LittleEndian.Uint32(kkm.AdminPassword[:])
 	sr.AdminPassword = int64(res)
@@ -1208,6 +1588,10 @@ func (kkm *KkmDrv) SetDataFromStruct(jkkm *KkmDrvSer) {
 	kkm.Param.KKMSerialNumber = jkkm.Param.KKMSerialNumber
 	kkm.Param.RNM = jkkm.Param.RNM
 	kkm.Param.LenLine = jkkm.Param.LenLine
+	kkm.Param.Rounding = jkkm.Param.Rounding
+	kkm.Param.FontDH = jkkm.Param.FontDH
+	kkm.Param.FontBold = jkkm.Param.FontBold
+	copyBarcodeParam(&kkm.Param, jkkm.Param)
 }
 
 func toInt(iface interface{}) int {
@@ -1272,53 +1656,18 @@ func UnSerialize(jdata []byte) (*KkmDrv, error) {
 		if ok1 {
 			kkm.Param.RNM = rnm.(string)
 		}
-		/*
-
-			PDF417NumCol   uint8 `json:"pdf417numcol"`
-			PDF417NumRow   uint8 `json:"pdf417numrow"`
-			PDF417W        uint8 `json:"pdf417w"`
-			PDF417H        uint8 `json:"pdf417h"`
-			PDF417ErrLevel uint8 `json:"pdf417errlevel"`
-			//DATAMATRIX param
-			DMATRScheme   uint8 `json:"datamatrixscheme"`
-			DMATRRotate   uint8 `json:"datamatrixrotate"`
-			DMATRDotSize  uint8 `json:"datamatrixdotsize"`
-			DMATRSymbSize uint8 `json:"datamatrixsymbsize"`
-			//AZTEC param
-			AZTECScheme   uint8 `json:"aztecscheme"`
-			AZTECDotSize  uint8 `json:"aztecdotsize"`
-			AZTECSymbSize uint8 `json:"aztecsymbsize"`
-			AZTECErrLevel uint8 `json:"aztecerrlevel"`
-			//QR
-			QRVersion uint8 `json:"qrversion"`
-			QRMask    uint8 `json:"qrmask"`
-			//QRDotSize по умолчанию = 8
-			QRDotSize uint8 `json:"qrdotsize"`
-			//QRErrLevel коррекция ошибок по умолчанию =0
-			QRErrLevel uint8 `json:"qrerrlevel"`*/
 		rnm, ok1 = pcf["kkmregnum"]
 		if ok1 {
 			kkm.Param.KKMRegNumber = rnm.(string)
 		}
-		uint8val, ok1 := pcf["lenline"]
-		if ok1 {
-			kkm.Param.LenLine = uint8val.(uint8)
-		}
-		uint8val, ok1 = pcf["barcodeh"]
-		if ok1 {
-			kkm.Param.BarCodeH = uint8val.(uint8)
-		}
-		uint8val, ok1 = pcf["barcodew"]
-		if ok1 {
-			kkm.Param.BarCodeW = uint8val.(uint8)
-		}
-		uint8val, ok1 = pcf["barcodealign"]
-		if ok1 {
-			kkm.Param.BarCodeAlign = uint8val.(uint8)
-		}
-		uint8val, ok1 = pcf["pdf417numcol"]
-		if ok1 {
-			kkm.Param.PDF417NumCol = uint8val.(uint8)
+		//числовые параметры в json - float64, читаем через структуру
+		var jkkm KkmDrvSer
+		if err := json.Unmarshal(jdata, &jkkm); err == nil {
+			kkm.Param.LenLine = jkkm.Param.LenLine
+			kkm.Param.Rounding = jkkm.Param.Rounding
+			kkm.Param.FontDH = jkkm.Param.FontDH
+			kkm.Param.FontBold = jkkm.Param.FontBold
+			copyBarcodeParam(&kkm.Param, jkkm.Param)
 		}
 	}
 	return &kkm, nil
@@ -1724,21 +2073,23 @@ func (kkm *KkmDrv) FNGetStatus() (byte, error) {
 	  Номер последнего ФД: 4 байта
 	*/
 	admpass := kkm.GetAdminPass()
-	errcode, data, err := kkm.SendCommand(0xff41, admpass)
+	errcode, data, err := kkm.SendCommand(0xff01, admpass)
 	if errcode > 0 {
 		if err != nil {
 			log.Printf("FNGetStatus: %v", err)
 			return 1, err
 		}
 	}
-	if len(data) > 1 {
+	if len(data) >= 30 {
 		kkm.mu.Lock()
 		kkm.FNState.FNLifeState = data[0]
 		kkm.FNState.FNCurrentDocument = data[1]
 		kkm.FNState.FNDocumentData = data[2]
 		kkm.FNState.FNSessionState = data[3]
 		kkm.FNState.FNWarningFlags = data[4]
-		kkm.FNState.DateTime = binary.LittleEndian.Uint64(data[5:10])
+		dt := make([]byte, 8)
+		copy(dt, data[5:10])
+		kkm.FNState.DateTime = binary.LittleEndian.Uint64(dt)
 		kkm.FNState.SerialNumber = string(data[10:26])
 		kkm.FNState.DocumentNumber = binary.LittleEndian.Uint32(data[26:30])
 		kkm.mu.Unlock()
@@ -1859,8 +2210,21 @@ func (kkm *KkmDrv) SendNAK() error {
 	return err
 }
 
-//SendCommand отправка команды в ККМ и возврат результата
+//SendCommand отправка команды в ККМ и возврат результата. Если печать остановлена
+//(нет бумаги, ожидание продолжения печати), ждет заправки бумаги и повторяет команду, см. paper.go
 func (kkm *KkmDrv) SendCommand(cmdint uint16, params []byte) (errcode byte, data []byte, err error) {
+	errcode, data, err = kkm.sendCommand(cmdint, params)
+	for i := 0; i < paperRetries && err == nil && paperStopped(cmdint, errcode); i++ {
+		if kkm.WaitPrint(cmdint) != nil {
+			break
+		}
+		errcode, data, err = kkm.sendCommand(cmdint, params)
+	}
+	return
+}
+
+//sendCommand отправка команды в ККМ и возврат результата
+func (kkm *KkmDrv) sendCommand(cmdint uint16, params []byte) (errcode byte, data []byte, err error) {
 	//очистим параметры предидущей команды
 	kkm.SetErrState(0)
 	if !kkm.GetConnected() {
@@ -1882,7 +2246,9 @@ func (kkm *KkmDrv) SendCommand(cmdint uint16, params []byte) (errcode byte, data
 	content[1] = byte(cmdlen + len(params))       //cmd+params
 	content[2] = b[0]
 	if cmdlen > 1 {
-		content[3] = b[1]
+		//двухбайтная команда передается старшим байтом вперед: FFh 01h
+		content[2] = b[1]
+		content[3] = b[0]
 	}
 	for i, c := range params {
 		content[cmdlen+2+i] = c
@@ -1913,7 +2279,7 @@ func (kkm *KkmDrv) SendCommand(cmdint uint16, params []byte) (errcode byte, data
 		//ошибки – 2 байта
 		if num > 0 && len(answer) > 1 {
 			//для двухбайтных комманд
-			if cmdlen > 2 && len(answer) > 2 {
+			if cmdlen > 1 && len(answer) > 2 {
 				errcode = answer[2]
 				if num > 3 {
 					data = answer[3:num]
@@ -2166,12 +2532,14 @@ func (kkm *KkmDrv) Connect() (int, error) {
 		case NAK:
 			kkm.SetConnected(true)
 			log.Println("Wait command state")
+			kkm.connected()
 			return 1, nil
 		case ACK:
 			//wait stx
 			log.Println("KKM status ASK")
 			kkm.ClearAnswer()
 			kkm.SetConnected(true)
+			kkm.connected()
 			return 1, nil
 		default:
 			log.Printf("Check connection@ KKM in silens %v", ret)
@@ -2182,5 +2550,22 @@ func (kkm *KkmDrv) Connect() (int, error) {
 	return 0, errors.New("Check connection@ KKM in bad state")
 }
 
+//connected действия после подключения: параметры шрифтов и счетчик подключений
+func (kkm *KkmDrv) connected() {
+	if _, err := kkm.LoadFonts(); err != nil {
+		log.Printf("параметры шрифтов %s: %v", kkm.DeviceID, err)
+	}
+	kkm.mu.Lock()
+	kkm.connects++
+	kkm.mu.Unlock()
+}
+
+//ConnectCount число установленных подключений к ККМ, по его изменению сервер узнает о переподключении
+func (kkm *KkmDrv) ConnectCount() int {
+	kkm.mu.RLock()
+	defer kkm.mu.RUnlock()
+	return kkm.connects
+}
+
 func main() {
 }
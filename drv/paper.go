@@ -0,0 +1,125 @@
+package drv
+
+import (
+	"errors"
+	"strconv"
+	"time"
+)
+
+/*
+	Остановка печати из-за бумаги.
+	Если команда печати отвечает 50H (идет печать предыдущей команды), 58H (ожидание команды продолжения печати),
+	6BH или 6CH (нет чековой или контрольной ленты), SendCommand опрашивает подрежим ККТ (10H):
+		1 - пассивное отсутствие бумаги, 2 - активное отсутствие бумаги: ждем заправки бумаги, событие paperout;
+		3 - бумага заправлена, ККТ ждет продолжения печати: команда B0H, событие continued;
+		4, 5 - идет печать: ждем окончания;
+	и повторяет команду. Ожидание не дольше PaperWait, иначе событие timeout и исходный код ошибки команды.
+	На каждом опросе занятость ККТ продлевается (TouchBusy), чтобы другие процессы не освободили ее через MaxTimeKKMBusy.
+*/
+
+//Подрежимы ККТ
+const (
+	//SubStatePaper бумага есть
+	SubStatePaper = 0
+	//SubStatePassiveOut пассивное отсутствие бумаги
+	SubStatePassiveOut = 1
+	//SubStateActiveOut активное отсутствие бумаги, печать остановлена
+	SubStateActiveOut = 2
+	//SubStateWaitContinue после активного отсутствия бумаги ККТ ждет команду продолжения печати B0H
+	SubStateWaitContinue = 3
+	//SubStatePrintReport фаза печати полных фискальных отчетов
+	SubStatePrintReport = 4
+	//SubStatePrinting фаза печати операции
+	SubStatePrinting = 5
+)
+
+//PaperWait сколько ждать заправки бумаги, 0 - не ждать
+var PaperWait = 5 * time.Minute
+
+//PaperPoll интервал опроса подрежима при ожидании бумаги
+var PaperPoll = time.Second
+
+//paperRetries сколько раз повторять команду после заправки бумаги
+const paperRetries = 3
+
+//PaperEvent событие остановки или продолжения печати
+type PaperEvent struct {
+	Time     time.Time `json:"time"`
+	DeviceID string    `json:"deviceID"`
+	//paperout - нет бумаги, continued - печать продолжена, timeout - бумага не заправлена за PaperWait, error - ошибка ККТ
+	Event    string `json:"event"`
+	SubState byte   `json:"substate"`
+	//Команда, на которой обнаружена остановка, 0 - проверка после документа
+	Command uint16 `json:"command"`
+	Message string `json:"message"`
+}
+
+//OnPaper вызывается при остановке и продолжении печати
+var OnPaper func(ev PaperEvent)
+
+func (kkm *KkmDrv) paperEvent(event string, substate byte, cmd uint16, msg string) {
+	if OnPaper != nil {
+		OnPaper(PaperEvent{Time: time.Now(), DeviceID: kkm.DeviceID, Event: event, SubState: substate, Command: cmd, Message: msg})
+	}
+}
+
+//paperStopped команда печати не выполнена из-за бумаги или незавершенной печати
+func paperStopped(cmd uint16, errcode byte) bool {
+	if PaperWait <= 0 {
+		return false
+	}
+	switch cmd {
+	case 0x10, 0x11, 0xB0:
+		//команды опроса и продолжения печати выполняются при ожидании
+		return false
+	}
+	switch errcode {
+	case 0x50, 0x58, 0x6b, 0x6c:
+		return true
+	}
+	return false
+}
+
+//WaitPrint дождется окончания печати, при остановке печати - заправки бумаги, и продолжит печать командой B0H.
+//cmd - команда, которая будет повторена: для нее ждем и бумагу при пассивном отсутствии, 0 - проверка после документа
+func (kkm *KkmDrv) WaitPrint(cmd uint16) error {
+	if PaperWait <= 0 {
+		return nil
+	}
+	deadline := time.Now().Add(PaperWait)
+	var reported byte
+	for {
+		kkm.TouchBusy()
+		if _, err := kkm.GetStatus10(); err != nil {
+			kkm.paperEvent("error", 0, cmd, err.Error())
+			return err
+		}
+		sub := kkm.GetState().SubState
+		switch {
+		case sub == SubStatePaper, sub == SubStatePassiveOut && cmd == 0:
+			return nil
+		case sub == SubStateWaitContinue:
+			errcode, err := kkm.ContinuePrint(kkm.GetAdminPass())
+			if err == nil && errcode > 0 {
+				err = errors.New(kkm.ParseErrState(errcode))
+			}
+			if err != nil {
+				kkm.paperEvent("error", sub, cmd, "печать не продолжена: "+err.Error())
+				return err
+			}
+			kkm.paperEvent("continued", sub, cmd, "бумага заправлена, печать продолжена")
+			reported = 0
+		case sub == SubStatePassiveOut || sub == SubStateActiveOut:
+			if reported != sub {
+				kkm.paperEvent("paperout", sub, cmd, "нет бумаги, ожидание заправки")
+				reported = sub
+			}
+		}
+		if time.Now().After(deadline) {
+			msg := "печать не продолжена за " + strconv.Itoa(int(PaperWait/time.Second)) + " с"
+			kkm.paperEvent("timeout", sub, cmd, msg)
+			return errors.New(msg)
+		}
+		time.Sleep(PaperPoll)
+	}
+}
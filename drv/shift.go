@@ -0,0 +1,100 @@
+package drv
+
+import (
+	"encoding/binary"
+	"errors"
+	"kkm-shtrih/drv/tlv"
+)
+
+//ShiftResult результат открытия (закрытия) смены в ФН
+type ShiftResult struct {
+	FNResult
+	//Номер смены
+	ShiftNumber uint16
+}
+
+//shiftDocument отправит команду начала отчета, реквизиты кассира и команду формирования отчета смены
+func (kkm *KkmDrv) shiftDocument(pass []byte, begin, cmd uint16, cashier, inn string) (ShiftResult, byte, error) {
+	var res ShiftResult
+	if len(pass) == 0 {
+		pass = kkm.GetAdminPass()
+	}
+	//тег 1203 ИНН кассира, тег 1021 кассир: кодируем до начала отчета, чтобы ошибка реквизита не оставила его открытым
+	var tags []tlv.TLV
+	if len(inn) > 0 {
+		t, err := kkm.EncodeTag(1203, inn)
+		if err != nil {
+			return res, 1, err
+		}
+		tags = append(tags, t)
+	}
+	if len(cashier) > 0 {
+		t, err := kkm.EncodeTag(1021, cashier)
+		if err != nil {
+			return res, 1, err
+		}
+		tags = append(tags, t)
+	}
+	errcode, _, err := kkm.SendCommand(begin, pass[:4])
+	if err != nil {
+		return res, 1, err
+	}
+	if errcode > 0 {
+		return res, errcode, errors.New(kkm.ParseErrState(errcode))
+	}
+	for _, t := range tags {
+		errcode, err = kkm.FNSendTLVStruct(pass, t)
+		if err != nil {
+			return res, 1, err
+		}
+		if errcode > 0 {
+			return res, errcode, errors.New(kkm.ParseErrState(errcode))
+		}
+	}
+	errcode, data, err := kkm.SendCommand(cmd, pass[:4])
+	if err != nil {
+		return res, 1, err
+	}
+	if errcode > 0 {
+		return res, errcode, errors.New(kkm.ParseErrState(errcode))
+	}
+	if len(data) < 2 {
+		return res, 1, errors.New("неверная длина ответа на команду смены")
+	}
+	res.ShiftNumber = binary.LittleEndian.Uint16(data[:2])
+	res.FNResult = parseFNResult(data[2:])
+	return res, 0, nil
+}
+
+//FNOpenShift открыть смену в ФН с реквизитами кассира
+func (kkm *KkmDrv) FNOpenShift(pass []byte, cashier, inn string) (ShiftResult, byte, error) {
+	/*Начать открытие смены
+	Код команды FF41h . Длина сообщения: 6 байт.
+	Пароль системного администратора: 4 байта
+	Открыть смену в ФН
+	Код команды FF0Bh . Длина сообщения: 6 байт.
+	Пароль системного администратора: 4 байта
+	Ответ: FF0Bh Длина сообщения: 11 байт.
+	Код ошибки: 1 байт
+	Номер новой открытой смены: 2 байта
+	Номер ФД :4 байта
+	Фискальный признак: 4 байта*/
+	return kkm.shiftDocument(pass, 0xff41, 0xff0b, cashier, inn)
+}
+
+//FNCloseShift закрыть смену в ФН (Z-отчет) с реквизитами кассира
+func (kkm *KkmDrv) FNCloseShift(pass []byte, cashier, inn string) (ShiftResult, byte, error) {
+	/*Начать закрытие смены
+	Код команды FF42h . Длина сообщения: 6 байт.
+	Пароль системного администратора: 4 байта
+	Закрыть смену в ФН
+	Код команды FF43h . Длина сообщения: 6 байт.
+	Пароль системного администратора: 4 байт
+	Ответ: FF43h Длина сообщения: 11 (16) байт
+	Код ошибки: 1 байт
+	Номер только что закрытой смены: 2 байта
+	Номер ФД :4 байта
+	Фискальный признак: 4 байта
+	Дата и время: 5 байт DATE_TIME может отсутствовать*/
+	return kkm.shiftDocument(pass, 0xff42, 0xff43, cashier, inn)
+}
@@ -0,0 +1,138 @@
+package tlv
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"math"
+	"strconv"
+	"time"
+)
+
+//Field разобранный реквизит фискального документа
+type Field struct {
+	Tag  uint16 `json:"tag" xml:"Tag,attr"`
+	Name string `json:"name" xml:"Name,attr"`
+	//Value значение реквизита: число, строка, дата (TimeFormat), для неизвестных тегов hex
+	Value interface{} `json:"value,omitempty" xml:"Value,attr,omitempty"`
+	//Children вложенные реквизиты STLV
+	Children []Field `json:"children,omitempty" xml:"Tag"`
+}
+
+//docTypes типы фискальных документов (тег документа)
+var docTypes = map[uint16]string{
+	1:  "отчет о регистрации",
+	11: "отчет об изменении параметров регистрации",
+	2:  "отчет об открытии смены",
+	21: "отчет о текущем состоянии расчетов",
+	3:  "кассовый чек",
+	31: "кассовый чек коррекции",
+	4:  "бланк строгой отчетности",
+	41: "бланк строгой отчетности коррекции",
+	5:  "отчет о закрытии смены",
+	6:  "отчет о закрытии фискального накопителя",
+	7:  "подтверждение оператора",
+}
+
+//DocumentTypeName название типа фискального документа
+func DocumentTypeName(doctype uint16) string {
+	if n, ok := docTypes[doctype]; ok {
+		return n
+	}
+	return "неизвестный документ " + strconv.Itoa(int(doctype))
+}
+
+//Parse разбирает последовательность TLV структур
+func Parse(b []byte) ([]TLV, error) {
+	ret := make([]TLV, 0, 16)
+	for len(b) > 0 {
+		if len(b) < 4 {
+			return ret, errors.New("неполный заголовок TLV")
+		}
+		tag := binary.LittleEndian.Uint16(b[0:2])
+		l := int(binary.LittleEndian.Uint16(b[2:4]))
+		if len(b) < 4+l {
+			return ret, errors.New("тег " + strconv.Itoa(int(tag)) + ": длина " + strconv.Itoa(l) + " больше данных")
+		}
+		ret = append(ret, TLV{Tag: tag, Value: b[4 : 4+l]})
+		b = b[4+l:]
+	}
+	return ret, nil
+}
+
+//Decode разбирает значение TLV по словарю тегов
+func Decode(t TLV, codepage string) Field {
+	f := Field{Tag: t.Tag}
+	d, ok := Lookup(t.Tag)
+	if !ok {
+		f.Name = "неизвестный реквизит"
+		f.Value = hex.EncodeToString(t.Value)
+		return f
+	}
+	f.Name = d.Name
+	switch d.Type {
+	case TypeByte:
+		if len(t.Value) > 0 {
+			f.Value = int(t.Value[0])
+		}
+	case TypeUint32:
+		f.Value = uint64(DecodeVLN(t.Value))
+	case TypeVLN:
+		//денежные величины в ФН хранятся в копейках
+		f.Value = float64(DecodeVLN(t.Value)) / 100
+	case TypeFVLN:
+		f.Value = DecodeFVLN(t.Value)
+	case TypeString:
+		f.Value = DecodeString(t.Value, codepage)
+	case TypeUnixTime:
+		f.Value = time.Unix(int64(DecodeVLN(t.Value)), 0).Format(TimeFormat)
+	case TypeBytes:
+		if t.Tag == 1077 && len(t.Value) == 6 {
+			//фискальный признак документа: первые 2 байта служебные, далее ФПД big endian
+			f.Value = uint64(binary.BigEndian.Uint32(t.Value[2:6]))
+		} else {
+			f.Value = hex.EncodeToString(t.Value)
+		}
+	case TypeSTLV:
+		f.Children = DecodeAll(t.Value, codepage)
+	}
+	return f
+}
+
+//DecodeAll разбирает последовательность TLV в список реквизитов,
+//нераспознанный остаток возвращается как тег 0 в hex
+func DecodeAll(b []byte, codepage string) []Field {
+	list, err := Parse(b)
+	ret := make([]Field, 0, len(list)+1)
+	for _, t := range list {
+		ret = append(ret, Decode(t, codepage))
+	}
+	if err != nil {
+		rest := 0
+		for _, t := range list {
+			rest += 4 + len(t.Value)
+		}
+		ret = append(ret, Field{Name: err.Error(), Value: hex.EncodeToString(b[rest:])})
+	}
+	return ret
+}
+
+//DecodeVLN разбирает целое переменной длины little endian
+func DecodeVLN(b []byte) uint64 {
+	var v uint64
+	if len(b) > 8 {
+		b = b[:8]
+	}
+	for i := len(b) - 1; i >= 0; i-- {
+		v = v<<8 | uint64(b[i])
+	}
+	return v
+}
+
+//DecodeFVLN разбирает дробное переменной длины: первый байт - положение десятичной точки
+func DecodeFVLN(b []byte) float64 {
+	if len(b) == 0 {
+		return 0
+	}
+	return float64(DecodeVLN(b[1:])) / math.Pow10(int(b[0]))
+}
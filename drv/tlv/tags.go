@@ -0,0 +1,194 @@
+package tlv
+
+//Type тип данных реквизита ФФД
+type Type uint8
+
+const (
+	//TypeByte целое 1 байт
+	TypeByte Type = iota + 1
+	//TypeUint32 целое 4 байта
+	TypeUint32
+	//TypeVLN целое переменной длины (денежные величины в копейках)
+	TypeVLN
+	//TypeFVLN дробное переменной длины (количество)
+	TypeFVLN
+	//TypeString строка
+	TypeString
+	//TypeUnixTime дата и время unixtime 4 байта
+	TypeUnixTime
+	//TypeBytes массив байт
+	TypeBytes
+	//TypeSTLV составная структура
+	TypeSTLV
+)
+
+//Scope область действия реквизита
+type Scope uint8
+
+const (
+	//ScopeCheck реквизит чека (документа), передается командой FF0Ch
+	ScopeCheck Scope = iota + 1
+	//ScopeOperation реквизит предмета расчета, передается командой FF4Dh
+	ScopeOperation
+	//ScopeFN реквизит формирует ФН, передать его нельзя, только прочитать
+	ScopeFN
+)
+
+//Tag описание реквизита ФФД
+type Tag struct {
+	Code   uint16
+	Name   string
+	Type   Type
+	MaxLen int
+	Scope  Scope
+	//Fixed строка фиксированной длины, дополняется пробелами (ИНН)
+	Fixed bool
+}
+
+//String название типа реквизита
+func (t Type) String() string {
+	switch t {
+	case TypeByte:
+		return "BYTE"
+	case TypeUint32:
+		return "UINT32"
+	case TypeVLN:
+		return "VLN"
+	case TypeFVLN:
+		return "FVLN"
+	case TypeString:
+		return "STRING"
+	case TypeUnixTime:
+		return "UNIXTIME"
+	case TypeBytes:
+		return "BYTES"
+	case TypeSTLV:
+		return "STLV"
+	}
+	return "UNKNOWN"
+}
+
+//Lookup найдет реквизит в словаре
+func Lookup(tag uint16) (Tag, bool) {
+	t, ok := tags[tag]
+	return t, ok
+}
+
+//tags словарь реквизитов ФФД 1.05/1.1
+var tags = map[uint16]Tag{
+	//реквизиты чека
+	1008: {1008, "телефон или электронный адрес покупателя", TypeString, 64, ScopeCheck, false},
+	1009: {1009, "адрес расчетов", TypeString, 256, ScopeCheck, false},
+	1021: {1021, "кассир", TypeString, 64, ScopeCheck, false},
+	1055: {1055, "применяемая система налогообложения", TypeByte, 1, ScopeCheck, false},
+	1057: {1057, "признак агента", TypeByte, 1, ScopeCheck, false},
+	1084: {1084, "дополнительный реквизит пользователя", TypeSTLV, 320, ScopeCheck, false},
+	1085: {1085, "наименование дополнительного реквизита пользователя", TypeString, 64, ScopeCheck, false},
+	1086: {1086, "значение дополнительного реквизита пользователя", TypeString, 256, ScopeCheck, false},
+	1117: {1117, "адрес электронной почты отправителя чека", TypeString, 64, ScopeCheck, false},
+	1173: {1173, "тип коррекции", TypeByte, 1, ScopeCheck, false},
+	1174: {1174, "основание для коррекции", TypeSTLV, 292, ScopeCheck, false},
+	1177: {1177, "описание коррекции", TypeString, 256, ScopeCheck, false},
+	1178: {1178, "дата документа основания для коррекции", TypeUnixTime, 4, ScopeCheck, false},
+	1179: {1179, "номер документа основания для коррекции", TypeString, 32, ScopeCheck, false},
+	1187: {1187, "место расчетов", TypeString, 256, ScopeCheck, false},
+	1192: {1192, "дополнительный реквизит чека (БСО)", TypeString, 16, ScopeCheck, false},
+	1203: {1203, "ИНН кассира", TypeString, 12, ScopeCheck, true},
+	1227: {1227, "покупатель (клиент)", TypeString, 256, ScopeCheck, false},
+	1228: {1228, "ИНН покупателя (клиента)", TypeString, 12, ScopeCheck, true},
+
+	//реквизиты предмета расчета
+	1005: {1005, "адрес оператора перевода", TypeString, 256, ScopeOperation, false},
+	1016: {1016, "ИНН оператора перевода", TypeString, 12, ScopeOperation, true},
+	1023: {1023, "количество предмета расчета", TypeFVLN, 8, ScopeOperation, false},
+	1026: {1026, "наименование оператора перевода", TypeString, 64, ScopeOperation, false},
+	1030: {1030, "наименование предмета расчета", TypeString, 128, ScopeOperation, false},
+	1043: {1043, "стоимость предмета расчета", TypeVLN, 6, ScopeOperation, false},
+	1044: {1044, "операция платежного агента", TypeString, 24, ScopeOperation, false},
+	1059: {1059, "предмет расчета", TypeSTLV, 1024, ScopeOperation, false},
+	1073: {1073, "телефон платежного агента", TypeString, 19, ScopeOperation, false},
+	1074: {1074, "телефон оператора по приему платежей", TypeString, 19, ScopeOperation, false},
+	1075: {1075, "телефон оператора перевода", TypeString, 19, ScopeOperation, false},
+	1079: {1079, "цена за единицу предмета расчета", TypeVLN, 6, ScopeOperation, false},
+	1162: {1162, "код товарной номенклатуры", TypeBytes, 32, ScopeOperation, false},
+	1171: {1171, "телефон поставщика", TypeString, 19, ScopeOperation, false},
+	1191: {1191, "дополнительный реквизит предмета расчета", TypeString, 64, ScopeOperation, false},
+	1197: {1197, "единица измерения предмета расчета", TypeString, 16, ScopeOperation, false},
+	1198: {1198, "размер НДС за единицу предмета расчета", TypeVLN, 6, ScopeOperation, false},
+	1199: {1199, "ставка НДС", TypeByte, 1, ScopeOperation, false},
+	1200: {1200, "сумма НДС за предмет расчета", TypeVLN, 6, ScopeOperation, false},
+	1207: {1207, "признак торговли подакцизными товарами", TypeByte, 1, ScopeOperation, false},
+	1212: {1212, "признак предмета расчета", TypeByte, 1, ScopeOperation, false},
+	1214: {1214, "признак способа расчета", TypeByte, 1, ScopeOperation, false},
+	1222: {1222, "признак агента по предмету расчета", TypeByte, 1, ScopeOperation, false},
+	1223: {1223, "данные агента", TypeSTLV, 512, ScopeOperation, false},
+	1224: {1224, "данные поставщика", TypeSTLV, 512, ScopeOperation, false},
+	1225: {1225, "наименование поставщика", TypeString, 256, ScopeOperation, false},
+	1226: {1226, "ИНН поставщика", TypeString, 12, ScopeOperation, true},
+	1229: {1229, "акциз", TypeVLN, 6, ScopeOperation, false},
+	1230: {1230, "код страны происхождения товара", TypeString, 3, ScopeOperation, false},
+	1231: {1231, "номер таможенной декларации", TypeString, 32, ScopeOperation, false},
+
+	//реквизиты регистрации ККТ
+	1001: {1001, "признак автоматического режима", TypeByte, 1, ScopeCheck, false},
+	1002: {1002, "признак автономного режима", TypeByte, 1, ScopeCheck, false},
+	1013: {1013, "заводской номер ККТ", TypeString, 20, ScopeFN, false},
+	1017: {1017, "ИНН ОФД", TypeString, 12, ScopeCheck, true},
+	1018: {1018, "ИНН пользователя", TypeString, 12, ScopeCheck, true},
+	1036: {1036, "номер автомата", TypeString, 20, ScopeCheck, false},
+	1037: {1037, "регистрационный номер ККТ", TypeString, 20, ScopeCheck, false},
+	1046: {1046, "наименование ОФД", TypeString, 256, ScopeCheck, false},
+	1048: {1048, "наименование пользователя", TypeString, 256, ScopeCheck, false},
+	1056: {1056, "признак шифрования", TypeByte, 1, ScopeCheck, false},
+	1060: {1060, "адрес сайта ФНС", TypeString, 256, ScopeCheck, false},
+	1062: {1062, "системы налогообложения", TypeByte, 1, ScopeCheck, false},
+	1101: {1101, "код причины перерегистрации", TypeByte, 1, ScopeCheck, false},
+	1108: {1108, "признак ККТ для расчетов только в сети Интернет", TypeByte, 1, ScopeCheck, false},
+	1109: {1109, "признак расчетов за услуги", TypeByte, 1, ScopeCheck, false},
+	1110: {1110, "признак АС БСО", TypeByte, 1, ScopeCheck, false},
+	1126: {1126, "признак проведения лотереи", TypeByte, 1, ScopeCheck, false},
+	1193: {1193, "признак проведения азартных игр", TypeByte, 1, ScopeCheck, false},
+	1205: {1205, "коды причин изменения сведений о ККТ", TypeUint32, 4, ScopeCheck, false},
+	1221: {1221, "признак установки принтера в автомате", TypeByte, 1, ScopeCheck, false},
+
+	//реквизиты, формируемые ФН
+	1012: {1012, "дата, время", TypeUnixTime, 4, ScopeFN, false},
+	1020: {1020, "сумма расчета, указанного в чеке (БСО)", TypeVLN, 6, ScopeFN, false},
+	1031: {1031, "сумма по чеку (БСО) наличными", TypeVLN, 6, ScopeFN, false},
+	1038: {1038, "номер смены", TypeUint32, 4, ScopeFN, false},
+	1040: {1040, "номер ФД", TypeUint32, 4, ScopeFN, false},
+	1041: {1041, "номер ФН", TypeString, 16, ScopeFN, false},
+	1042: {1042, "номер чека за смену", TypeUint32, 4, ScopeFN, false},
+	1050: {1050, "признак исчерпания ресурса ФН", TypeByte, 1, ScopeFN, false},
+	1051: {1051, "признак необходимости срочной замены ФН", TypeByte, 1, ScopeFN, false},
+	1052: {1052, "признак заполнения памяти ФН", TypeByte, 1, ScopeFN, false},
+	1053: {1053, "признак превышения времени ожидания ответа ОФД", TypeByte, 1, ScopeFN, false},
+	1054: {1054, "признак расчета", TypeByte, 1, ScopeFN, false},
+	1077: {1077, "фискальный признак документа", TypeBytes, 6, ScopeFN, false},
+	1081: {1081, "сумма по чеку (БСО) безналичными", TypeVLN, 6, ScopeFN, false},
+	1097: {1097, "количество непереданных ФД", TypeUint32, 4, ScopeFN, false},
+	1098: {1098, "дата первого из непереданных ФД", TypeUnixTime, 4, ScopeFN, false},
+	1102: {1102, "сумма НДС чека по ставке 20%", TypeVLN, 6, ScopeFN, false},
+	1103: {1103, "сумма НДС чека по ставке 10%", TypeVLN, 6, ScopeFN, false},
+	1104: {1104, "сумма расчета по чеку с НДС по ставке 0%", TypeVLN, 6, ScopeFN, false},
+	1105: {1105, "сумма расчета по чеку без НДС", TypeVLN, 6, ScopeFN, false},
+	1106: {1106, "сумма НДС чека по расч. ставке 20/120", TypeVLN, 6, ScopeFN, false},
+	1107: {1107, "сумма НДС чека по расч. ставке 10/110", TypeVLN, 6, ScopeFN, false},
+	1111: {1111, "общее количество ФД за смену", TypeUint32, 4, ScopeFN, false},
+	1116: {1116, "номер первого непереданного документа", TypeUint32, 4, ScopeFN, false},
+	1118: {1118, "количество кассовых чеков (БСО) за смену", TypeUint32, 4, ScopeFN, false},
+	1188: {1188, "версия ККТ", TypeString, 8, ScopeFN, false},
+	1189: {1189, "версия ФФД ККТ", TypeByte, 1, ScopeFN, false},
+	1190: {1190, "версия ФФД ФН", TypeByte, 1, ScopeFN, false},
+	1209: {1209, "версия ФФД", TypeByte, 1, ScopeFN, false},
+	1215: {1215, "сумма по чеку (БСО) предоплатой", TypeVLN, 6, ScopeFN, false},
+	1216: {1216, "сумма по чеку (БСО) постоплатой", TypeVLN, 6, ScopeFN, false},
+	1217: {1217, "сумма по чеку (БСО) встречным предоставлением", TypeVLN, 6, ScopeFN, false},
+	1206: {1206, "сообщение оператора", TypeByte, 1, ScopeFN, false},
+	1208: {1208, "сайт чеков", TypeString, 256, ScopeFN, false},
+	1213: {1213, "ресурс ключей ФП", TypeUint32, 4, ScopeFN, false},
+
+	//реквизиты подтверждения оператора
+	1068: {1068, "сообщение оператора для ФН", TypeSTLV, 9, ScopeFN, false},
+	1078: {1078, "фискальный признак оператора", TypeBytes, 18, ScopeFN, false},
+}
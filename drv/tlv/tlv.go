@@ -0,0 +1,370 @@
+package tlv
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/text/encoding/charmap"
+)
+
+/*
+Формат TLV структуры ФФД:
+Тег: 2 байта (little endian)
+Длина: 2 байта (little endian)
+Значение: N байт
+Например, тег 1008 "адрес покупателя" со значением 12345678:
+F0h 03h 08h 00h 31h 32h 33h 34h 35h 36h 37h 38h
+
+STLV - составная структура, значение которой является последовательностью TLV структур
+(1059 предмет расчета, 1084 доп. реквизит пользователя, 1223 данные агента и т.д.)
+*/
+
+//DefaultCodePage кодировка строковых реквизитов ФФД по умолчанию
+const DefaultCodePage = "cp866"
+
+//TimeFormat формат даты и времени для реквизитов типа UNIXTIME
+const TimeFormat = "2006-01-02 15:04:05"
+
+//TLV структура тег-длина-значение
+type TLV struct {
+	Tag   uint16
+	Value []byte
+}
+
+//Bytes вернет TLV в виде байт для передачи в ФН
+func (t TLV) Bytes() []byte {
+	b := make([]byte, 4+len(t.Value))
+	binary.LittleEndian.PutUint16(b[0:2], t.Tag)
+	binary.LittleEndian.PutUint16(b[2:4], uint16(len(t.Value)))
+	copy(b[4:], t.Value)
+	return b
+}
+
+//STLV собирает составную структуру из вложенных TLV
+func STLV(tag uint16, child ...TLV) TLV {
+	val := make([]byte, 0, 64)
+	for _, c := range child {
+		val = append(val, c.Bytes()...)
+	}
+	return TLV{Tag: tag, Value: val}
+}
+
+//replaceRunes замена символов, которых нет в однобайтовой кодировке
+var replaceRunes = map[rune]string{
+	'«': "\"", '»': "\"", '„': "\"", '“': "\"", '”': "\"", '‘': "'", '’': "'",
+	'—': "-", '–': "-", '−': "-", '№': "N", '…': "...", '\u00a0': " ",
+}
+
+//charmapFor однобайтовая кодировка по имени, неизвестное имя - кодировка по умолчанию cp866
+func charmapFor(codepage string) *charmap.Charmap {
+	switch codepage {
+	case "cp1251", "windows-1251":
+		return charmap.Windows1251
+	}
+	return charmap.CodePage866
+}
+
+//EncodeString кодирует строку в заданной кодировке ("cp866", "cp1251"),
+//символы, которых нет в кодировке, заменяются близкими по начертанию или "?"
+func EncodeString(s string, codepage string) []byte {
+	enc := charmapFor(codepage)
+	out := make([]byte, 0, len(s))
+	for _, r := range s {
+		if b, ok := enc.EncodeRune(r); ok {
+			out = append(out, b)
+			continue
+		}
+		rep, ok := replaceRunes[r]
+		if !ok {
+			rep = "?"
+		}
+		for _, rr := range rep {
+			if b, ok := enc.EncodeRune(rr); ok {
+				out = append(out, b)
+			} else {
+				out = append(out, '?')
+			}
+		}
+	}
+	return out
+}
+
+//DecodeString декодирует строку из заданной кодировки в utf-8
+func DecodeString(b []byte, codepage string) string {
+	out, _ := charmapFor(codepage).NewDecoder().Bytes(b)
+	return string(out)
+}
+
+//EncodeByte кодирует однобайтовое значение
+func EncodeByte(v uint8) []byte {
+	return []byte{v}
+}
+
+//EncodeUint32 кодирует целое 4 байта little endian
+func EncodeUint32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, v)
+	return b
+}
+
+//EncodeVLN кодирует целое переменной длины: little endian без старших нулевых байт
+func EncodeVLN(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, v)
+	n := 8
+	for n > 1 && b[n-1] == 0 {
+		n--
+	}
+	return b[:n]
+}
+
+//EncodeMoney кодирует сумму в рублях в VLN в копейках
+func EncodeMoney(v float64) []byte {
+	return EncodeVLN(uint64(math.Round(v * 100)))
+}
+
+//EncodeFVLN кодирует дробное переменной длины: первый байт - положение десятичной точки, далее VLN
+func EncodeFVLN(v float64, digits int) []byte {
+	//1.5 = 01h 0Fh ; 12.43675 (6 знаков) = 06h + VLN(12436750)
+	if digits < 0 {
+		digits = fracDigits(v)
+	}
+	n := uint64(math.Round(v * math.Pow10(digits)))
+	return append([]byte{byte(digits)}, EncodeVLN(n)...)
+}
+
+//EncodeUnixTime кодирует дату и время в unixtime 4 байта
+func EncodeUnixTime(t time.Time) []byte {
+	return EncodeUint32(uint32(t.Unix()))
+}
+
+//fracDigits количество знаков после запятой, не более 6
+func fracDigits(v float64) int {
+	s := strconv.FormatFloat(v, 'f', -1, 64)
+	i := strings.IndexByte(s, '.')
+	if i < 0 {
+		return 0
+	}
+	d := len(s) - i - 1
+	if d > 6 {
+		d = 6
+	}
+	return d
+}
+
+//Encoder кодирует значения реквизитов по словарю тегов
+type Encoder struct {
+	//CodePage кодировка строковых реквизитов
+	CodePage string
+}
+
+//NewEncoder вернет кодировщик с кодировкой по умолчанию
+func NewEncoder() *Encoder {
+	return &Encoder{CodePage: DefaultCodePage}
+}
+
+//Encode кодирует значение реквизита в TLV по словарю тегов
+func Encode(tag uint16, v interface{}) (TLV, error) {
+	return NewEncoder().Encode(tag, v)
+}
+
+//Encode кодирует значение реквизита в TLV по словарю тегов.
+//v может быть строкой, числом, bool, time.Time, []byte,
+//для STLV - map[string]interface{} (номер тега - значение) или []interface{} из {"tag","value"}
+func (e *Encoder) Encode(tag uint16, v interface{}) (TLV, error) {
+	t, ok := Lookup(tag)
+	if !ok {
+		return TLV{}, errors.New("тег " + strconv.Itoa(int(tag)) + " не найден в словаре")
+	}
+	val, err := e.encodeValue(t, v)
+	if err != nil {
+		return TLV{}, errors.New("тег " + strconv.Itoa(int(tag)) + " (" + t.Name + "): " + err.Error())
+	}
+	if t.MaxLen > 0 && len(val) > t.MaxLen {
+		return TLV{}, errors.New("тег " + strconv.Itoa(int(tag)) + " (" + t.Name + "): длина " + strconv.Itoa(len(val)) + " превышает " + strconv.Itoa(t.MaxLen) + " байт")
+	}
+	return TLV{Tag: tag, Value: val}, nil
+}
+
+func (e *Encoder) encodeValue(t Tag, v interface{}) ([]byte, error) {
+	switch t.Type {
+	case TypeByte:
+		n, err := toFloat(v)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 || n > 255 {
+			return nil, errors.New("значение должно быть в диапазоне 0..255")
+		}
+		return EncodeByte(uint8(n)), nil
+	case TypeUint32:
+		n, err := toFloat(v)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 || n > math.MaxUint32 {
+			return nil, errors.New("значение вне диапазона uint32")
+		}
+		return EncodeUint32(uint32(n)), nil
+	case TypeVLN:
+		//денежные величины передаются в рублях, в ФН уходят в копейках
+		n, err := toFloat(v)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, errors.New("значение не может быть отрицательным")
+		}
+		return EncodeMoney(n), nil
+	case TypeFVLN:
+		n, err := toFloat(v)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, errors.New("значение не может быть отрицательным")
+		}
+		return EncodeFVLN(n, -1), nil
+	case TypeString:
+		s, ok := v.(string)
+		if !ok {
+			if n, err := toFloat(v); err == nil {
+				s = strconv.FormatFloat(n, 'f', -1, 64)
+			} else {
+				return nil, errors.New("ожидается строка")
+			}
+		}
+		b := EncodeString(s, e.CodePage)
+		if t.Fixed && t.MaxLen > len(b) {
+			//ИНН 10 знаков дополняется пробелами справа до 12
+			b = append(b, []byte(strings.Repeat(" ", t.MaxLen-len(b)))...)
+		}
+		return b, nil
+	case TypeUnixTime:
+		switch tv := v.(type) {
+		case time.Time:
+			return EncodeUnixTime(tv), nil
+		case string:
+			tm, err := time.ParseInLocation(TimeFormat, tv, time.Local)
+			if err != nil {
+				tm, err = time.ParseInLocation("2006-01-02", tv, time.Local)
+				if err != nil {
+					return nil, errors.New("дата должна быть в формате " + TimeFormat)
+				}
+			}
+			return EncodeUnixTime(tm), nil
+		default:
+			n, err := toFloat(v)
+			if err != nil {
+				return nil, err
+			}
+			return EncodeUint32(uint32(n)), nil
+		}
+	case TypeBytes:
+		switch tv := v.(type) {
+		case []byte:
+			return tv, nil
+		case string:
+			//двоичные реквизиты (код товара 1162) передаются в base64
+			b, err := base64.StdEncoding.DecodeString(tv)
+			if err != nil {
+				return nil, errors.New("ожидается строка base64")
+			}
+			return b, nil
+		}
+		return nil, errors.New("ожидается строка base64")
+	case TypeSTLV:
+		child, err := e.encodeChildren(v)
+		if err != nil {
+			return nil, err
+		}
+		return STLV(t.Code, child...).Value, nil
+	}
+	return nil, errors.New("неизвестный тип реквизита")
+}
+
+//encodeChildren разбирает вложенные реквизиты STLV
+func (e *Encoder) encodeChildren(v interface{}) ([]TLV, error) {
+	ret := make([]TLV, 0, 8)
+	switch tv := v.(type) {
+	case []TLV:
+		return tv, nil
+	case map[string]interface{}:
+		//порядок тегов в STLV не важен, но сохраним его стабильным
+		keys := make([]string, 0, len(tv))
+		for k := range tv {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			tag, err := strconv.Atoi(k)
+			if err != nil {
+				return nil, errors.New("номер тега должен быть числом: " + k)
+			}
+			c, err := e.Encode(uint16(tag), tv[k])
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, c)
+		}
+	case []interface{}:
+		for _, item := range tv {
+			m, ok := item.(map[string]interface{})
+			if !ok {
+				return nil, errors.New("элемент STLV должен быть объектом {tag, value}")
+			}
+			ntag, err := toFloat(m["tag"])
+			if err != nil {
+				return nil, errors.New("не указан тег вложенного реквизита")
+			}
+			c, err := e.Encode(uint16(ntag), m["value"])
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, c)
+		}
+	default:
+		return nil, errors.New("ожидается набор вложенных реквизитов")
+	}
+	return ret, nil
+}
+
+//toFloat приводит значение json к числу
+func toFloat(v interface{}) (float64, error) {
+	switch tv := v.(type) {
+	case float64:
+		return tv, nil
+	case float32:
+		return float64(tv), nil
+	case int:
+		return float64(tv), nil
+	case int64:
+		return float64(tv), nil
+	case uint8:
+		return float64(tv), nil
+	case uint16:
+		return float64(tv), nil
+	case uint32:
+		return float64(tv), nil
+	case uint64:
+		return float64(tv), nil
+	case bool:
+		if tv {
+			return 1, nil
+		}
+		return 0, nil
+	case string:
+		f, err := strconv.ParseFloat(strings.Replace(tv, ",", ".", 1), 64)
+		if err != nil {
+			return 0, errors.New("ожидается число")
+		}
+		return f, nil
+	}
+	return 0, errors.New("ожидается число")
+}
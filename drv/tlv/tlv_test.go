@@ -0,0 +1,176 @@
+package tlv
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatalf("hex %q: %v", s, err)
+	}
+	return b
+}
+
+func TestEncodeVLN(t *testing.T) {
+	tests := []struct {
+		v    uint64
+		want string
+	}{
+		{0, "00"},
+		{1, "01"},
+		{0x1234, "3412"},
+		{1 << 32, "0000000001"},
+	}
+	for _, tt := range tests {
+		got := EncodeVLN(tt.v)
+		if !bytes.Equal(got, unhex(t, tt.want)) {
+			t.Errorf("EncodeVLN(%d) = %x, want %s", tt.v, got, tt.want)
+		}
+		if back := DecodeVLN(got); back != tt.v {
+			t.Errorf("DecodeVLN(%x) = %d, want %d", got, back, tt.v)
+		}
+	}
+}
+
+func TestEncodeMoney(t *testing.T) {
+	tests := []struct {
+		v    float64
+		want string
+	}{
+		{12.34, "d204"},
+		{0.1 + 0.2, "1e"},
+		{0, "00"},
+	}
+	for _, tt := range tests {
+		if got := EncodeMoney(tt.v); !bytes.Equal(got, unhex(t, tt.want)) {
+			t.Errorf("EncodeMoney(%v) = %x, want %s", tt.v, got, tt.want)
+		}
+	}
+}
+
+func TestEncodeFVLN(t *testing.T) {
+	tests := []struct {
+		v      float64
+		digits int
+		want   string
+	}{
+		//примеры ФФД: 1.5 = 01h 0Fh, 12.43675 с 6 знаками = 06h + VLN(12436750)
+		{1.5, -1, "010f"},
+		{12.43675, 6, "060ec5bd"},
+		{2, -1, "0002"},
+		{0.001, 3, "0301"},
+	}
+	for _, tt := range tests {
+		got := EncodeFVLN(tt.v, tt.digits)
+		if !bytes.Equal(got, unhex(t, tt.want)) {
+			t.Errorf("EncodeFVLN(%v, %d) = %x, want %s", tt.v, tt.digits, got, tt.want)
+		}
+		if back := DecodeFVLN(got); back != tt.v {
+			t.Errorf("DecodeFVLN(%x) = %v, want %v", got, back, tt.v)
+		}
+	}
+}
+
+func TestEncodeTag(t *testing.T) {
+	tests := []struct {
+		name     string
+		codepage string
+		tag      uint16
+		v        interface{}
+		want     string
+	}{
+		//пример ФФД: телефон покупателя 1008
+		{"1008", DefaultCodePage, 1008, "12345678", "f00308003132333435363738"},
+		//ИНН 10 знаков дополняется пробелами до 12
+		{"ИНН кассира", DefaultCodePage, 1203, "1234567890", "b3040c00313233343536373839302020"},
+		{"ИНН 12 знаков", DefaultCodePage, 1203, "123456789012", "b3040c00313233343536373839303132"},
+		{"cp866", "cp866", 1030, "Чай", "06040300" + "97a0a9"},
+		{"cp1251", "cp1251", 1030, "Чай", "06040300" + "d7e0e9"},
+		{"windows-1251", "windows-1251", 1030, "Чай", "06040300" + "d7e0e9"},
+		//неизвестная и пустая кодировка - cp866
+		{"неизвестная кодировка", "koi8-r", 1030, "Чай", "06040300" + "97a0a9"},
+		{"пустая кодировка", "", 1030, "Чай", "06040300" + "97a0a9"},
+		{"цена", DefaultCodePage, 1079, 12.34, "37040200d204"},
+		{"количество", DefaultCodePage, 1023, 1.5, "ff030200010f"},
+	}
+	for _, tt := range tests {
+		tv, err := (&Encoder{CodePage: tt.codepage}).Encode(tt.tag, tt.v)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got := tv.Bytes(); !bytes.Equal(got, unhex(t, tt.want)) {
+			t.Errorf("%s: Encode(%d, %v) = %x, want %s", tt.name, tt.tag, tt.v, got, tt.want)
+		}
+	}
+}
+
+func TestEncodeErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		tag  uint16
+		v    interface{}
+	}{
+		{"ИНН длиннее 12", 1203, "1234567890123"},
+		{"неизвестный тег", 9999, "x"},
+		{"отрицательная цена", 1079, -1.0},
+		{"байт вне диапазона", 1055, 256},
+		{"не base64", 1162, "не base64"},
+	}
+	for _, tt := range tests {
+		if _, err := Encode(tt.tag, tt.v); err == nil {
+			t.Errorf("%s: ожидалась ошибка", tt.name)
+		}
+	}
+}
+
+func TestEncodeString(t *testing.T) {
+	tests := []struct {
+		s        string
+		codepage string
+		want     string
+	}{
+		{"Привет", "cp866", "8fe0a8a2a5e2"},
+		{"Привет", "cp1251", "cff0e8e2e5f2"},
+		//кавычек-елочек и тире нет в cp866, они заменяются, прочие символы - "?"; № в cp866 есть (FCh)
+		{"«№5»—😀", "cp866", "22fc35222d3f"},
+		{"…", "cp866", hex.EncodeToString([]byte("..."))},
+		//в cp1251 есть «, №, —
+		{"«№»—", "cp1251", "abb9bb97"},
+	}
+	for _, tt := range tests {
+		if got := EncodeString(tt.s, tt.codepage); !bytes.Equal(got, unhex(t, tt.want)) {
+			t.Errorf("EncodeString(%q, %s) = %x, want %s", tt.s, tt.codepage, got, tt.want)
+		}
+	}
+}
+
+func TestSTLV(t *testing.T) {
+	//данные агента 1223 с одним телефоном платежного агента 1073
+	got := STLV(1223, TLV{Tag: 1073, Value: []byte("1")}).Bytes()
+	if want := unhex(t, "c704050031040100"+"31"); !bytes.Equal(got, want) {
+		t.Errorf("STLV = %x, want %x", got, want)
+	}
+	//повторяющиеся теги задаются списком {tag, value}
+	tv, err := Encode(1223, []interface{}{
+		map[string]interface{}{"tag": 1073, "value": "+79001234567"},
+		map[string]interface{}{"tag": 1073, "value": "+79007654321"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := DecodeAll(tv.Bytes(), DefaultCodePage)
+	if len(fields) != 1 || fields[0].Tag != 1223 || len(fields[0].Children) != 2 {
+		t.Fatalf("DecodeAll = %+v", fields)
+	}
+	for i, want := range []string{"+79001234567", "+79007654321"} {
+		c := fields[0].Children[i]
+		if c.Tag != 1073 || c.Value != want {
+			t.Errorf("реквизит %d = %d %v, want 1073 %s", i, c.Tag, c.Value, want)
+		}
+	}
+}
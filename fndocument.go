@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"kkm-shtrih/drv"
+	"kkm-shtrih/drv/tlv"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+//FNDocument фискальный документ из архива ФН
+type FNDocument struct {
+	XMLName  xml.Name    `xml:"Document" json:"-"`
+	Number   uint32      `xml:"Number,attr" json:"number"`
+	Type     uint16      `xml:"Type,attr" json:"type"`
+	TypeName string      `xml:"TypeName,attr" json:"typeName"`
+	Tags     []tlv.Field `xml:"Tag" json:"tags"`
+}
+
+//getFNDocument прочитает фискальный документ из архива ФН по номеру и разберет реквизиты
+func getFNDocument(c *gin.Context) {
+	/*
+		GET FNDocument/<DeviceID>?DocumentNumber=12&format=json
+		DocumentNumber=0 - последний сформированный документ
+	*/
+	deviceID := c.Param("DeviceID")
+	json := c.DefaultQuery("format", "xml")
+	reply := func(code int, obj interface{}) {
+		if json == "json" {
+			c.JSON(code, obj)
+		} else {
+			c.XML(code, obj)
+		}
+	}
+
+	kkm, err := KkmServ.GetDrv(deviceID)
+	if err != nil {
+		reply(http.StatusOK, gin.H{"error": true, "message": "deviceID не зарегистрирован"})
+		return
+	}
+	procid, _ := getIntParam(c, "procid", 0)
+	if kkm.ChkBusy(procid) {
+		reply(http.StatusOK, gin.H{"error": true, "message": "ККТ занята"})
+		return
+	}
+	//займем ккм
+	if procid == 0 {
+		procid = int(time.Now().Unix())
+		//освободим по завершению
+		defer kkm.SetBusy(0)
+	}
+	kkm.SetBusy(procid)
+
+	num, err := getIntParam(c, "DocumentNumber", 0)
+	if err != nil || num < 0 {
+		reply(http.StatusBadRequest, gin.H{"error": true, "message": "неверный номер документа"})
+		return
+	}
+	if num == 0 {
+		errcode, err := kkm.FNGetStatus()
+		if err != nil {
+			reply(http.StatusOK, gin.H{"error": true, "message": err.Error()})
+			return
+		}
+		if errcode > 0 {
+			reply(http.StatusOK, gin.H{"error": true, "message": kkm.ParseErrState(errcode)})
+			return
+		}
+		num = int(kkm.FNGetFNState().DocumentNumber)
+	}
+
+	doctype, data, errcode, err := kkm.FNReadDocument(kkm.GetAdminPass(), uint32(num))
+	if err != nil {
+		reply(http.StatusOK, gin.H{"error": true, "message": err.Error()})
+		return
+	}
+	if errcode > 0 {
+		reply(http.StatusOK, gin.H{"error": true, "message": kkm.ParseErrState(errcode)})
+		return
+	}
+	doc := FNDocument{
+		Number:   uint32(num),
+		Type:     doctype,
+		TypeName: tlv.DocumentTypeName(doctype),
+		Tags:     tlv.DecodeAll(data, kkm.TLVCodePage()),
+	}
+	if json == "json" {
+		c.JSON(http.StatusOK, gin.H{"error": false, "message": "ok", "document": doc})
+		return
+	}
+	c.XML(http.StatusOK, doc)
+}
+
+//documentCopyLines сформирует строки копии фискального документа для печати
+func documentCopyLines(doc FNDocument, width int) []string {
+	lines := make([]string, 0, 64)
+	lines = append(lines, centerLine("КОПИЯ", width), centerLine(doc.TypeName, width))
+	lines = append(lines, textLine("ФД", strconv.FormatUint(uint64(doc.Number), 10), width)...)
+	lines = append(lines, strings.Repeat("-", width))
+	lines = appendFieldLines(lines, doc.Tags, width)
+	lines = append(lines, strings.Repeat("-", width), centerLine("КОПИЯ", width))
+	return lines
+}
+
+func appendFieldLines(lines []string, fields []tlv.Field, width int) []string {
+	for _, f := range fields {
+		if len(f.Children) > 0 {
+			lines = append(lines, drv.WrapText(f.Name, width)...)
+			lines = appendFieldLines(lines, f.Children, width)
+			lines = append(lines, strings.Repeat("-", width))
+			continue
+		}
+		lines = append(lines, textLine(f.Name, fieldValue(f), width)...)
+	}
+	return lines
+}
+
+//fieldValue значение реквизита для печати, денежные суммы с двумя знаками
+func fieldValue(f tlv.Field) string {
+	if t, ok := tlv.Lookup(f.Tag); ok && t.Type == tlv.TypeVLN {
+		if v, ok := f.Value.(float64); ok {
+			return strconv.FormatFloat(v, 'f', 2, 64)
+		}
+	}
+	return fmt.Sprint(f.Value)
+}
+
+//textLine название слева, значение справа; если не помещается - значение с новой строки
+func textLine(name, value string, width int) []string {
+	nl := utf8.RuneCountInString(name)
+	vl := utf8.RuneCountInString(value)
+	if nl+vl+1 <= width {
+		return []string{name + strings.Repeat(" ", width-nl-vl) + value}
+	}
+	lines := drv.WrapText(name, width)
+	for _, v := range drv.WrapText(value, width) {
+		lines = append(lines, strings.Repeat(" ", width-utf8.RuneCountInString(v))+v)
+	}
+	return lines
+}
+
+//centerLine выравнивание строки по центру
+func centerLine(s string, width int) string {
+	l := utf8.RuneCountInString(s)
+	if l >= width {
+		return s
+	}
+	return strings.Repeat(" ", (width-l)/2) + s
+}
+
+//getOFDTicket Запрос квитанции о получении данных в ОФД по номеру
+func getOFDTicket(c *gin.Context) {
+	deviceID := c.Param("DeviceID")
+	json := c.DefaultQuery("format", "xml")
+	reply := func(code int, obj interface{}) {
+		if json == "json" {
+			c.JSON(code, obj)
+		} else {
+			c.XML(code, obj)
+		}
+	}
+	kkm, err := KkmServ.GetDrv(deviceID)
+	if err != nil {
+		reply(http.StatusOK, gin.H{"error": true, "message": "deviceID не зарегистрирован"})
+		return
+	}
+	procid, _ := getIntParam(c, "procid", 0)
+	if kkm.ChkBusy(procid) {
+		reply(http.StatusOK, gin.H{"error": true, "message": "ККТ занята"})
+		return
+	}
+	//займем ккм
+	if procid == 0 {
+		procid = int(time.Now().Unix())
+		//освободим по завершению
+		defer kkm.SetBusy(0)
+	}
+	kkm.SetBusy(procid)
+
+	admpass := kkm.GetAdminPass()
+	checkNumber, err := getIntParam(c, "CheckNumber", 0)
+	if err != nil {
+		reply(http.StatusOK, gin.H{"error": true, "message": err.Error()})
+		return
+	}
+	param := make([]byte, 8)
+	copy(param, admpass[:4])
+	copy(param[4:], itob(int64(checkNumber)))
+	/* Код команды FF3Сh . Длина сообщения: 11 байт.
+	Пароль системного администратора: 4 байта [0:4]
+	Номер фискального документа: 4 байта	[4:8]
+	Ответ: FF3Сh Длина сообщения: 1+N байт.
+	Код ошибки: 1 байт
+	Квитанция: N байт
+	*/
+	errcode, data, err := kkm.SendCommand(0xff3c, param)
+	if err != nil {
+		reply(http.StatusOK, gin.H{"error": true, "message": err.Error()})
+		return
+	}
+	if errcode > 0 {
+		reply(http.StatusOK, gin.H{"error": true, "message": kkm.ParseErrState(errcode)})
+		return
+	}
+	reply(http.StatusOK, gin.H{"error": false, "message": "ok", "docval": data[:]})
+}
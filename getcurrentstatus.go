@@ -246,19 +246,16 @@ func getCurrentStatus(c *gin.Context) {
 	Номер документа для ОФД первого в очереди: 4 байта [4:8]
 	Дата и время документа для ОФД первого в очереди: 5 бай [8:13]
 	*/
-	errcode, _, err = kkm.SendCommand(0xff39, admpass)
+	ofd, errcode, err := kkm.FNGetOFDStatus()
 	if errcode > 0 {
 		c.XML(http.StatusBadRequest, gin.H{"error": kkm.ParseErrState(errcode)})
 		return
 	}
-	/*Количество непереданных документов
-	BacklogDocumentsCounter int `xml:"BacklogDocumentsCounter,attr" binding:"-"`
-	//Номер первого непереданного документа
-	BacklogDocumentFirstNumber int `xml:"BacklogDocumentFirstNumber,attr" binding:"-"`
-	//Дата и время первого из непереданных документов
-	BacklogDocumentFirstDateTime string `xml:"BacklogDocumentFirstDateTime,attr" binding:"-"`*/
-	out.BacklogDocumentsCounter = int(btoi(data[2:4]))
-	out.BacklogDocumentFirstNumber = int(btoi(data[4:8]))
-	out.BacklogDocumentFirstDateTime = time.Unix(btoi(data[8:13]), 0).Format("2006-01-02 15:04:05")
+	OFDMon.Update(deviceID, ofd, err)
+	out.BacklogDocumentsCounter = ofd.Count
+	out.BacklogDocumentFirstNumber = int(ofd.FirstNumber)
+	if ofd.Count > 0 {
+		out.BacklogDocumentFirstDateTime = ofd.FirstDateTime.Format("2006-01-02 15:04:05")
+	}
 	c.XML(http.StatusBadRequest, out)
 }
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/color"
+	"io"
+	"kkm-shtrih/drv"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	//форматы изображений логотипа
+	_ "image/png"
+
+	"github.com/gin-gonic/gin"
+	bolt "go.etcd.io/bbolt"
+	_ "golang.org/x/image/bmp"
+)
+
+//Logo монохромное изображение для печати, хранится для ККТ по имени
+type Logo struct {
+	Name     string    `json:"name"`
+	DeviceID string    `json:"deviceID"`
+	Width    int       `json:"width"`
+	Height   int       `json:"height"`
+	Created  time.Time `json:"created"`
+	//Линии графики по drv.GraphicsLineBytes байт, изображение выровнено по центру области печати
+	Data []byte `json:"data,omitempty"`
+}
+
+//LogoRef ссылка на логотип в текстовом документе
+type LogoRef struct {
+	Name string `xml:"Name,attr"`
+}
+
+//initLogos создаст хранилище логотипов
+func initLogos() error {
+	return DB.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte("Logos"))
+		return err
+	})
+}
+
+func logoKey(deviceID, name string) []byte {
+	return []byte(deviceID + "/" + name)
+}
+
+func loadLogo(deviceID, name string) (Logo, error) {
+	var l Logo
+	err := DB.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket([]byte("Logos")).Get(logoKey(deviceID, name))
+		if v == nil {
+			return errors.New("логотип " + name + " не найден")
+		}
+		return json.Unmarshal(v, &l)
+	})
+	return l, err
+}
+
+func saveLogo(l *Logo) error {
+	v, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	return DB.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("Logos")).Put(logoKey(l.DeviceID, l.Name), v)
+	})
+}
+
+//graphicsWidth ширина области печати в точках (команда 26H), но не больше линии графики
+func graphicsWidth(kkm *drv.KkmDrv) int {
+	w := drv.GraphicsLineBytes * 8
+	fp, errcode, err := kkm.GetFontParam(kkm.GetAdminPass(), 1)
+	if err == nil && errcode == 0 && fp.PrintWidth > 0 && int(fp.PrintWidth) < w {
+		w = int(fp.PrintWidth)
+	}
+	return w
+}
+
+//luminance яркость точки 0..255, прозрачные точки считаются белыми
+func luminance(c color.Color) float64 {
+	r, g, b, a := c.RGBA()
+	//цвета RGBA() умножены на альфу, накладываем на белый фон
+	return (0.299*float64(r)+0.587*float64(g)+0.114*float64(b))/257 + 255*(1-float64(a)/0xffff)
+}
+
+//convertLogo уменьшит изображение до ширины области печати width и
+//переведет в монохромное с рассеиванием ошибки (Флойд-Стейнберг)
+func convertLogo(img image.Image, width int) (Logo, error) {
+	b := img.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+	if sw == 0 || sh == 0 {
+		return Logo{}, errors.New("пустое изображение")
+	}
+	w, h := sw, sh
+	if w > width {
+		h, w = sh*width/sw, width
+	}
+	if h > drv.GraphicsMaxLines {
+		w, h = w*drv.GraphicsMaxLines/h, drv.GraphicsMaxLines
+	}
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+	//яркость точки - среднее по области исходного изображения
+	gray := make([]float64, w*h)
+	for y := 0; y < h; y++ {
+		y0, y1 := b.Min.Y+y*sh/h, b.Min.Y+(y+1)*sh/h
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < w; x++ {
+			x0, x1 := b.Min.X+x*sw/w, b.Min.X+(x+1)*sw/w
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+			var sum float64
+			for yy := y0; yy < y1; yy++ {
+				for xx := x0; xx < x1; xx++ {
+					sum += luminance(img.At(xx, yy))
+				}
+			}
+			gray[y*w+x] = sum / float64((y1-y0)*(x1-x0))
+		}
+	}
+	spread := func(x, y int, e float64) {
+		if x >= 0 && x < w && y < h {
+			gray[y*w+x] += e
+		}
+	}
+	data := make([]byte, h*drv.GraphicsLineBytes)
+	offset := (width - w) / 2
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			old := gray[y*w+x]
+			val := 255.0
+			if old < 128 {
+				val = 0
+				px := offset + x
+				data[y*drv.GraphicsLineBytes+px/8] |= 1 << uint(px%8)
+			}
+			e := old - val
+			spread(x+1, y, e*7/16)
+			spread(x-1, y+1, e*3/16)
+			spread(x, y+1, e*5/16)
+			spread(x+1, y+1, e/16)
+		}
+	}
+	return Logo{Width: w, Height: h, Created: time.Now(), Data: data}, nil
+}
+
+//loadedGraphic изображение в памяти графики ККТ: имя, время создания и номер подключения, при котором загружено
+type loadedGraphic struct {
+	Name    string
+	Created time.Time
+	Connect int
+}
+
+//graphicsMem что загружено в память графики ККТ, чтобы повторно печатать логотип без загрузки по линиям
+var graphicsMem = struct {
+	sync.Mutex
+	dev map[string]loadedGraphic
+}{dev: make(map[string]loadedGraphic)}
+
+//printLogo загрузит логотип в память графики ККТ по линиям и напечатает его.
+//Если этот логотип уже загружен при текущем подключении, печатается без загрузки.
+func printLogo(kkm *drv.KkmDrv, pass []byte, l Logo) (byte, error) {
+	if l.Height == 0 || len(l.Data) < l.Height*drv.GraphicsLineBytes {
+		return 1, errors.New("логотип " + l.Name + " поврежден")
+	}
+	key := loadedGraphic{Name: l.Name, Created: l.Created, Connect: kkm.ConnectCount()}
+	graphicsMem.Lock()
+	cached, ok := graphicsMem.dev[kkm.DeviceID]
+	//память графики перезаписывается, пока загрузка не завершена - ее содержимое неизвестно
+	delete(graphicsMem.dev, kkm.DeviceID)
+	graphicsMem.Unlock()
+	if !ok || !cached.Created.Equal(key.Created) || cached.Name != key.Name || cached.Connect != key.Connect {
+		for i := 0; i < l.Height; i++ {
+			line := l.Data[i*drv.GraphicsLineBytes : (i+1)*drv.GraphicsLineBytes]
+			if errcode, err := kkm.LoadGraphicsLine(pass, uint16(i+1), line); errcode > 0 || err != nil {
+				return errcode, err
+			}
+		}
+	}
+	errcode, err := kkm.PrintGraphics(pass, 1, uint16(l.Height))
+	if errcode == 0 && err == nil {
+		graphicsMem.Lock()
+		graphicsMem.dev[kkm.DeviceID] = key
+		graphicsMem.Unlock()
+	}
+	return errcode, err
+}
+
+//readImage изображение из поля file формы или из тела запроса
+func readImage(c *gin.Context) (image.Image, error) {
+	var src io.Reader = c.Request.Body
+	if strings.HasPrefix(c.ContentType(), "multipart/") {
+		fh, err := c.FormFile("file")
+		if err != nil {
+			return nil, err
+		}
+		f, err := fh.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		src = f
+	}
+	data, err := io.ReadAll(src)
+	if err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, errors.New("изображение должно быть PNG или BMP: " + err.Error())
+	}
+	return img, nil
+}
+
+//uploadLogo загрузка логотипа PNG/BMP: ?Name= сохранить под именем, ?print=1 напечатать
+func uploadLogo(c *gin.Context) {
+	deviceID := c.Param("DeviceID")
+	name := c.Query("Name")
+	doPrint := c.Query("print") == "1"
+	kkm, err := KkmServ.GetDrv(deviceID)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"error": true, "message": "deviceID не зарегистрирован"})
+		return
+	}
+	if len(name) == 0 && !doPrint {
+		c.JSON(http.StatusBadRequest, gin.H{"error": true, "message": "не указано имя логотипа"})
+		return
+	}
+	img, err := readImage(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": true, "message": err.Error()})
+		return
+	}
+	if kkm.ChkBusy(0) {
+		c.JSON(http.StatusOK, gin.H{"error": true, "message": "ККТ занята"})
+		return
+	}
+	//займем ккм
+	procid := int(time.Now().Unix())
+	kkm.SetBusy(procid)
+	//освободим по завершению
+	defer kkm.SetBusy(0)
+
+	l, err := convertLogo(img, graphicsWidth(kkm))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": true, "message": err.Error()})
+		return
+	}
+	l.Name = name
+	l.DeviceID = deviceID
+	if len(name) > 0 {
+		if err = saveLogo(&l); err != nil {
+			c.JSON(http.StatusOK, gin.H{"error": true, "message": err.Error()})
+			return
+		}
+	}
+	if doPrint {
+		errcode, err := printLogo(kkm, kkm.GetAdminPass(), l)
+		if err != nil {
+			c.JSON(http.StatusOK, gin.H{"error": true, "message": err.Error()})
+			return
+		}
+		if errcode > 0 {
+			c.JSON(http.StatusOK, gin.H{"error": true, "message": kkm.ParseErrState(errcode)})
+			return
+		}
+	}
+	l.Data = nil
+	c.JSON(http.StatusOK, gin.H{"error": false, "message": "ok", "logo": l})
+}
+
+//getLogos список логотипов ККТ
+func getLogos(c *gin.Context) {
+	deviceID := c.Param("DeviceID")
+	logos := make([]Logo, 0)
+	err := DB.View(func(tx *bolt.Tx) error {
+		cur := tx.Bucket([]byte("Logos")).Cursor()
+		prefix := logoKey(deviceID, "")
+		for k, v := cur.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = cur.Next() {
+			var l Logo
+			if json.Unmarshal(v, &l) == nil {
+				l.Data = nil
+				logos = append(logos, l)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"error": true, "message": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"error": false, "message": "ok", "logos": logos})
+}
+
+//deleteLogo удалит логотип ККТ
+func deleteLogo(c *gin.Context) {
+	deviceID := c.Param("DeviceID")
+	name := c.Param("Name")
+	if _, err := loadLogo(deviceID, name); err != nil {
+		c.JSON(http.StatusOK, gin.H{"error": true, "message": err.Error()})
+		return
+	}
+	err := DB.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("Logos")).Delete(logoKey(deviceID, name))
+	})
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"error": true, "message": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"error": false, "message": "ok"})
+}
+
+//printLogoHandler печать сохраненного логотипа
+func printLogoHandler(c *gin.Context) {
+	deviceID := c.Param("DeviceID")
+	kkm, err := KkmServ.GetDrv(deviceID)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"error": true, "message": "deviceID не зарегистрирован"})
+		return
+	}
+	l, err := loadLogo(deviceID, c.Param("Name"))
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"error": true, "message": err.Error()})
+		return
+	}
+	if kkm.ChkBusy(0) {
+		c.JSON(http.StatusOK, gin.H{"error": true, "message": "ККТ занята"})
+		return
+	}
+	//займем ккм
+	procid := int(time.Now().Unix())
+	kkm.SetBusy(procid)
+	//освободим по завершению
+	defer kkm.SetBusy(0)
+
+	errcode, err := printLogo(kkm, kkm.GetAdminPass(), l)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"error": true, "message": err.Error()})
+		return
+	}
+	if errcode > 0 {
+		c.JSON(http.StatusOK, gin.H{"error": true, "message": kkm.ParseErrState(errcode)})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"error": false, "message": "ok"})
+}
@@ -55,6 +55,9 @@ var LENLINE uint8 = 32
 //DIGITS разрядность сумм
 var DIGITS int = 2
 
+//EVENTDAYS сколько дней хранить журналы событий смен, бумаги и восстановления
+var EVENTDAYS = 90
+
 func searchKKM(c *gin.Context) {
 	ret := drv.SearchKKM()
 	c.JSON(http.StatusOK, gin.H{"error": false, "devices": ret})
@@ -304,17 +307,7 @@ func getDataKKT(c *gin.Context) {
 
 		res.DateTime = strconv.FormatUint(uint64(data[0]), 10) + "." + strconv.FormatUint(uint64(data[1]), 10) + "." + strconv.FormatUint(uint64(data[2]), 10) + " " + strconv.FormatUint(uint64(data[3]), 10) + ":" + strconv.FormatUint(uint64(data[4]), 10) // string Дата и время операции регистрации фискального накопителя
 
-		tax := ""
-		comma := ""
-		for i := int64(0); i < 5; i++ {
-			mask := byte(1)
-			if (data[27] & mask) > 0 {
-				tax = tax + comma + strconv.FormatInt(i, 10)
-				comma = ","
-			}
-			mask = mask << 1
-		}
-		res.TaxationSystems = tax // string Коды системы налогообложения через разделитель ",".
+		res.TaxationSystems = bitCodes(data[27], 6) // string Коды системы налогообложения через разделитель ",".
 		//Коды системы налогообложения 0-Общая,1-Упрощенная (Доход),2-Упрощенная (Доход минус Расход),3-Енвд,4-Единый сельхоз налог,5-Патентная система налогообложения.
 		res.IsOffline = (data[28] & 0b0010) > 0   // bool  Признак автономного режима
 		res.IsEncrypted = (data[28] & 0b0001) > 0 // bool Признак шифрование данных
@@ -376,17 +369,7 @@ func getDataKKT(c *gin.Context) {
 		res.SaleLocation = res.SaleLocation + string(decodeWindows1251(data))
 		tabparam[7] = 16 //поле признак агента
 		errcode, data, err = kkm.SendCommand(0x1F, tabparam[:])
-		agent := ""
-		comma := ""
-		for i := int64(0); i < 7; i++ {
-			mask := byte(1)
-			if (data[0] & mask) > 0 {
-				agent = agent + comma + strconv.FormatInt(i, 10)
-				comma = ","
-			}
-			mask = mask << 1
-		}
-		res.AgentTypes = agent // string Коды признаков агента через разделитель ",".
+		res.AgentTypes = bitCodes(data[0], 7) // string Коды признаков агента через разделитель ",".
 		//0-«БАНК. ПЛ. АГЕНТ»,1-«БАНК. ПЛ. СУБАГЕНТ»,2-ПЛ. АГЕНТ,3-ПЛ. СУБАГЕНТ,4-ПОВЕРЕННЫЙ,5-КОМИССИОНЕР,6-АГЕНТ
 
 		tabparam[7] = 12 //поле инн офд
@@ -563,6 +546,9 @@ func main() {
 	// It will be created if it doesn't exist
 	//port := flag.String("port", "3000", "Номер порта")
 	port := flag.Int("port", 3000, "Номер порта")
+	ofdinterval := flag.Int("ofdinterval", 10, "Интервал опроса обмена с ОФД, минут (0 - не опрашивать)")
+	recovery := flag.String("recovery", "auto", "Незавершенный документ после сбоя: auto - аннулировать/продолжить печать, manual - только журнал")
+	paperwait := flag.Int("paperwait", 300, "Ожидание заправки бумаги при остановке печати, секунд (0 - не ждать)")
 	portstr := ":" + strconv.Itoa(*port)
 	flag.Parse()
 	//portstr := ":" + strconv.Itoa(*port)
@@ -585,6 +571,47 @@ func main() {
 		log.Fatal(err)
 	}
 
+	err = ShiftPol.Load()
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = initCheckRequests()
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = initDocJournal()
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = initReceipts()
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = initLogos()
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = initTemplates()
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = initPaperEvents()
+	if err != nil {
+		log.Fatal(err)
+	}
+	RECOVERYPOLICY = *recovery
+	drv.PaperWait = time.Duration(*paperwait) * time.Second
+	drv.OnPaper = recordPaperEvent
+	go recoverAll()
+	go runConnectRecovery()
+	go runShiftScheduler()
+	go runCheckSessionReaper()
+
+	if *ofdinterval > 0 {
+		OFDCHECKINTERVAL = time.Duration(*ofdinterval) * time.Minute
+		go runOFDMonitor()
+	}
+
 	router := gin.Default()
 	router.Static("/assets", "./assets")
 	router.LoadHTMLGlob("./tpl/*")
@@ -601,6 +628,28 @@ func main() {
 		api.PUT("SetServSetting/", setServSetting)
 		api.POST("run/:DeviceID/:command", runCommand)
 		api.GET("GetParamKKT/:DeviceID", getParamKKT)
+		api.POST("RegisterKKT/:DeviceID", registerKKT)
+		api.POST("ReRegisterKKT/:DeviceID", reRegisterKKT)
+		api.POST("CloseFN/:DeviceID", closeFN)
+		api.GET("FNDocument/:DeviceID", getFNDocument)
+		api.GET("OFDTicket/:DeviceID", getOFDTicket)
+		api.GET("OFDMonitor/", getOFDMonitor)
+		api.GET("OFDStatus/:DeviceID", getOFDStatus)
+		api.POST("ProcessBSO/:DeviceID", processBSO)
+		api.GET("ShiftPolicy/:DeviceID", getShiftPolicy)
+		api.PUT("ShiftPolicy/:DeviceID", setShiftPolicy)
+		api.GET("ShiftEvents/", getShiftEvents)
+		api.GET("RegInfo/:DeviceID", getRegInfo)
+		api.GET("DocJournal/", getDocJournal)
+		api.POST("RecoverDocument/:DeviceID", recoverDocumentHandler)
+		api.GET("PaperEvents/", getPaperEvents)
+		api.GET("Logo/:DeviceID", getLogos)
+		api.POST("Logo/:DeviceID", uploadLogo)
+		api.DELETE("Logo/:DeviceID/:Name", deleteLogo)
+		api.POST("PrintLogo/:DeviceID/:Name", printLogoHandler)
+		api.GET("Template/:DeviceID", getTemplates)
+		api.PUT("Template/:DeviceID/:Name", setTemplate)
+		api.DELETE("Template/:DeviceID/:Name", deleteTemplate)
 
 		//функции для печати
 		api.PUT("SetBusy/:DeviceID", setBusy)
@@ -613,20 +662,26 @@ func main() {
 		api.POST("FNSendTagOperation/:DeviceID", fnSendTagOperation)
 		api.POST("FNSendTag/:DeviceID", fnSendTag)
 		api.POST("CutCheck/:DeviceID", cutCheck)
+		api.GET("CheckSession/:DeviceID", getCheckSession)
 
 		//1c spec
 		api.POST("GetDataKKT/:DeviceID", getDataKKT)
-		//api.POST("OperationFN/:DeviceID", OperationFN) //Операция с фискальным накопителем.
+		api.POST("OperationFN/:DeviceID", operationFN) //Операция с фискальным накопителем.
 		api.POST("OpenShift/:DeviceID", openShift)
 		api.POST("CloseShift/:DeviceID", closeShift)
 		api.POST("ProcessCheck/:DeviceID", processCheck)
+		api.GET("CheckRequest/:DeviceID", getCheckRequest)
+		api.GET("ReturnCheck/:DeviceID", getReturnCheck)
+		api.POST("ReturnCheck/:DeviceID", returnCheck)
+		api.POST("ValidateCheck/:DeviceID", validateCheckHandler)
+		api.POST("Preview/:DeviceID", previewHandler)
 		//api.POST("ProcessCorrectionCheck/:DeviceID", ProcessCorrectionCheck)
 		api.POST("PrintTextDocument/:DeviceID", printTextDocument)
 		api.POST("CashInOutcome/:DeviceID", cashInOutcome)
 		api.POST("PrintXReport/:DeviceID", printXReport)
 		api.POST("PrintCheckCopy/:DeviceID", printCheckCopy)
 		api.POST("GetCurrentStatus/:DeviceID", getCurrentStatus)
-		api.POST("ReportCurrentStatusOfSettlements/:DeviceID", getCurrentStatus)
+		api.POST("ReportCurrentStatusOfSettlements/:DeviceID", reportCurrentStatusOfSettlements)
 		api.POST("OpenCashDrawer/:DeviceID", openCashDrawer)
 		api.POST("GetLineLength/:DeviceID", getLineLength)
 
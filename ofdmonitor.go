@@ -0,0 +1,182 @@
+package main
+
+import (
+	"kkm-shtrih/drv"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+//OFDCHECKINTERVAL интервал опроса статуса обмена с ОФД
+var OFDCHECKINTERVAL = 10 * time.Minute
+
+//OFDWARNDAYS возраст первого непереданного документа для предупреждения, дней
+var OFDWARNDAYS = 20
+
+//OFDCRITDAYS возраст первого непереданного документа для критического сообщения, дней
+var OFDCRITDAYS = 27
+
+//OFDBLOCKDAYS через сколько дней без передачи в ОФД ФН блокирует работу
+var OFDBLOCKDAYS = 30
+
+//Уровень состояния обмена с ОФД
+const (
+	OFDLevelOK       = "ok"
+	OFDLevelWarning  = "warning"
+	OFDLevelCritical = "critical"
+	OFDLevelError    = "error"
+)
+
+//OFDState состояние обмена с ОФД одной ККТ
+type OFDState struct {
+	DeviceID string `json:"deviceID"`
+	//Время последнего опроса
+	Checked time.Time `json:"checked"`
+	//Количество непереданных документов
+	Backlog int `json:"backlog"`
+	//Номер первого непереданного документа
+	FirstNumber uint32 `json:"firstNumber"`
+	//Дата и время первого непереданного документа
+	FirstDateTime time.Time `json:"firstDateTime"`
+	//Последний обмен с ОФД: очередь пуста или уменьшилась
+	LastExchange time.Time `json:"lastExchange"`
+	//Возраст первого непереданного документа, дней
+	AgeDays int `json:"ageDays"`
+	//Дней до блокировки ФН
+	DaysLeft int `json:"daysLeft"`
+	//Транспортное соединение с ОФД установлено
+	Connected bool   `json:"connected"`
+	Level     string `json:"level"`
+	Message   string `json:"message"`
+}
+
+//OFDMonitor фоновый контроль очереди документов для ОФД
+type OFDMonitor struct {
+	mu    sync.Mutex
+	state map[string]OFDState
+}
+
+//OFDMon экземпляр монитора ОФД
+var OFDMon = OFDMonitor{state: make(map[string]OFDState)}
+
+//Get вернет состояние обмена ККТ
+func (m *OFDMonitor) Get(deviceID string) (OFDState, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	st, ok := m.state[deviceID]
+	return st, ok
+}
+
+//GetAll вернет состояние обмена всех ККТ
+func (m *OFDMonitor) GetAll() map[string]OFDState {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ret := make(map[string]OFDState, len(m.state))
+	for k, v := range m.state {
+		ret[k] = v
+	}
+	return ret
+}
+
+//Update обновит состояние обмена по статусу ФН и сообщит о смене уровня
+func (m *OFDMonitor) Update(deviceID string, st drv.OFDStatus, err error) OFDState {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	prev, ok := m.state[deviceID]
+	cur := OFDState{DeviceID: deviceID, Checked: time.Now(), LastExchange: prev.LastExchange}
+	if err != nil {
+		//при ошибке опроса сохраняем последние известные данные об очереди
+		cur = prev
+		cur.DeviceID = deviceID
+		cur.Checked = time.Now()
+		cur.Level = OFDLevelError
+		cur.Message = err.Error()
+		m.state[deviceID] = cur
+		return cur
+	}
+	cur.Backlog = st.Count
+	cur.FirstNumber = st.FirstNumber
+	cur.FirstDateTime = st.FirstDateTime
+	cur.Connected = st.State&0x01 > 0
+	if st.Count == 0 || (ok && (st.Count < prev.Backlog || st.FirstNumber != prev.FirstNumber)) {
+		cur.LastExchange = cur.Checked
+	}
+	cur.Level = OFDLevelOK
+	cur.Message = "очередь ОФД пуста"
+	cur.DaysLeft = OFDBLOCKDAYS
+	if st.Count > 0 {
+		cur.AgeDays = int(cur.Checked.Sub(st.FirstDateTime).Hours() / 24)
+		cur.DaysLeft = OFDBLOCKDAYS - cur.AgeDays
+		cur.Message = "не передано документов: " + strconv.Itoa(st.Count) + ", первый №" + strconv.FormatUint(uint64(st.FirstNumber), 10) +
+			" от " + st.FirstDateTime.Format("2006-01-02 15:04") + ", до блокировки ФН дней: " + strconv.Itoa(cur.DaysLeft)
+		switch {
+		case cur.AgeDays >= OFDCRITDAYS:
+			cur.Level = OFDLevelCritical
+		case cur.AgeDays >= OFDWARNDAYS:
+			cur.Level = OFDLevelWarning
+		}
+	}
+	if cur.Level != prev.Level && (cur.Level == OFDLevelWarning || cur.Level == OFDLevelCritical) {
+		log.Printf("ОФД %s [%s]: %s", deviceID, cur.Level, cur.Message)
+	}
+	m.state[deviceID] = cur
+	return cur
+}
+
+//checkOFD опросит статус обмена с ОФД, если ККТ свободна
+func checkOFD(deviceID string) (OFDState, bool) {
+	kkm, err := KkmServ.GetDrv(deviceID)
+	if err != nil {
+		return OFDState{}, false
+	}
+	if kkm.ChkBusy(0) {
+		return OFDMon.Get(deviceID)
+	}
+	//займем ккм
+	procid := int(time.Now().Unix())
+	kkm.SetBusy(procid)
+	//освободим по завершению
+	defer kkm.SetBusy(0)
+	st, _, err := kkm.FNGetOFDStatus()
+	return OFDMon.Update(deviceID, st, err), true
+}
+
+//runOFDMonitor фоновый опрос всех ККТ
+func runOFDMonitor() {
+	for {
+		for _, id := range KkmServ.GetKeys() {
+			checkOFD(id)
+		}
+		time.Sleep(OFDCHECKINTERVAL)
+	}
+}
+
+//getOFDMonitor состояние обмена с ОФД всех ККТ
+func getOFDMonitor(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"error": false, "devices": OFDMon.GetAll()})
+}
+
+//getOFDStatus состояние обмена с ОФД ККТ, ?refresh=1 - опросить ККТ сейчас
+func getOFDStatus(c *gin.Context) {
+	deviceID := c.Param("DeviceID")
+	if _, err := KkmServ.GetDrv(deviceID); err != nil {
+		c.JSON(http.StatusOK, gin.H{"error": true, "message": "deviceID не зарегистрирован"})
+		return
+	}
+	var st OFDState
+	var ok bool
+	if c.Query("refresh") == "1" {
+		st, ok = checkOFD(deviceID)
+	} else {
+		st, ok = OFDMon.Get(deviceID)
+	}
+	if !ok {
+		c.JSON(http.StatusOK, gin.H{"error": true, "message": "нет данных об обмене с ОФД"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"error": false, "message": st.Message, "state": st})
+}
@@ -1,6 +1,11 @@
 package main
 
 import (
+	"encoding/xml"
+	"kkm-shtrih/drv/tlv"
+	"log"
+	"strconv"
+	"strings"
 	"time"
 
 	"net/http"
@@ -27,11 +32,12 @@ func openCashDrawer(c *gin.Context) {
 	kkm.SetBusy(procid)
 	//освободим по завершению
 	defer kkm.SetBusy(0)
-	admpass := kkm.GetAdminPass()
-	param := make([]byte, 5)
-	copy(param, admpass[:4])
-	param[5] = byte(0)
-	errcode, _, _ := kkm.SendCommand(0x28, param)
+	drawer, err := getIntParam(c, "CashDrawer", 0)
+	if err != nil || drawer < 0 || drawer > 1 {
+		c.XML(http.StatusOK, gin.H{"error": true, "message": "номер денежного ящика должен быть 0 или 1"})
+		return
+	}
+	errcode, _ := kkm.OpenCashDrawer(kkm.GetAdminPass(), byte(drawer))
 	if errcode > 0 {
 		c.XML(http.StatusOK, gin.H{"error": true, "message": kkm.ParseErrState(errcode)})
 	} else {
@@ -90,62 +96,94 @@ func getLineLength(c *gin.Context) {
 	}
 	kkm.SetBusy(procid)
 
-	admpass := kkm.GetAdminPass()
-
-	param := make([]byte, 5)
-	copy(param, admpass[:4])
-	param[5] = byte(1) //номер шрифта
-	errcode, data, _ := kkm.SendCommand(0x26, param)
-	if errcode > 0 {
+	//?font= номер шрифта, по умолчанию 1; параметры шрифтов читаются при подключении, ?refresh=1 - перечитать
+	font, err := getIntParam(c, "font", 1)
+	if err != nil || font < 1 || font > 255 {
+		font = 1
+	}
+	fonts := kkm.GetFonts()
+	if len(fonts) == 0 || c.Query("refresh") == "1" {
+		if _, err := kkm.LoadFonts(); err != nil {
+			if json == "xml" {
+				c.XML(http.StatusOK, gin.H{"error": true, "message": err.Error()})
+			} else {
+				c.JSON(http.StatusOK, gin.H{"error": true, "message": err.Error()})
+			}
+			return
+		}
+		fonts = kkm.GetFonts()
+	}
+	if _, ok := fonts[byte(font)]; !ok {
 		if json == "xml" {
-			c.XML(http.StatusOK, gin.H{"error": true, "message": kkm.ParseErrState(errcode)})
+			c.XML(http.StatusOK, gin.H{"error": true, "message": "шрифт " + strconv.Itoa(font) + " не найден"})
 		} else {
-			c.JSON(http.StatusOK, gin.H{"error": true, "message": kkm.ParseErrState(errcode)})
+			c.JSON(http.StatusOK, gin.H{"error": true, "message": "шрифт " + strconv.Itoa(font) + " не найден"})
 		}
 		return
 	}
-
-	wlinepoint := btoi(data[:2])
-	wfont := btoi(data[2:3])
-	linew := int(wlinepoint / wfont)
+	linew := int(kkm.LineLength(byte(font)))
 	if json == "xml" {
 		c.XML(http.StatusOK, gin.H{"error": false, "message": "ok", "LineLength": linew})
 	} else {
-		c.JSON(http.StatusOK, gin.H{"error": false, "message": "ok", "LineLength": linew})
+		//длина строки всех шрифтов
+		lengths := make(map[string]int, len(fonts))
+		for f := range fonts {
+			lengths[strconv.Itoa(int(f))] = int(kkm.LineLength(f))
+		}
+		c.JSON(http.StatusOK, gin.H{"error": false, "message": "ok", "LineLength": linew, "Fonts": lengths})
 	}
 
 }
 
 //cashInOutcome печать чека внесения/выемки
 func cashInOutcome(c *gin.Context) {
+	/*
+		POST CashInOutcome/<DeviceID>?Amount=100.00[&format=json]
+		Amount > 0 - внесение, Amount < 0 - выплата (выемка)
+		<?xml version="1.0" encoding="UTF-8"?>
+		<InputParameters>
+			<Parameters CashierName="Иванов И.П." CashDrawer="0"/>
+		</InputParameters>
+		Тело необязательно. Amount можно передать атрибутом Parameters, CashDrawer - номер денежного ящика,
+		который надо открыть после операции (не указан - ящик не открывается).
+		Внесение/выплата не фискальный документ ФН: CashierINN (тег 1203) передать некуда и он не принимается,
+		CashierName печатается из таблицы 2 и после операции имя оператора восстанавливается.
+		Ответ: ShiftNumber - номер смены, DocumentNumber - сквозной номер документа,
+		CashBalance - наличность в кассе после операции, DateTime - дата и время ККТ.
+		Наличность ведется ККТ одним регистром 241 на все денежные ящики: CashDrawer только открывает ящик,
+		CashBalance - общая наличность в кассе, а не в указанном ящике.
+	*/
+	type Parameters struct {
+		CashierName string `xml:"CashierName,attr" json:"CashierName" binding:"-"` //ФИО и должность уполномоченного лица для проведения операции
+		Amount      string `xml:"Amount,attr" json:"Amount" binding:"-"`           //Сумма внесения/выплаты
+		CashDrawer  string `xml:"CashDrawer,attr" json:"CashDrawer" binding:"-"`   //Номер денежного ящика
+	}
+	type InputParameters struct {
+		XMLName    xml.Name `xml:"InputParameters"`
+		Parameters `xml:"Parameters" json:"Parameters"`
+	}
+	var inp = InputParameters{}
 	deviceID := c.Param("DeviceID")
 
-	kkm, err := KkmServ.GetDrv(deviceID)
-	if err != nil {
-		c.XML(http.StatusOK, gin.H{"error": true, "message": "deviceID не зарегистрирован"})
-		return
-	}
 	json, ok := c.GetQuery("format")
 	if !ok {
 		json = "xml"
 	}
-	procid, err := getIntParam(c, "procid", 0)
-	/*
-		if err != nil {
-			if json == "json" {
-				c.JSON(http.StatusOK, gin.H{"error": true, "message": err.Error()})
-			} else {
-				c.XML(http.StatusOK, gin.H{"error": true, "message": err.Error()})
-			}
-			return
-		}
-	*/
-	if kkm.ChkBusy(procid) {
+	reply := func(code int, h gin.H) {
 		if json == "json" {
-			c.JSON(http.StatusOK, gin.H{"error": true, "message": "ККТ занята"})
+			c.JSON(code, h)
 		} else {
-			c.XML(http.StatusOK, gin.H{"error": true, "message": "ККТ занята"})
+			c.XML(code, h)
 		}
+	}
+	kkm, err := KkmServ.GetDrv(deviceID)
+	if err != nil {
+		reply(http.StatusOK, gin.H{"error": true, "message": "deviceID не зарегистрирован"})
+		return
+	}
+	procid, _ := getIntParam(c, "procid", 0)
+	if kkm.ChkBusy(procid) {
+		reply(http.StatusOK, gin.H{"error": true, "message": "ККТ занята"})
 		return
 	}
 
@@ -157,66 +195,77 @@ func cashInOutcome(c *gin.Context) {
 	}
 	kkm.SetBusy(procid)
 
-	admpass := kkm.GetAdminPass()
-	/*
-	   <?xml version="1.0" encoding="UTF-8"?>
-	    <InputParameters>
-	   	<Parameters CashierName="Иванов И.П." CashierINN="32456234523452"/>
-	    </InputParameters>
-	   Внесение
-	   Команда: 50H. Длина сообщения: 10 байт.
-	   Пароль оператора (4 байта)
-	   Сумма (5 байт)
-	   Ответ: 50H. Длина сообщения: 5 байт.
-	   Код ошибки (1 байт)
-	   Порядковый номер оператора (1 байт) 1…30
-	   Сквозной номер документа (2 байта)
-	   Выплата
-	   Команда: 51H. Длина сообщения: 10 байт.
-	   Пароль оператора (4 байта)
-	   Сумма (5 байт)
-	   Ответ: 51H. Длина сообщения: 5 байт.
-	   Код ошибки (1 байт)
-	   Порядковый номер оператора (1 байт) 1…30
-	   Сквозной номер документа (2 байта)
-	*/
-	amount, err := getFloatParam(c, "Amount", 0.0)
-	if err != nil {
-		if json == "json" {
-			c.JSON(http.StatusOK, gin.H{"error": true, "message": "Сумма внесения/выемки не должна быть нулевой"})
+	if c.Request.ContentLength > 0 {
+		if strings.Contains(c.ContentType(), "json") {
+			err = c.ShouldBindJSON(&inp)
 		} else {
-			c.XML(http.StatusOK, gin.H{"error": true, "message": "умма внесения/выемки не должна быть нулевой"})
+			err = c.ShouldBindXML(&inp)
+		}
+		if err != nil {
+			reply(http.StatusBadRequest, gin.H{"error": true, "message": "bad request " + err.Error()})
+			return
 		}
+	}
+	amount, err := getFloatParam(c, "Amount", 0.0)
+	if err == nil && amount == 0 && len(inp.Amount) > 0 {
+		amount, err = strconv.ParseFloat(strings.Replace(inp.Amount, ",", ".", 1), 64)
+	}
+	if err != nil || amount == 0 {
+		reply(http.StatusOK, gin.H{"error": true, "message": "Сумма внесения/выемки не должна быть нулевой"})
 		return
 	}
-	param := make([]byte, 10)
-	cmd := uint16(0x50)
-	if amount < 0 {
-		cmd = 0x51
-		amount = -amount
+	drawer := -1
+	if len(inp.CashDrawer) > 0 {
+		if drawer, err = strconv.Atoi(inp.CashDrawer); err != nil || drawer < 0 || drawer > 1 {
+			reply(http.StatusOK, gin.H{"error": true, "message": "номер денежного ящика должен быть 0 или 1"})
+			return
+		}
 	}
-	copy(param, admpass[:4])
-	copy(param[4:], money2byte(amount, DIGITS))
-	errcode, data, err := kkm.SendCommand(cmd, param)
-	if errcode > 0 {
-		if json == "xml" {
-			c.XML(http.StatusOK, gin.H{"error": true, "message": kkm.ParseErrState(errcode)})
-		} else {
-			c.JSON(http.StatusOK, gin.H{"error": true, "message": kkm.ParseErrState(errcode)})
+
+	admpass := kkm.GetAdminPass()
+	if len(inp.CashierName) > 0 {
+		//внесение/выплата не фискальный документ ФН, теги 1021/1203 в ФН не передаются:
+		//кассир печатается из таблицы 2 (оператор 30 - администратор), прежнее имя вернем после операции
+		prev, _, err := kkm.OperatorName(admpass, 30)
+		if err != nil {
+			reply(http.StatusOK, gin.H{"error": true, "message": "не удалось прочитать кассира: " + err.Error()})
+			return
 		}
+		if _, err = kkm.SetOperatorName(admpass, 30, inp.CashierName); err != nil {
+			reply(http.StatusOK, gin.H{"error": true, "message": "не удалось записать кассира: " + err.Error()})
+			return
+		}
+		defer func() {
+			if _, err := kkm.SetOperatorName(admpass, 30, prev); err != nil {
+				log.Printf("cashInOutcome %s: не удалось восстановить кассира: %v", deviceID, err)
+			}
+		}()
+	}
+	res, errcode, err := kkm.CashInOutcome(admpass, amount)
+	if err != nil || errcode > 0 {
+		msg := kkm.ParseErrState(errcode)
+		if err != nil {
+			msg = err.Error()
+		}
+		reply(http.StatusOK, gin.H{"error": true, "message": msg})
 		return
 	}
-	//data[0] - oper pass
-
-	if json == "xml" {
-		c.XML(http.StatusOK, gin.H{"error": false, "message": "ok", "docnum": btoi(data[1:])})
-	} else {
-		c.JSON(http.StatusOK, gin.H{"error": false, "message": "ok", "docnum": btoi(data[1:])})
+	if drawer >= 0 {
+		kkm.OpenCashDrawer(admpass, byte(drawer))
 	}
+	reply(http.StatusOK, gin.H{"error": false, "message": "ok", "docnum": res.DocumentNumber,
+		"ShiftNumber": res.ShiftNumber, "DocumentNumber": res.DocumentNumber, "CashBalance": res.CashBalance,
+		"DateTime": res.DateTime.Format("2006-01-02 15:04:05")})
 }
 
-//printCheckCopy Запрос квитанции о получении данных в ОФД по номеру
+//printCheckCopy печать копии фискального документа по номеру
 func printCheckCopy(c *gin.Context) {
+	/*
+		POST PrintCheckCopy/<DeviceID>?CheckNumber=12
+		CheckNumber - номер ФД, 0 - последний документ.
+		Последний чек повторяется командой ККТ "Повтор документа", остальные документы
+		печатаются нефискальной копией по реквизитам из архива ФН.
+	*/
 	deviceID := c.Param("DeviceID")
 
 	kkm, err := KkmServ.GetDrv(deviceID)
@@ -229,21 +278,16 @@ func printCheckCopy(c *gin.Context) {
 	if !ok {
 		json = "xml"
 	}
-	procid, err := getIntParam(c, "procid", 0)
-	/*if err != nil {
+	reply := func(code int, obj interface{}) {
 		if json == "json" {
-			c.JSON(http.StatusOK, gin.H{"error": true, "message": err.Error()})
+			c.JSON(code, obj)
 		} else {
-			c.XML(http.StatusOK, gin.H{"error": true, "message": err.Error()})
+			c.XML(code, obj)
 		}
-		return
-	}*/
+	}
+	procid, _ := getIntParam(c, "procid", 0)
 	if kkm.ChkBusy(procid) {
-		if json == "json" {
-			c.JSON(http.StatusOK, gin.H{"error": true, "message": "ККТ занята"})
-		} else {
-			c.XML(http.StatusOK, gin.H{"error": true, "message": "ККТ занята"})
-		}
+		reply(http.StatusOK, gin.H{"error": true, "message": "ККТ занята"})
 		return
 	}
 
@@ -258,39 +302,66 @@ func printCheckCopy(c *gin.Context) {
 	admpass := kkm.GetAdminPass()
 
 	checkNumber, err := getIntParam(c, "CheckNumber", 0)
+	if err != nil || checkNumber < 0 {
+		reply(http.StatusOK, gin.H{"error": true, "message": "неверный номер документа"})
+		return
+	}
+	errcode, err := kkm.FNGetStatus()
 	if err != nil {
-		if json == "json" {
-			c.JSON(http.StatusOK, gin.H{"error": true, "message": err.Error()})
-		} else {
-			c.XML(http.StatusOK, gin.H{"error": true, "message": err.Error()})
-		}
+		reply(http.StatusOK, gin.H{"error": true, "message": err.Error()})
 		return
 	}
-	param := make([]byte, 8)
-
-	copy(param, admpass[:4])
-	copy(param[4:], itob(int64(checkNumber)))
-	/* Код команды FF3Сh . Длина сообщения: 11 байт.
-	Пароль системного администратора: 4 байта [0:4]
-	Номер фискального документа: 4 байта	[4:8]
-	Ответ: FF3Сh Длина сообщения: 1+N байт.
-	Код ошибки: 1 байт
-	Квитанция: N байт
-	*/
-	errcode, data, err := kkm.SendCommand(0xff3c, param)
 	if errcode > 0 {
-		if json == "xml" {
-			c.XML(http.StatusOK, gin.H{"error": true, "message": kkm.ParseErrState(errcode)})
-		} else {
-			c.JSON(http.StatusOK, gin.H{"error": true, "message": kkm.ParseErrState(errcode)})
-		}
+		reply(http.StatusOK, gin.H{"error": true, "message": kkm.ParseErrState(errcode)})
 		return
 	}
-	//data[0] - oper pass
-
-	if json == "xml" {
-		c.XML(http.StatusOK, gin.H{"error": false, "message": "ok", "docval": data[:]})
-	} else {
-		c.JSON(http.StatusOK, gin.H{"error": false, "message": "ok", "docval": data[:]})
+	fnstate := kkm.FNGetFNState()
+	if fnstate.FNCurrentDocument != 0 {
+		reply(http.StatusOK, gin.H{"error": true, "message": "открыт документ, печать копии невозможна"})
+		return
+	}
+	last := int(fnstate.DocumentNumber)
+	if checkNumber == 0 {
+		checkNumber = last
+	}
+	doctype, data, errcode, err := kkm.FNReadDocument(admpass, uint32(checkNumber))
+	if err != nil {
+		reply(http.StatusOK, gin.H{"error": true, "message": err.Error()})
+		return
+	}
+	if errcode > 0 {
+		reply(http.StatusOK, gin.H{"error": true, "message": kkm.ParseErrState(errcode)})
+		return
+	}
+	//последний чек ККТ умеет повторить сама
+	if checkNumber == last && (doctype == 3 || doctype == 4) {
+		errcode, err = kkm.RepeatDocument(admpass)
+		if err == nil && errcode == 0 {
+			reply(http.StatusOK, gin.H{"error": false, "message": "ok", "mode": "repeat"})
+			return
+		}
+	}
+	doc := FNDocument{
+		Number:   uint32(checkNumber),
+		Type:     doctype,
+		TypeName: tlv.DocumentTypeName(doctype),
+		Tags:     tlv.DecodeAll(data, kkm.TLVCodePage()),
+	}
+	width := int(kkm.GetLenLine())
+	if width == 0 {
+		width = int(LENLINE)
+	}
+	for _, s := range documentCopyLines(doc, width) {
+		errcode, err = kkm.PrintString(admpass, s)
+		if err != nil {
+			reply(http.StatusOK, gin.H{"error": true, "message": err.Error()})
+			return
+		}
+		if errcode > 0 {
+			reply(http.StatusOK, gin.H{"error": true, "message": kkm.ParseErrState(errcode)})
+			return
+		}
 	}
+	kkm.CutCheck(admpass, 0)
+	reply(http.StatusOK, gin.H{"error": false, "message": "ok", "mode": "copy"})
 }
@@ -135,6 +135,21 @@ func openShift(c *gin.Context) {
 		return
 	}
 
+	//тег 1203 ИНН Кассира
+	//Тег 1021 — кассир. В печатных документах — «КАССИР». Сюда должны вноситься «должность и фамилия лица, осуществившего расчет с покупателем
+	//реквизиты проверяются до начала отчета: ошибка после него оставит отчет смены незавершенным
+	tags := cashierTags(inp.CashierName, inp.CashierINN)
+	if len(inp.SaleAddress) > 0 {
+		tags = append(tags, tagValue{1009, inp.SaleAddress})
+	}
+	if len(inp.SaleLocation) > 0 {
+		tags = append(tags, tagValue{1187, inp.SaleLocation})
+	}
+	if err = checkTagValues(kkm, tags); err != nil {
+		c.XML(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
 	/*Начать открытие смены
 	Код команды FF41h . Длина сообщения: 6 байт.
 	Пароль системного администратора: 4 байта
@@ -166,19 +181,10 @@ func openShift(c *gin.Context) {
 		kkm.SetState(2, state.SubState, state.Flag, state.FlagFP)
 	} else {
 		//отправим tlv с параметрами и откроем смену ФН
-		//тег 1203 ИНН Кассира
-		//Тег 1021 — кассир. В печатных документах — «КАССИР». Сюда должны вноситься «должность и фамилия лица, осуществившего расчет с покупателем
-		if len(inp.CashierINN) > 0 {
-			kkm.FNSendTLV(admpass, 1203, []byte(inp.CashierINN))
-		}
-		if len(inp.CashierName) > 0 {
-			kkm.FNSendTLV(admpass, 021, []byte(encodeWindows1251(inp.CashierName)))
-		}
-		if len(inp.SaleAddress) > 0 {
-			kkm.FNSendTLV(admpass, 1009, []byte(encodeWindows1251(inp.SaleAddress)))
-		}
-		if len(inp.SaleLocation) > 0 {
-			kkm.FNSendTLV(admpass, 1187, []byte(encodeWindows1251(inp.SaleLocation)))
+		if err = sendTagValues(kkm, admpass, tags); err != nil {
+			log.Printf("kkmOpenShift: %v", err)
+			c.XML(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
 		}
 		//теперь откроем
 		errcode, data, err := kkm.SendCommand(0xff0b, admpass)
@@ -0,0 +1,492 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"kkm-shtrih/drv"
+	"kkm-shtrih/drv/tlv"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+//Тип операции с ФН (1c OperationFN)
+const (
+	//OperationFNRegistration регистрация ККТ
+	OperationFNRegistration = 1
+	//OperationFNReRegistration изменение параметров регистрации
+	OperationFNReRegistration = 2
+	//OperationFNClose закрытие фискального режима ФН
+	OperationFNClose = 3
+)
+
+//ParametersFiscal параметры регистрации 1c OperationFN
+type ParametersFiscal struct {
+	XMLName xml.Name `xml:"ParametersFiscal" json:"-"`
+	//Тип операции 1 - регистрация, 2 - изменение параметров регистрации, 3 - закрытие ФН
+	OperationType int `xml:"OperationType,attr" json:"OperationType" binding:"-"`
+	//ФИО и должность уполномоченного лица для проведения операции
+	CashierName string `xml:"CashierName,attr" json:"CashierName" binding:"-"`
+	//ИНН уполномоченного лица для проведения операции
+	CashierINN string `xml:"CashierINN,attr" json:"CashierINN" binding:"-"`
+	//Регистрационный номер ККТ
+	KKTNumber string `xml:"KKTNumber,attr" json:"KKTNumber" binding:"-"`
+	//Название организации
+	OrganizationName string `xml:"OrganizationName,attr" json:"OrganizationName" binding:"-"`
+	//ИНН организации
+	INN string `xml:"INN,attr" json:"INN" binding:"-"`
+	//Адрес проведения расчетов
+	SaleAddress string `xml:"SaleAddress,attr" json:"SaleAddress" binding:"-"`
+	//Место проведения расчетов
+	SaleLocation string `xml:"SaleLocation,attr" json:"SaleLocation" binding:"-"`
+	//Коды системы налогообложения через разделитель ","
+	TaxationSystems string `xml:"TaxationSystems,attr" json:"TaxationSystems" binding:"-"`
+	IsOffline       bool   `xml:"IsOffline,attr" json:"IsOffline" binding:"-"`     //Признак автономного режима
+	IsEncrypted     bool   `xml:"IsEncrypted,attr" json:"IsEncrypted" binding:"-"` //Признак шифрование данных
+	IsService       bool   `xml:"IsService,attr" json:"IsService" binding:"-"`     //Признак расчетов за услуги
+	IsExcisable     bool   `xml:"IsExcisable,attr" json:"IsExcisable" binding:"-"` //Продажа подакцизного товара
+	IsGambling      bool   `xml:"IsGambling,attr" json:"IsGambling" binding:"-"`   //Признак проведения азартных игр
+	IsLottery       bool   `xml:"IsLottery,attr" json:"IsLottery" binding:"-"`     //Признак проведения лотереи
+	//Коды признаков агента через разделитель ","
+	AgentTypes          string `xml:"AgentTypes,attr" json:"AgentTypes" binding:"-"`
+	BSOSing             bool   `xml:"BSOSing,attr" json:"BSOSing" binding:"-"`                         //Признак формирования АС БСО
+	IsOnlineOnly        bool   `xml:"IsOnlineOnly,attr" json:"IsOnlineOnly" binding:"-"`               //Признак ККТ для расчетов только в Интернет
+	IsAutomaticPrinter  bool   `xml:"IsAutomaticPrinter,attr" json:"IsAutomaticPrinter" binding:"-"`   //Признак установки принтера в автомате
+	IsAutomatic         bool   `xml:"IsAutomatic,attr" json:"IsAutomatic" binding:"-"`                 //Признак автоматического режима
+	AutomaticNumber     string `xml:"AutomaticNumber,attr" json:"AutomaticNumber" binding:"-"`         //Номер автомата для автоматического режима
+	OFDOrganizationName string `xml:"OFDOrganizationName,attr" json:"OFDOrganizationName" binding:"-"` //Название организации ОФД
+	OFDOrganizationINN  string `xml:"OFDOrganizationINN,attr" json:"OFDOrganizationINN" binding:"-"`   //ИНН организации ОФД
+	FNSWebSite          string `xml:"FNSWebSite,attr" json:"FNSWebSite" binding:"-"`                   //Адрес сайта уполномоченного органа (ФНС)
+	SenderEmail         string `xml:"SenderEmail,attr" json:"SenderEmail" binding:"-"`                 //Адрес электронной почты отправителя чека
+	//Код причины перерегистрации ФФД 1.05 (тег 1101)
+	//1 - Замена ФН, 2 - Замена ОФД, 3 - Изменение реквизитов, 4 - Изменение настроек ККТ
+	ReasonCode int `xml:"ReasonCode,attr" json:"ReasonCode" binding:"-"`
+	//Коды причин изменения сведений о ККТ ФФД 1.1 (тег 1205) через разделитель ",", номера бит 0..31
+	//0 - замена ФН, 1 - замена ОФД, 2 - изменение наименования пользователя, 3 - изменение адреса и (или) места расчетов ...
+	ReasonCodes string `xml:"ReasonCodes,attr" json:"ReasonCodes" binding:"-"`
+}
+
+//operationFN Операция с фискальным накопителем (1c spec): регистрация, перерегистрация, закрытие ФН
+func operationFN(c *gin.Context) {
+	/*
+		<?xml version="1.0" encoding="UTF-8"?>
+		<ParametersFiscal OperationType="1" CashierName="Иванов И.П." CashierINN="32456234523452" KKTNumber="0000000001012345"
+			OrganizationName="ООО Ромашка" INN="7701234567" SaleAddress="г.Москва" SaleLocation="Магазин" TaxationSystems="0,1"
+			OFDOrganizationName="ООО Такском" OFDOrganizationINN="7704211201" FNSWebSite="www.nalog.ru" SenderEmail="info@shop.ru"/>
+		тип операции может быть передан параметром ?OperationType=1
+	*/
+	optype, _ := getIntParam(c, "OperationType", 0)
+	runOperationFN(c, optype)
+}
+
+//registerKKT регистрация ККТ (json)
+func registerKKT(c *gin.Context) {
+	runOperationFN(c, OperationFNRegistration)
+}
+
+//reRegisterKKT перерегистрация ККТ (json)
+func reRegisterKKT(c *gin.Context) {
+	runOperationFN(c, OperationFNReRegistration)
+}
+
+//closeFN закрытие фискального режима ФН (json)
+func closeFN(c *gin.Context) {
+	runOperationFN(c, OperationFNClose)
+}
+
+func runOperationFN(c *gin.Context, optype int) {
+	type OutParameters struct {
+		OperationType  int    `xml:"OperationType,attr" json:"OperationType"`
+		DocumentNumber int    `xml:"DocumentNumber,attr" json:"DocumentNumber"` //Номер фискального документа
+		FiscalSign     string `xml:"FiscalSign,attr" json:"FiscalSign"`         //Фискальный признак
+		DateTime       string `xml:"DateTime,attr" json:"DateTime"`             //Дата и время формирования документа
+	}
+	type OutputParameters struct {
+		XMLName       xml.Name `xml:"OutputParameters" json:"-"`
+		OutParameters `xml:"Parameters"`
+	}
+	var inp = ParametersFiscal{}
+	var out = OutputParameters{}
+	isjson := c.ContentType() == "application/json" || c.Query("format") == "json"
+	reply := func(code int, obj interface{}) {
+		if isjson {
+			c.JSON(code, obj)
+		} else {
+			c.XML(code, obj)
+		}
+	}
+
+	deviceID := c.Param("DeviceID")
+	kkm, err := KkmServ.GetDrv(deviceID)
+	if err != nil {
+		reply(http.StatusOK, gin.H{"error": true, "message": "deviceID не зарегистрирован"})
+		return
+	}
+	if kkm.ChkBusy(0) {
+		reply(http.StatusOK, gin.H{"error": true, "message": "ККТ занята"})
+		return
+	}
+	//займем ккм
+	procid := int(time.Now().Unix())
+	kkm.SetBusy(procid)
+	//освободим по завершению
+	defer kkm.SetBusy(0)
+
+	if c.ContentType() == "application/json" {
+		err = c.ShouldBindJSON(&inp)
+	} else {
+		err = c.ShouldBindXML(&inp)
+	}
+	if err != nil {
+		reply(http.StatusBadRequest, gin.H{"error": true, "message": "bad request " + err.Error()})
+		return
+	}
+	if optype == 0 {
+		optype = inp.OperationType
+	}
+	inp.OperationType = optype
+
+	errcode, err := kkm.FNGetStatus()
+	if err != nil {
+		reply(http.StatusOK, gin.H{"error": true, "message": err.Error()})
+		return
+	}
+	if errcode > 0 {
+		reply(http.StatusOK, gin.H{"error": true, "message": kkm.ParseErrState(errcode)})
+		return
+	}
+	ffd11 := false
+	if optype == OperationFNReRegistration {
+		//формат кода причины зависит от версии ФФД
+		ffd11, _, _ = kkm.FNGetFFDVersion()
+	}
+	if err = validateOperationFN(&inp, kkm.FNGetFNState(), ffd11); err != nil {
+		reply(http.StatusOK, gin.H{"error": true, "message": err.Error()})
+		return
+	}
+
+	admpass := kkm.GetAdminPass()
+	var res drv.FNResult
+	switch optype {
+	case OperationFNRegistration, OperationFNReRegistration:
+		res, errcode, err = fnRegistration(kkm, admpass, &inp, ffd11)
+	case OperationFNClose:
+		//реквизиты отчета передаются между началом и закрытием фискального режима
+		_, err = kkm.FNBeginCloseFiscalMode(admpass)
+		err = stepError("начало закрытия фискального режима", err)
+		if err == nil {
+			err = sendCashierTags(kkm, admpass, inp.CashierName, inp.CashierINN)
+		}
+		if err == nil {
+			res, errcode, err = kkm.FNCloseFiscalMode(admpass)
+		}
+	}
+	if err != nil {
+		log.Printf("operationFN: %v", err)
+		reply(http.StatusOK, gin.H{"error": true, "message": err.Error()})
+		return
+	}
+	if errcode > 0 {
+		reply(http.StatusOK, gin.H{"error": true, "message": kkm.ParseErrState(errcode)})
+		return
+	}
+	RegInfo.Delete(deviceID)
+	if optype != OperationFNClose {
+		kkm.SetParam(inp.OrganizationName, inp.INN, "-", inp.KKTNumber)
+	}
+	out.OperationType = optype
+	out.DocumentNumber = int(res.DocumentNumber)
+	out.FiscalSign = strconv.FormatUint(uint64(res.FiscalSign), 10)
+	//ответ FF06h/FF34h/FF3Eh без даты, время документа берем из архива ФН
+	out.DateTime = documentDateTime(kkm, admpass, res.DocumentNumber)
+	if isjson {
+		c.JSON(http.StatusOK, gin.H{"error": false, "message": "ok", "OperationType": out.OperationType, "DocumentNumber": out.DocumentNumber, "FiscalSign": out.FiscalSign, "DateTime": out.DateTime})
+		return
+	}
+	c.XML(http.StatusOK, out)
+}
+
+//validateOperationFN проверка параметров операции и состояния ФН
+func validateOperationFN(inp *ParametersFiscal, fnstate drv.KkmFNState, ffd11 bool) error {
+	errs := make([]string, 0, 8)
+	/*Состояние фазы жизни ФН
+	0x00 Производственная стадия
+	0x01 Готовность к фискализации
+	0x03 Фискальный режим
+	0x07 Фискальный режим закрыт. Передача фискальных документов в ОФД
+	0x0F Чтение данных из Архива ФН*/
+	life := fnstate.FNLifeState & 0x0f
+	if fnstate.FNSessionState != 0 {
+		errs = append(errs, "смена открыта, необходимо закрыть смену")
+	}
+	if fnstate.FNCurrentDocument != 0 {
+		errs = append(errs, "в ФН открыт документ")
+	}
+	//длина строковых реквизитов по словарю тегов, проверяется до записи в ФН
+	for _, t := range append(cashierTags(inp.CashierName, inp.CashierINN), registrationTags(inp)...) {
+		if _, err := tlv.Encode(t.tag, t.val); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	switch inp.OperationType {
+	case OperationFNRegistration:
+		if life != 0x01 {
+			errs = append(errs, "ФН не в состоянии готовности к фискализации (фаза "+strconv.Itoa(int(life))+")")
+		}
+	case OperationFNReRegistration:
+		reason, err := fnReasonCode(inp, ffd11)
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+		//при замене ФН перерегистрация выполняется на новом, не фискализированном ФН
+		fnchange := (ffd11 && reason&0x01 > 0) || (!ffd11 && reason == 1)
+		if fnchange {
+			if life != 0x01 {
+				errs = append(errs, "для замены ФН новый ФН должен быть в состоянии готовности к фискализации")
+			}
+		} else if life != 0x03 {
+			errs = append(errs, "ФН не в фискальном режиме")
+		}
+	case OperationFNClose:
+		if life != 0x03 {
+			errs = append(errs, "ФН не в фискальном режиме")
+		}
+		if len(errs) > 0 {
+			return errors.New(strings.Join(errs, "; "))
+		}
+		return nil
+	default:
+		return errors.New("неизвестный тип операции с ФН: " + strconv.Itoa(inp.OperationType))
+	}
+	if !isDigits(inp.INN) || (len(inp.INN) != 10 && len(inp.INN) != 12) {
+		errs = append(errs, "ИНН организации должен содержать 10 или 12 цифр")
+	}
+	if !isDigits(inp.KKTNumber) || len(inp.KKTNumber) == 0 || len(inp.KKTNumber) > 20 {
+		errs = append(errs, "регистрационный номер ККТ должен содержать до 20 цифр")
+	}
+	if len(inp.CashierINN) > 0 && (!isDigits(inp.CashierINN) || len(inp.CashierINN) != 12) {
+		errs = append(errs, "ИНН кассира должен содержать 12 цифр")
+	}
+	if _, err := parseCodeList(inp.TaxationSystems, 5); err != nil || len(inp.TaxationSystems) == 0 {
+		errs = append(errs, "коды систем налогообложения должны быть в диапазоне 0..5")
+	}
+	if _, err := parseCodeList(inp.AgentTypes, 6); err != nil {
+		errs = append(errs, "коды признаков агента должны быть в диапазоне 0..6")
+	}
+	if !inp.IsOffline {
+		if !isDigits(inp.OFDOrganizationINN) || (len(inp.OFDOrganizationINN) != 10 && len(inp.OFDOrganizationINN) != 12) {
+			errs = append(errs, "не указан ИНН ОФД (обязателен для режима передачи данных)")
+		}
+	}
+	if inp.IsAutomatic && len(inp.AutomaticNumber) == 0 {
+		errs = append(errs, "не указан номер автомата для автоматического режима")
+	}
+	if len(encodeWindows1251(inp.AutomaticNumber)) > 20 {
+		errs = append(errs, "номер автомата должен быть не длиннее 20 символов")
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+//fnRegistration регистрация и перерегистрация ККТ
+func fnRegistration(kkm *drv.KkmDrv, admpass []byte, inp *ParametersFiscal, ffd11 bool) (drv.FNResult, byte, error) {
+	taxcodes, _ := parseCodeList(inp.TaxationSystems, 5)
+	agents, _ := parseCodeList(inp.AgentTypes, 6)
+	p := drv.FNRegParam{Inn: inp.INN, RNM: inp.KKTNumber, TaxCode: byte(taxcodes)}
+	//Бит 0 – Шифрование, Бит 1 – Автономный режим, Бит 2 – Автоматический режим, Бит 3 – Применение в сфере услуг, Бит 4 – Режим БСО, Бит 5 – Применение в Интернет
+	p.WorkMode = boolBit(inp.IsEncrypted, 0) | boolBit(inp.IsOffline, 1) | boolBit(inp.IsAutomatic, 2) | boolBit(inp.IsService, 3) | boolBit(inp.BSOSing, 4) | boolBit(inp.IsOnlineOnly, 5)
+
+	//реквизиты, которые ККТ берет из таблицы 18 "Fiscal storage"
+	//поле 2 ИНН, поле 3 РНМ, поле 5 налогообложение, поле 6 режим работы, поле 16 признак агента,
+	//поле 21 расширенные признаки (Бит 0 – подакцизные товары, Бит 1 – азартные игры, Бит 2 – лотереи, Бит 3 – принтер в автомате)
+	//любая ошибка до FF06h/FF34h прерывает операцию: отчет с неполными реквизитами в ФН не исправить
+	_, err := kkm.WriteTable(admpass, 18, 1, 16, []byte{byte(agents)})
+	if err = stepError("таблица 18 поле 16", err); err != nil {
+		return drv.FNResult{}, 0, err
+	}
+	_, err = kkm.WriteTable(admpass, 18, 1, 21, []byte{boolBit(inp.IsExcisable, 0) | boolBit(inp.IsGambling, 1) | boolBit(inp.IsLottery, 2) | boolBit(inp.IsAutomaticPrinter, 3)})
+	if err = stepError("таблица 18 поле 21", err); err != nil {
+		return drv.FNResult{}, 0, err
+	}
+	if inp.IsAutomatic {
+		//Таблица 24 Встраиваемая интернет техника, поле 1 Заводской номер автомата
+		_, err = kkm.WriteTable(admpass, 24, 1, 1, encodeWindows1251(inp.AutomaticNumber))
+		if err = stepError("таблица 24 поле 1", err); err != nil {
+			return drv.FNResult{}, 0, err
+		}
+	}
+
+	_, err = kkm.FNBeginRegistration(admpass)
+	if err = stepError("начало отчета о регистрации", err); err != nil {
+		return drv.FNResult{}, 0, err
+	}
+	if err = sendCashierTags(kkm, admpass, inp.CashierName, inp.CashierINN); err != nil {
+		return drv.FNResult{}, 0, err
+	}
+	for _, t := range registrationTags(inp) {
+		_, err = kkm.FNSendTag(admpass, t.tag, t.val)
+		if err = stepError("тег "+strconv.Itoa(int(t.tag)), err); err != nil {
+			return drv.FNResult{}, 0, err
+		}
+	}
+	if inp.OperationType == OperationFNRegistration {
+		return kkm.FNRegistration(admpass, p)
+	}
+	reason, err := fnReasonCode(inp, ffd11)
+	if err != nil {
+		return drv.FNResult{}, 1, err
+	}
+	return kkm.FNReRegistration(admpass, reason, ffd11)
+}
+
+//registrationTags реквизиты отчета о регистрации, передаваемые тегами (пустые не передаются)
+func registrationTags(inp *ParametersFiscal) []tagValue {
+	tags := make([]tagValue, 0, 7)
+	for _, t := range []tagValue{{1048, inp.OrganizationName}, {1009, inp.SaleAddress}, {1187, inp.SaleLocation},
+		{1046, inp.OFDOrganizationName}, {1017, inp.OFDOrganizationINN}, {1060, inp.FNSWebSite}, {1117, inp.SenderEmail}} {
+		if len(t.val.(string)) > 0 {
+			tags = append(tags, t)
+		}
+	}
+	return tags
+}
+
+//cashierTags кассир (1021) и ИНН кассира (1203), пустые не передаются
+func cashierTags(name, inn string) []tagValue {
+	tags := make([]tagValue, 0, 2)
+	if len(inn) > 0 {
+		tags = append(tags, tagValue{1203, inn})
+	}
+	if len(name) > 0 {
+		tags = append(tags, tagValue{1021, name})
+	}
+	return tags
+}
+
+//checkCashierTags проверит кодирование кассира и ИНН кассира в кодировке ККТ до открытия документа
+func checkCashierTags(kkm *drv.KkmDrv, name, inn string) error {
+	return checkTagValues(kkm, cashierTags(name, inn))
+}
+
+//sendCashierTags передаст кассира (1021) и ИНН кассира (1203)
+func sendCashierTags(kkm *drv.KkmDrv, pass []byte, name, inn string) error {
+	return sendTagValues(kkm, pass, cashierTags(name, inn))
+}
+
+//checkTagValues проверит кодирование реквизитов в кодировке ККТ
+func checkTagValues(kkm *drv.KkmDrv, tags []tagValue) error {
+	for _, t := range tags {
+		_, err := kkm.EncodeTag(t.tag, t.val)
+		if err = stepError("тег "+strconv.Itoa(int(t.tag)), err); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//sendTagValues передаст реквизиты в ФН, ошибка ККТ по любому из них прерывает передачу
+func sendTagValues(kkm *drv.KkmDrv, pass []byte, tags []tagValue) error {
+	for _, t := range tags {
+		errcode, err := kkm.FNSendTag(pass, t.tag, t.val)
+		if err == nil && errcode > 0 {
+			err = errors.New(kkm.ParseErrState(errcode))
+		}
+		if err = stepError("тег "+strconv.Itoa(int(t.tag)), err); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//documentDateTime дата и время документа (тег 1012) из архива ФН, пусто - документ не прочитан
+func documentDateTime(kkm *drv.KkmDrv, pass []byte, fd uint32) string {
+	_, data, errcode, err := kkm.FNReadDocument(pass, fd)
+	if err == nil && errcode > 0 {
+		err = errors.New(kkm.ParseErrState(errcode))
+	}
+	if err != nil {
+		log.Printf("документ %d не прочитан из архива ФН: %v", fd, err)
+		return ""
+	}
+	for _, f := range tlv.DecodeAll(data, kkm.TLVCodePage()) {
+		if v, ok := f.Value.(string); ok && f.Tag == 1012 {
+			return v
+		}
+	}
+	return ""
+}
+
+//stepError ошибка шага операции с ФН с его наименованием
+func stepError(step string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return errors.New(step + ": " + err.Error())
+}
+
+//fnReasonCode код причины перерегистрации: для ФФД 1.05 - число 1..4, для ФФД 1.1 - битовая маска
+func fnReasonCode(inp *ParametersFiscal, ffd11 bool) (uint32, error) {
+	if !ffd11 {
+		if inp.ReasonCode < 1 || inp.ReasonCode > 4 {
+			return 0, errors.New("код причины перерегистрации должен быть в диапазоне 1..4")
+		}
+		return uint32(inp.ReasonCode), nil
+	}
+	if len(inp.ReasonCodes) > 0 {
+		mask, err := parseCodeList(inp.ReasonCodes, 31)
+		if err != nil || mask == 0 {
+			return 0, errors.New("коды причин изменения сведений о ККТ должны быть в диапазоне 0..31")
+		}
+		return mask, nil
+	}
+	//код ФФД 1.05 переведем в маску ФФД 1.1
+	switch inp.ReasonCode {
+	case 1: //замена ФН
+		return 1 << 0, nil
+	case 2: //замена ОФД
+		return 1 << 1, nil
+	case 3: //изменение реквизитов: наименование пользователя, адрес и место расчетов
+		return 1<<2 | 1<<3, nil
+	}
+	return 0, errors.New("не указаны коды причин изменения сведений о ККТ")
+}
+
+//parseCodeList разбирает список кодов через "," в битовую маску
+func parseCodeList(s string, max int) (uint32, error) {
+	var mask uint32
+	if len(strings.TrimSpace(s)) == 0 {
+		return 0, nil
+	}
+	for _, v := range strings.Split(s, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil || n < 0 || n > max {
+			return 0, errors.New("неверный код " + v)
+		}
+		mask = mask | 1<<uint(n)
+	}
+	return mask, nil
+}
+
+//boolBit вернет байт с установленным битом n если b
+func boolBit(b bool, n uint) byte {
+	if b {
+		return 1 << n
+	}
+	return 0
+}
+
+//isDigits строка состоит только из цифр
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
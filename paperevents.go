@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"kkm-shtrih/drv"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	bolt "go.etcd.io/bbolt"
+)
+
+//initPaperEvents создаст журнал остановок печати
+func initPaperEvents() error {
+	return DB.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte("PaperEvents"))
+		return err
+	})
+}
+
+//recordPaperEvent запишет остановку или продолжение печати в журнал, вызывается драйвером (drv.OnPaper)
+func recordPaperEvent(ev drv.PaperEvent) {
+	log.Printf("бумага %s [%s]: %s", ev.DeviceID, ev.Event, ev.Message)
+	v, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	err = DB.Update(func(tx *bolt.Tx) error {
+		return putEvent(tx.Bucket([]byte("PaperEvents")), ev.Time, ev.DeviceID, v)
+	})
+	if err != nil {
+		log.Printf("журнал бумаги: %v", err)
+	}
+}
+
+//getPaperEvents журнал остановок печати из-за бумаги, ?DeviceID= фильтр, ?limit= количество последних записей
+func getPaperEvents(c *gin.Context) {
+	deviceID := c.Query("DeviceID")
+	limit, err := getIntParam(c, "limit", 100)
+	if err != nil || limit <= 0 {
+		limit = 100
+	}
+	events := make([]drv.PaperEvent, 0, limit)
+	err = DB.View(func(tx *bolt.Tx) error {
+		cur := tx.Bucket([]byte("PaperEvents")).Cursor()
+		for k, v := cur.Last(); k != nil && len(events) < limit; k, v = cur.Prev() {
+			var ev drv.PaperEvent
+			if err := json.Unmarshal(v, &ev); err != nil {
+				continue
+			}
+			if len(deviceID) == 0 || ev.DeviceID == deviceID {
+				events = append(events, ev)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"error": true, "message": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"error": false, "events": events})
+}
@@ -0,0 +1,564 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"kkm-shtrih/drv"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	xdraw "golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gomono"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+/*
+	Предпросмотр чека (CheckPackage) и текстового документа (PrintTextDocument) без печати на ККТ.
+	Раскладка строк - по длине строки и параметрам шрифтов ККТ, прочитанным при подключении,
+	если ККТ не подключалась - по длине строки kkmparam и символу 12x24 точки.
+	Логотипы, штрихкоды и QR-код чека рисуются растром, фискальные реквизиты - нулевые.
+*/
+
+//operationNames наименования типов операций чека
+var operationNames = map[int]string{1: "ПРИХОД", 2: "ВОЗВРАТ ПРИХОДА", 3: "РАСХОД", 4: "ВОЗВРАТ РАСХОДА"}
+
+//paymentNames наименования видов оплат в порядке печати
+var paymentNames = []string{"НАЛИЧНЫМИ", "БЕЗНАЛИЧНЫМИ", "ПРЕДВАРИТЕЛЬНАЯ ОПЛАТА (АВАНС)", "ПОСЛЕДУЮЩАЯ ОПЛАТА (КРЕДИТ)", "ИНАЯ ФОРМА ОПЛАТЫ"}
+
+//taxationNames наименования систем налогообложения
+var taxationNames = map[int]string{0: "ОСН", 1: "УСН доход", 2: "УСН доход - расход", 3: "ЕНВД", 4: "ЕСХН", 5: "ПСН"}
+
+//previewDPI разрешение печати ККТ, точек на дюйм
+const previewDPI = 203
+
+//previewItem строка или изображение документа
+type previewItem struct {
+	op      markupOp
+	img     image.Image
+	caption string
+}
+
+//Preview документ, разложенный по ширине ленты ККТ
+type Preview struct {
+	kkm   *drv.KkmDrv
+	items []previewItem
+	mono  *opentype.Font
+	faces map[float64]font.Face
+}
+
+func newPreview(kkm *drv.KkmDrv) *Preview {
+	return &Preview{kkm: kkm, faces: make(map[float64]font.Face)}
+}
+
+//width длина строки шрифта в символах
+func (p *Preview) width(f int) int {
+	if f < 1 {
+		f = 1
+	}
+	w := int(p.kkm.LineLength(byte(f)))
+	if w == 0 {
+		w = int(LENLINE)
+	}
+	return w
+}
+
+//dots ширина области печати в точках
+func (p *Preview) dots() int {
+	if fp, ok := p.kkm.GetFonts()[1]; ok && fp.PrintWidth > 0 {
+		return int(fp.PrintWidth)
+	}
+	return p.width(1) * 12
+}
+
+//cell размер символа шрифта в точках
+func (p *Preview) cell(f int) (int, int) {
+	if f < 1 {
+		f = 1
+	}
+	if fp, ok := p.kkm.GetFonts()[byte(f)]; ok && fp.CharWidth > 0 && fp.CharHeight > 0 {
+		return int(fp.CharWidth), int(fp.CharHeight)
+	}
+	w := p.dots() / p.width(f)
+	if w < 1 {
+		w = 1
+	}
+	return w, w * 2
+}
+
+//markup строки с разметкой
+func (p *Preview) markup(lines []TextLine) {
+	for _, op := range layoutMarkup(p.kkm, lines) {
+		p.items = append(p.items, previewItem{op: op})
+	}
+}
+
+//text строки шрифтом 1 с переносом, как PrintString
+func (p *Preview) text(lines ...string) {
+	for _, l := range lines {
+		wrapped := []string{l}
+		if utf8.RuneCountInString(l) > p.width(1) {
+			wrapped = drv.WrapText(l, p.width(1))
+		}
+		for _, s := range wrapped {
+			p.items = append(p.items, previewItem{op: markupOp{Kind: "line", Text: s, Font: 1}})
+		}
+	}
+}
+
+//wide строки двойной ширины, как PrintWideLine
+func (p *Preview) wide(lines ...string) {
+	for _, l := range lines {
+		p.items = append(p.items, previewItem{op: markupOp{Kind: "line", Text: l, Wide: true, Font: 1}})
+	}
+}
+
+//image растровое изображение, caption - подпись в текстовом предпросмотре
+func (p *Preview) image(img image.Image, caption string) {
+	p.items = append(p.items, previewItem{img: img, caption: caption})
+}
+
+//Text документ простым текстом, строки двойной ширины - через пробел
+func (p *Preview) Text() string {
+	var b strings.Builder
+	width := p.width(1)
+	for _, it := range p.items {
+		switch {
+		case it.img != nil:
+			b.WriteString(centerLine("["+it.caption+"]", width))
+		case it.op.Kind == "cut":
+			b.WriteString(strings.Repeat("~", width))
+		case it.op.Kind == "feed":
+			b.WriteString(strings.Repeat("\n", it.op.Count-1))
+		case it.op.Wide:
+			r := []rune(it.op.Text)
+			s := make([]string, len(r))
+			for i := range r {
+				s[i] = string(r[i])
+			}
+			b.WriteString(strings.TrimRight(strings.Join(s, " "), " "))
+		default:
+			b.WriteString(strings.TrimRight(it.op.Text, " "))
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+//face моноширинный шрифт, символ которого помещается в ячейку cw x ch
+func (p *Preview) face(cw, ch int) (font.Face, error) {
+	var err error
+	if p.mono == nil {
+		if p.mono, err = opentype.Parse(gomono.TTF); err != nil {
+			return nil, err
+		}
+	}
+	//ширина символа Go Mono - 0.6 кегля
+	size := float64(ch) * 0.75
+	if size*0.6 > float64(cw) {
+		size = float64(cw) / 0.6
+	}
+	if f, ok := p.faces[size]; ok {
+		return f, nil
+	}
+	f, err := opentype.NewFace(p.mono, &opentype.FaceOptions{Size: size, DPI: 72, Hinting: font.HintingFull})
+	if err != nil {
+		return nil, err
+	}
+	p.faces[size] = f
+	return f, nil
+}
+
+//newCanvas белая полоса ленты высотой h
+func newCanvas(w, h int) *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	draw.Draw(img, img.Bounds(), image.White, image.Point{}, draw.Src)
+	return img
+}
+
+//renderLine строка текста по ячейкам шрифта, двойная ширина - растяжением символа
+func (p *Preview) renderLine(op markupOp) (*image.Gray, error) {
+	cw, ch := p.cell(op.Font)
+	face, err := p.face(cw, ch)
+	if err != nil {
+		return nil, err
+	}
+	scale := 1
+	if op.Wide {
+		scale = 2
+	}
+	m := face.Metrics()
+	baseline := (ch-(m.Ascent+m.Descent).Ceil())/2 + m.Ascent.Ceil()
+	line := newCanvas(p.dots(), ch)
+	glyph := image.NewGray(image.Rect(0, 0, cw, ch))
+	d := font.Drawer{Dst: glyph, Src: image.Black, Face: face}
+	for i, r := range []rune(op.Text) {
+		if r == ' ' {
+			continue
+		}
+		draw.Draw(glyph, glyph.Bounds(), image.White, image.Point{}, draw.Src)
+		adv, _ := face.GlyphAdvance(r)
+		d.Dot = fixed.P((cw-adv.Ceil())/2, baseline)
+		d.DrawString(string(r))
+		x0 := i * cw * scale
+		for y := 0; y < ch; y++ {
+			for x := 0; x < cw*scale; x++ {
+				line.SetGray(x0+x, y, glyph.GrayAt(x/scale, y))
+			}
+		}
+	}
+	return line, nil
+}
+
+//renderImage изображение по центру ленты, шире ленты - с уменьшением
+func (p *Preview) renderImage(img image.Image) *image.Gray {
+	dots := p.dots()
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w > dots {
+		w, h = dots, h*dots/w
+	}
+	out := newCanvas(dots, h+8)
+	r := image.Rect((dots-w)/2, 4, (dots-w)/2+w, 4+h)
+	xdraw.NearestNeighbor.Scale(out, r, img, b, draw.Over, nil)
+	return out
+}
+
+//Image документ растром в точках ККТ
+func (p *Preview) Image() (*image.Gray, error) {
+	dots := p.dots()
+	_, lh := p.cell(1)
+	var parts []*image.Gray
+	for _, it := range p.items {
+		switch {
+		case it.img != nil:
+			parts = append(parts, p.renderImage(it.img))
+		case it.op.Kind == "cut":
+			cut := newCanvas(dots, 16)
+			for x := 0; x < dots; x++ {
+				if x/6%2 == 0 {
+					cut.SetGray(x, 8, color.Gray{})
+				}
+			}
+			parts = append(parts, cut)
+		case it.op.Kind == "feed":
+			parts = append(parts, newCanvas(dots, lh*it.op.Count))
+		default:
+			line, err := p.renderLine(it.op)
+			if err != nil {
+				return nil, err
+			}
+			parts = append(parts, line)
+		}
+	}
+	//поля ленты сверху и снизу
+	h := 2 * lh
+	for _, part := range parts {
+		h += part.Bounds().Dy()
+	}
+	out := newCanvas(dots, h)
+	y := lh
+	for _, part := range parts {
+		draw.Draw(out, part.Bounds().Add(image.Pt(0, y)), part, image.Point{}, draw.Src)
+		y += part.Bounds().Dy()
+	}
+	return out, nil
+}
+
+//previewPDF страница PDF с изображением ленты в натуральную величину
+func previewPDF(img *image.Gray) ([]byte, error) {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	var data bytes.Buffer
+	zw := zlib.NewWriter(&data)
+	for y := 0; y < h; y++ {
+		if _, err := zw.Write(img.Pix[y*img.Stride : y*img.Stride+w]); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	pw := float64(w) * 72 / previewDPI
+	ph := float64(h) * 72 / previewDPI
+	content := fmt.Sprintf("q %.2f 0 0 %.2f 0 0 cm /Im0 Do Q", pw, ph)
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.2f %.2f] /Resources << /XObject << /Im0 5 0 R >> >> /Contents 4 0 R >>", pw, ph),
+		fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", len(content), content),
+		fmt.Sprintf("<< /Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace /DeviceGray /BitsPerComponent 8 /Filter /FlateDecode /Length %d >>\nstream\n", w, h, data.Len()),
+	}
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, obj := range objects {
+		offsets[i] = buf.Len()
+		fmt.Fprintf(&buf, "%d 0 obj\n%s", i+1, obj)
+		if i == len(objects)-1 {
+			buf.Write(data.Bytes())
+			buf.WriteString("\nendstream")
+		}
+		buf.WriteString("\nendobj\n")
+	}
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	return buf.Bytes(), nil
+}
+
+//logoImage изображение логотипа из линий графики
+func logoImage(l Logo) image.Image {
+	w := drv.GraphicsLineBytes * 8
+	img := newCanvas(w, l.Height)
+	for y := 0; y < l.Height && (y+1)*drv.GraphicsLineBytes <= len(l.Data); y++ {
+		for x := 0; x < w; x++ {
+			if l.Data[y*drv.GraphicsLineBytes+x/8]&(1<<uint(x%8)) > 0 {
+				img.SetGray(x, y, color.Gray{})
+			}
+		}
+	}
+	return img
+}
+
+//vatName наименование ставки НДС
+func vatName(rate string) string {
+	switch rate {
+	case "none", "4":
+		return "БЕЗ НДС"
+	case "0", "20", "18", "10":
+		return "НДС " + rate + "%"
+	case "20/120", "18/118", "10/110":
+		return "НДС " + rate
+	}
+	return "НАЛОГ " + rate
+}
+
+func money(v float64) string {
+	return strconv.FormatFloat(v, 'f', 2, 64)
+}
+
+//previewCheck чек, как его напечатает fiscalizeCheck
+func previewCheck(p *Preview, deviceID string, chk *CheckPackage) error {
+	v := validateCheck(deviceID, chk)
+	if !v.Valid {
+		return errors.New(strings.Join(v.Errors, "; "))
+	}
+	par := &chk.Parameters
+	width := p.width(1)
+	if par.Electronically {
+		p.text(centerLine("ЧЕК ТОЛЬКО В ЭЛЕКТРОННОМ ВИДЕ", width), centerLine("НЕ ПЕЧАТАЕТСЯ", width))
+		p.items = append(p.items, previewItem{op: markupOp{Kind: "feed", Count: 1}})
+	}
+	if len(par.Logo) > 0 {
+		logo, err := loadLogo(deviceID, par.Logo)
+		if err != nil {
+			return err
+		}
+		p.image(logoImage(logo), "ЛОГОТИП "+logo.Name)
+	}
+	doctype := par.DocumentType
+	if doctype == 0 {
+		doctype = DocTypeCheck
+	}
+	for _, l := range documentHeaderLines(doctype) {
+		p.text(centerLine(l, width))
+	}
+	tctx := checkTemplateContext(deviceID, chk, v.Total)
+	header, err := renderTemplate(deviceID, TemplateHeader, tctx)
+	if err != nil {
+		return err
+	}
+	footer, err := renderTemplate(deviceID, TemplateFooter, tctx)
+	if err != nil {
+		return err
+	}
+	p.markup(header)
+	title := "КАССОВЫЙ ЧЕК"
+	if doctype == DocTypeCorrection || doctype == DocTypeBSOCorrection {
+		title = "КАССОВЫЙ ЧЕК КОРРЕКЦИИ"
+	}
+	optype := checkOperationType(par)
+	p.text(centerLine(title, width), centerLine(operationNames[optype], width))
+	if len(par.SenderEmail) > 0 {
+		p.text(par.SenderEmail)
+	}
+	for _, fs := range chk.Positions.FiscalString {
+		name := fs.Name
+		if len(fs.MeasurementUnit) > 0 {
+			name = name + " " + fs.MeasurementUnit
+		}
+		p.text(name)
+		qty := strconv.FormatFloat(fs.Quantity, 'f', -1, 64)
+		p.text(textLine(qty+" X "+money(fs.PriceWithDiscount), "="+money(fs.AmountWithDiscount), width)...)
+		vat := "=" + money(fs.AmountWithDiscount)
+		if fs.VATAmount > 0 {
+			vat = "=" + money(fs.VATAmount)
+		}
+		p.text(textLine(vatName(fs.VATRate), vat, width)...)
+	}
+	p.markup(footer)
+	if v.Rounding > 0 {
+		p.text(textLine("ОКРУГЛЕНИЕ", "-"+money(v.Rounding), width)...)
+	}
+	total := round2(v.Total - v.Rounding)
+	p.wide(textLine("ИТОГ", "="+money(total), width/2)...)
+	pay := chk.Payments
+	for i, sum := range []float64{pay.Cash, pay.ElectronicPayment, pay.PrePayment, pay.PostPayment, pay.Barter} {
+		if sum > 0 {
+			p.text(textLine(paymentNames[i], "="+money(sum), width)...)
+		}
+	}
+	if v.Change > 0 {
+		p.text(textLine("СДАЧА", "="+money(v.Change), width)...)
+	}
+	for _, t := range v.Taxes {
+		if vatRates[t.VATRate] == 0 {
+			p.text(textLine("СУММА "+vatName(t.VATRate), "="+money(t.Amount), width)...)
+		} else {
+			p.text(textLine("СУММА "+vatName(t.VATRate), "="+money(t.VATAmount), width)...)
+		}
+	}
+	p.text(textLine("СНО", taxationNames[par.TaxationSystem], width)...)
+	p.text(textLine("КАССИР", par.CashierName, width)...)
+	if len(par.CashierINN) > 0 {
+		p.text(textLine("ИНН КАССИРА", par.CashierINN, width)...)
+	}
+	if len(par.CustomerEmail) > 0 {
+		p.text(textLine("ЭЛ. АДР. ПОКУПАТЕЛЯ", par.CustomerEmail, width)...)
+	} else if len(par.CustomerPhone) > 0 {
+		p.text(textLine("ТЕЛ. ПОКУПАТЕЛЯ", par.CustomerPhone, width)...)
+	}
+	if reg, ok := RegInfo.Get(deviceID); ok {
+		p.text(textLine("ИНН", reg.Inn, width)...)
+		p.text(textLine("РН ККТ", reg.RNM, width)...)
+	}
+	now := time.Now()
+	p.text(textLine("ДАТА", now.Format("02.01.06 15:04"), width)...)
+	p.text(textLine("ФН", "0000000000000000", width)...)
+	p.text(textLine("ФД", "0", width)...)
+	p.text(textLine("ФП", "0", width)...)
+	//QR-код чека: дата, сумма, ФН, ФД, ФП, тип операции
+	qr := "t=" + now.Format("20060102T1504") + "&s=" + money(total) + "&fn=0000000000000000&i=0&fp=0&n=" + strconv.Itoa(optype)
+	img, err := barcodeImage("QR", []byte(qr), p.kkm.GetParam(), p.dots())
+	if err != nil {
+		return err
+	}
+	p.image(img, "QR "+qr)
+	p.items = append(p.items, previewItem{op: markupOp{Kind: "cut"}})
+	return nil
+}
+
+//previewTextDocument текстовый документ, как его напечатает printTextDocument
+func previewTextDocument(p *Preview, deviceID string, doc *TextDocument) error {
+	if _, err := tapeFlags(doc.Tape); err != nil {
+		return err
+	}
+	for _, ref := range doc.Positions.Logos {
+		logo, err := loadLogo(deviceID, ref.Name)
+		if err != nil {
+			return err
+		}
+		p.image(logoImage(logo), "ЛОГОТИП "+logo.Name)
+	}
+	lines, footer, err := textDocumentLines(deviceID, doc)
+	if err != nil {
+		return err
+	}
+	p.markup(lines)
+	if bc := doc.Positions.Barcode; len(bc.Barcode) > 0 {
+		data, err := base64.StdEncoding.DecodeString(bc.Barcode)
+		if err != nil {
+			return err
+		}
+		img, err := barcodeImage(bc.Barcodetype, data, p.kkm.GetParam(), p.dots())
+		if err != nil {
+			return err
+		}
+		p.image(img, bc.Barcodetype+" "+string(data))
+	}
+	p.markup(footer)
+	return nil
+}
+
+//previewHandler предпросмотр документа без печати
+func previewHandler(c *gin.Context) {
+	/*
+		POST Preview/<DeviceID>?doc=check|text&format=text|png|pdf
+		doc=check (по умолчанию) - тело CheckPackage в xml или json (Content-Type: application/json), как ProcessCheck
+		doc=text - тело Document в xml, как PrintTextDocument
+		format: text (по умолчанию) - text/plain, png - изображение ленты, pdf - лента в натуральную величину (203 dpi)
+	*/
+	deviceID := c.Param("DeviceID")
+	kkm, err := KkmServ.GetDrv(deviceID)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"error": true, "message": "deviceID не зарегистрирован"})
+		return
+	}
+	format := c.DefaultQuery("format", "text")
+	if format != "text" && format != "png" && format != "pdf" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": true, "message": "format должен быть text, png или pdf"})
+		return
+	}
+	p := newPreview(kkm)
+	switch c.DefaultQuery("doc", "check") {
+	case "check":
+		var chk = CheckPackage{}
+		if c.ContentType() == "application/json" {
+			err = c.ShouldBindJSON(&chk)
+		} else {
+			err = c.ShouldBindXML(&chk)
+		}
+		if err == nil {
+			err = previewCheck(p, deviceID, &chk)
+		}
+	case "text":
+		var doc = TextDocument{}
+		if err = c.ShouldBindXML(&doc); err == nil {
+			err = previewTextDocument(p, deviceID, &doc)
+		}
+	default:
+		err = errors.New("doc должен быть check или text")
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": true, "message": err.Error()})
+		return
+	}
+	if format == "text" {
+		c.Data(http.StatusOK, "text/plain; charset=utf-8", []byte(p.Text()))
+		return
+	}
+	img, err := p.Image()
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"error": true, "message": err.Error()})
+		return
+	}
+	var out []byte
+	if format == "pdf" {
+		out, err = previewPDF(img)
+	} else {
+		var buf bytes.Buffer
+		err = png.Encode(&buf, img)
+		out = buf.Bytes()
+	}
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"error": true, "message": err.Error()})
+		return
+	}
+	c.Data(http.StatusOK, map[string]string{"png": "image/png", "pdf": "application/pdf"}[format], out)
+}
+
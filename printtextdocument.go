@@ -3,40 +3,94 @@ package main
 import (
 	"encoding/base64"
 	"encoding/xml"
+	"errors"
 	"net/http"
 	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
-//CloseShift закрыть смену
+//TextDocBarcode штрихкод текстового документа, значение в base64
+type TextDocBarcode struct {
+	Barcodetype string `xml:"BarcodeType,attr" binding:"required"`
+	Barcode     string `xml:"Barcode,attr" binding:"required"`
+}
+
+//TextDocString строка текстового документа
+type TextDocString struct {
+	//Текст с разметкой, см. textmarkup.go
+	Text string `xml:"Text,attr" binding:"required"`
+}
+
+//TextDocPositions содержимое текстового документа
+type TextDocPositions struct {
+	//Логотипы ККТ (POST Logo) печатаются перед текстом
+	Logos   []LogoRef       `xml:"Logo"`
+	TextStr []TextDocString `xml:"TextString"`
+	Barcode TextDocBarcode  `xml:"Barcode"`
+}
+
+//TextDocument текстовый (нефискальный) документ PrintTextDocument
+type TextDocument struct {
+	XMLName xml.Name `xml:"Document"`
+	//Лента: receipt, control, both (по умолчанию)
+	Tape string `xml:"Tape,attr"`
+	//Макет документа из шаблонов ККТ, печатается перед TextString
+	Template     string           `xml:"Template,attr"`
+	TemplateData []TemplateValue  `xml:"TemplateData>Value"`
+	Positions    TextDocPositions `xml:"Positions"`
+}
+
+//textDocumentLines строки документа: шаблон заголовка, макет и TextString, и отдельно шаблон подвала
+func textDocumentLines(deviceID string, doc *TextDocument) ([]TextLine, []TextLine, error) {
+	tctx := newTemplateContext(deviceID, doc.TemplateData)
+	lines, err := renderTemplate(deviceID, TemplateHeader, tctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(doc.Template) > 0 {
+		if _, found, _ := loadTemplate(deviceID, doc.Template); !found {
+			return nil, nil, errors.New("шаблон " + doc.Template + " не найден")
+		}
+		layout, err := renderTemplate(deviceID, doc.Template, tctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		lines = append(lines, layout...)
+	}
+	footer, err := renderTemplate(deviceID, TemplateFooter, tctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, ts := range doc.Positions.TextStr {
+		l, err := parseMarkup(ts.Text)
+		if err != nil {
+			return nil, nil, err
+		}
+		lines = append(lines, l...)
+	}
+	return lines, footer, nil
+}
+
+//printTextDocument печать текстового документа
 func printTextDocument(c *gin.Context) {
 	/*
 	   <?xml version="1.0" encoding="UTF-8"?>
-	   <Document>
+	   <Document Tape="receipt" Template="kitchen">
 	   	<Positions>
+	   		<Logo Name="shop"/>
+	   		<TextString Text="{b}{c}ДИСКОНТНАЯ КАРТА"/>
+	   		<TextString Text="{sep}"/>
 	   		<TextString Text="Участие в дисконтной системе"/>
 	   		<TextString Text="Дисконтная карта: 00002345"/>
 	   		<Barcode BarcodeType="EAN13" Barcode="2000021262157"/>
 	   	</Positions>
+	   	<TemplateData>
+	   		<Value Name="OrderNumber" Value="15"/>
+	   	</TemplateData>
 	   </Document>
 	*/
-	type Barcode struct {
-		Barcodetype string `xml:"BarcodeType,attr" binding:"required"`
-		Barcode     string `xml:"Barcode,attr" binding:"required"`
-	}
-	type TextString struct {
-		Text string `xml:"Text,attr" binding:"required"`
-	}
-	type Positions struct {
-		TextStr []TextString `xml:"TextString"`
-		Barcode `xml:"Barcode"`
-	}
-	type Document struct {
-		XMLName   xml.Name `xml:"Document"`
-		Positions `xml:"Positions"`
-	}
-	var inp = Document{}
+	var inp = TextDocument{}
 	deviceID := c.Param("DeviceID")
 	kkm, err := KkmServ.GetDrv(deviceID)
 	if err != nil {
@@ -58,6 +112,16 @@ func printTextDocument(c *gin.Context) {
 		c.XML(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	tape, err := tapeFlags(inp.Tape)
+	if err != nil {
+		c.XML(http.StatusBadRequest, gin.H{"error": true, "message": err.Error()})
+		return
+	}
+	lines, footer, err := textDocumentLines(deviceID, &inp)
+	if err != nil {
+		c.XML(http.StatusBadRequest, gin.H{"error": true, "message": err.Error()})
+		return
+	}
 	errcode, err := kkm.FNGetStatus()
 	if err != nil {
 		c.XML(http.StatusBadRequest, gin.H{"error": err.Error()})
@@ -79,29 +143,59 @@ func printTextDocument(c *gin.Context) {
 		return
 	}
 	admpass := kkm.GetAdminPass()
-	for i := 0; i < len(inp.TextStr); i++ {
-		tx := inp.TextStr[i].Text
-		errcode, _ = kkm.PrintString(admpass, tx)
+	for _, ref := range inp.Positions.Logos {
+		logo, err := loadLogo(deviceID, ref.Name)
+		if err != nil {
+			c.XML(http.StatusBadRequest, gin.H{"error": true, "message": err.Error()})
+			return
+		}
+		errcode, err = printLogo(kkm, admpass, logo)
+		if err != nil {
+			c.XML(http.StatusBadRequest, gin.H{"error": true, "message": err.Error()})
+			return
+		}
 		if errcode > 0 {
 			c.XML(http.StatusBadRequest, gin.H{"error": true, "message": kkm.ParseErrState(errcode)})
 			return
 		}
 	}
-	barcode := inp.Barcode.Barcode
-	bartype := inp.Barcode.Barcodetype
-	decodedbarcode, err := base64.StdEncoding.DecodeString(barcode)
+	errcode, err = printMarkup(kkm, admpass, tape, lines)
 	if err != nil {
 		c.XML(http.StatusBadRequest, gin.H{"error": true, "message": err.Error()})
 		return
 	}
-	errcode, err = kkm.PrintBarCode(admpass, bartype, decodedbarcode)
+	if errcode > 0 {
+		c.XML(http.StatusBadRequest, gin.H{"error": true, "message": kkm.ParseErrState(errcode)})
+		return
+	}
+	if barcode := inp.Positions.Barcode.Barcode; len(barcode) > 0 {
+		decodedbarcode, err := base64.StdEncoding.DecodeString(barcode)
+		if err != nil {
+			c.XML(http.StatusBadRequest, gin.H{"error": true, "message": err.Error()})
+			return
+		}
+		errcode, err = printBarcode(kkm, admpass, inp.Positions.Barcode.Barcodetype, decodedbarcode)
+		if err != nil {
+			c.XML(http.StatusBadRequest, gin.H{"error": true, "message": err.Error()})
+			return
+		}
+		if errcode > 0 {
+			c.XML(http.StatusBadRequest, gin.H{"error": true, "message": kkm.ParseErrState(errcode)})
+			return
+		}
+	}
+	errcode, err = printMarkup(kkm, admpass, tape, footer)
 	if err != nil {
 		c.XML(http.StatusBadRequest, gin.H{"error": true, "message": err.Error()})
 		return
 	}
-	if err != nil {
+	if errcode > 0 {
 		c.XML(http.StatusBadRequest, gin.H{"error": true, "message": kkm.ParseErrState(errcode)})
 		return
 	}
-	c.XML(http.StatusOK, gin.H{"error": true, "message": "deviceID не зарегистрирован"})
+	if err = kkm.WaitPrint(0); err != nil {
+		c.XML(http.StatusOK, gin.H{"error": true, "message": "печать не завершена: " + err.Error()})
+		return
+	}
+	c.XML(http.StatusOK, gin.H{"error": false, "message": "ok"})
 }
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"kkm-shtrih/drv"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+//agentNames признаки агента (таблица 10 ФФД) по номеру бита тега 1057
+var agentNames = []string{"банковский платежный агент", "банковский платежный субагент", "платежный агент",
+	"платежный субагент", "поверенный", "комиссионер", "агент"}
+
+//RegProfile параметры регистрации ККТ, по которым проверяются чеки
+type RegProfile struct {
+	DeviceID string `json:"deviceID"`
+	RNM      string `json:"rnm"`
+	INN      string `json:"inn"`
+	DateTime string `json:"dateTime"`
+	FFD11    bool   `json:"ffd11"`
+	//Коды систем налогообложения через ","
+	TaxationSystems string `json:"taxationSystems"`
+	//Коды признаков агента через ","
+	AgentTypes string `json:"agentTypes"`
+	BSO        bool   `json:"bso"`
+	Automatic  bool   `json:"automatic"`
+	Internet   bool   `json:"internet"`
+	//Признаки подакцизных товаров, азартных игр и лотерей известны (ФФД 1.1 или таблица 18)
+	ExtKnown bool `json:"extKnown"`
+	Excise   bool `json:"excise"`
+	Gambling bool `json:"gambling"`
+	Lottery  bool `json:"lottery"`
+}
+
+//bitCodes номера установленных бит маски через "," (коды систем налогообложения, признаков агента)
+func bitCodes(mask byte, n int) string {
+	codes := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		if mask&(1<<uint(i)) > 0 {
+			codes = append(codes, strconv.Itoa(i))
+		}
+	}
+	return strings.Join(codes, ",")
+}
+
+func newRegProfile(deviceID string, reg drv.FNRegInfo) RegProfile {
+	return RegProfile{
+		DeviceID:        deviceID,
+		RNM:             reg.RNM,
+		INN:             reg.Inn,
+		DateTime:        reg.DateTime.Format("2006-01-02 15:04:05"),
+		FFD11:           reg.FFD11,
+		TaxationSystems: bitCodes(reg.TaxCode, 6),
+		AgentTypes:      bitCodes(reg.AgentTypes, 7),
+		BSO:             reg.BSO(),
+		Automatic:       reg.Automatic(),
+		Internet:        reg.Internet(),
+		ExtKnown:        reg.ExtKnown,
+		Excise:          reg.Excise(),
+		Gambling:        reg.Gambling(),
+		Lottery:         reg.Lottery(),
+	}
+}
+
+//agentProblem проверит признак агента code по маске регистрации, used - в чеке (позиции) есть агентские данные
+func agentProblem(field string, code int, used bool, reg drv.FNRegInfo) string {
+	if !used {
+		return ""
+	}
+	if code < 0 || code >= len(agentNames) {
+		return field + ": признак агента должен быть 0..6"
+	}
+	if reg.AgentTypes&(1<<uint(code)) == 0 {
+		if reg.AgentTypes == 0 {
+			return field + ": ККТ не зарегистрирована как агент, признак \"" + agentNames[code] + "\" недопустим"
+		}
+		return field + ": признак агента \"" + agentNames[code] + "\" не указан при регистрации ККТ (зарегистрированы " + bitCodes(reg.AgentTypes, 7) + ")"
+	}
+	return ""
+}
+
+//agentDataUsed заполнены данные агента
+func agentDataUsed(a AgentData) bool {
+	return a != AgentData{}
+}
+
+//subjectProblem проверит признак предмета расчета по режимам регистрации ККТ
+func subjectProblem(subject int, reg drv.FNRegInfo) string {
+	if !reg.ExtKnown {
+		return ""
+	}
+	switch subject {
+	case 2:
+		if !reg.Excise() {
+			return "CalculationSubject: ККТ не зарегистрирована для продажи подакцизных товаров"
+		}
+	case 5, 6:
+		if !reg.Gambling() {
+			return "CalculationSubject: ККТ не зарегистрирована для проведения азартных игр"
+		}
+	case 7, 8:
+		if !reg.Lottery() {
+			return "CalculationSubject: ККТ не зарегистрирована для проведения лотерей"
+		}
+	}
+	return ""
+}
+
+//registrationProblems проверка чека по параметрам регистрации ККТ из кэша: система налогообложения,
+//признаки агента, признаки предмета расчета и режим расчетов в Интернет
+func registrationProblems(deviceID string, chk *CheckPackage) []string {
+	var msgs []string
+	add := func(s string) {
+		if len(s) > 0 {
+			msgs = append(msgs, s)
+		}
+	}
+	p := &chk.Parameters
+	add(taxationProblem(deviceID, p.TaxationSystem))
+	reg, ok := RegInfo.Get(deviceID)
+	if !ok {
+		return msgs
+	}
+	add(agentProblem("AgentType", p.AgentType, p.AgentType != 0 || agentDataUsed(p.AgentData), reg))
+	if reg.Internet() && len(p.CustomerEmail) == 0 && len(p.CustomerPhone) == 0 {
+		add("CustomerEmail: ККТ зарегистрирована для расчетов в Интернет, обязателен email или телефон покупателя")
+	}
+	for i, fs := range chk.Positions.FiscalString {
+		pos := "FiscalString[" + strconv.Itoa(i+1) + "] "
+		if msg := agentProblem("CalculationAgent", fs.CalculationAgent, fs.CalculationAgent != 0 || agentDataUsed(fs.AgentData), reg); len(msg) > 0 {
+			add(pos + msg)
+		}
+		if msg := subjectProblem(fs.CalculationSubject, reg); len(msg) > 0 {
+			add(pos + msg)
+		}
+	}
+	return msgs
+}
+
+//getRegInfo параметры регистрации ККТ из кэша, ?refresh=1 - перечитать из ФН
+func getRegInfo(c *gin.Context) {
+	deviceID := c.Param("DeviceID")
+	kkm, err := KkmServ.GetDrv(deviceID)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"error": true, "message": "deviceID не зарегистрирован"})
+		return
+	}
+	reg, ok := RegInfo.Get(deviceID)
+	if !ok || c.Query("refresh") == "1" {
+		if kkm.ChkBusy(0) {
+			c.JSON(http.StatusOK, gin.H{"error": true, "message": "ККТ занята"})
+			return
+		}
+		//займем ккм
+		procid := int(time.Now().Unix())
+		kkm.SetBusy(procid)
+		//освободим по завершению
+		defer kkm.SetBusy(0)
+		var errcode byte
+		reg, errcode, err = kkm.FNGetRegistration()
+		if err != nil {
+			c.JSON(http.StatusOK, gin.H{"error": true, "message": err.Error()})
+			return
+		}
+		if errcode > 0 {
+			c.JSON(http.StatusOK, gin.H{"error": true, "message": kkm.ParseErrState(errcode)})
+			return
+		}
+		RegInfo.Set(deviceID, reg)
+	}
+	c.JSON(http.StatusOK, gin.H{"error": false, "message": "ok", "registration": newRegProfile(deviceID, reg)})
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+//reportCurrentStatusOfSettlements отчет о текущем состоянии расчетов
+func reportCurrentStatusOfSettlements(c *gin.Context) {
+	/*<?xml version="1.0" encoding="UTF-8"?>
+	 <InputParameters>
+		<Parameters CashierName="Иванов И.П." CashierINN="32456234523452"/>
+	 </InputParameters>
+	Отчет формируется командами FF37h, FF38h, между ними передаются кассир (1021) и ИНН кассира (1203).
+	*/
+	type Parameters struct {
+		CashierName string `xml:"CashierName,attr" binding:"-"` //ФИО и должность уполномоченного лица для проведения операции
+		CashierINN  string `xml:"CashierINN,attr" binding:"-"`  //ИНН уполномоченного лица для проведения операции
+	}
+	type InputParameters struct {
+		XMLName    xml.Name `xml:"InputParameters"`
+		Parameters `xml:"Parameters"`
+	}
+	type OutParameters struct {
+		CheckNumber int    `xml:"CheckNumber,attr" binding:"-"` //Номер фискального документа отчета
+		FiscalSign  string `xml:"FiscalSign,attr" binding:"-"`  //Фискальный признак
+		DateTime    string `xml:"DateTime,attr" binding:"-"`    //Дата и время формирования отчета
+		//Количество непереданных документов
+		BacklogDocumentsCounter int `xml:"BacklogDocumentsCounter,attr" binding:"-"`
+		//Номер первого непереданного документа
+		BacklogDocumentFirstNumber int `xml:"BacklogDocumentFirstNumber,attr" binding:"-"`
+		//Дата и время первого из непереданных документов
+		BacklogDocumentFirstDateTime string `xml:"BacklogDocumentFirstDateTime,attr" binding:"-"`
+	}
+	type OutputParameters struct {
+		XMLName       xml.Name `xml:"OutputParameters"`
+		OutParameters `xml:"Parameters"`
+	}
+	var inp = InputParameters{}
+	var out = OutputParameters{}
+	deviceID := c.Param("DeviceID")
+
+	kkm, err := KkmServ.GetDrv(deviceID)
+	if err != nil {
+		c.XML(http.StatusOK, gin.H{"error": true, "message": "deviceID не зарегистрирован"})
+		return
+	}
+	if kkm.ChkBusy(0) {
+		c.XML(http.StatusOK, gin.H{"error": true, "message": "ККТ занята"})
+		return
+	}
+	//займем ккм
+	procid := int(time.Now().Unix())
+	kkm.SetBusy(procid)
+	//освободим по завершению
+	defer kkm.SetBusy(0)
+
+	if c.Request.ContentLength > 0 {
+		if err = c.ShouldBindXML(&inp); err != nil {
+			c.XML(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	//реквизиты проверяются до начала отчета, чтобы не оставить отчет открытым
+	if err = checkCashierTags(kkm, inp.CashierName, inp.CashierINN); err != nil {
+		c.XML(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	admpass := kkm.GetAdminPass()
+	_, err = kkm.FNBeginSettlementsReport(admpass)
+	if err = stepError("начало отчета о состоянии расчетов", err); err != nil {
+		c.XML(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err = sendCashierTags(kkm, admpass, inp.CashierName, inp.CashierINN); err != nil {
+		//отчет уже начат в ФН: завершим его, иначе ФН останется с открытым документом
+		if rep, _, errrep := kkm.FNSettlementsReport(admpass); errrep != nil {
+			err = errors.New(err.Error() + "; отчет не завершен: " + errrep.Error())
+		} else {
+			err = errors.New(err.Error() + "; отчет сформирован без кассира, ФД " + strconv.Itoa(int(rep.DocumentNumber)))
+		}
+		c.XML(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	rep, _, err := kkm.FNSettlementsReport(admpass)
+	if err != nil {
+		c.XML(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	out.CheckNumber = int(rep.DocumentNumber)
+	out.FiscalSign = strconv.FormatUint(uint64(rep.FiscalSign), 10)
+	dt, _, err := kkm.GetDateTime(admpass)
+	if err != nil {
+		dt = time.Now()
+	}
+	out.DateTime = dt.Format("2006-01-02 15:04:05")
+	out.BacklogDocumentsCounter = int(rep.Backlog)
+	if rep.Backlog > 0 {
+		out.BacklogDocumentFirstDateTime = rep.FirstDate.Format("2006-01-02 15:04:05")
+	}
+	//номер и точное время первого непереданного документа - из статуса обмена с ОФД
+	st, _, err := kkm.FNGetOFDStatus()
+	OFDMon.Update(deviceID, st, err)
+	if err == nil && st.Count > 0 {
+		out.BacklogDocumentFirstNumber = int(st.FirstNumber)
+		out.BacklogDocumentFirstDateTime = st.FirstDateTime.Format("2006-01-02 15:04:05")
+	}
+	c.XML(http.StatusOK, out)
+}
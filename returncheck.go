@@ -0,0 +1,573 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kkm-shtrih/drv"
+	"kkm-shtrih/drv/tlv"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	bolt "go.etcd.io/bbolt"
+)
+
+//ReceiptRecord чек в локальном журнале: пакет чека и уже возвращенные количества по позициям
+type ReceiptRecord struct {
+	DeviceID    string `json:"deviceID"`
+	CheckNumber int    `json:"CheckNumber"`
+	FiscalSign  string `json:"FiscalSign"`
+	DateTime    string `json:"DateTime"`
+	//journal - сохранен сервером при формировании, fn - прочитан из архива ФН
+	Source string       `json:"source"`
+	Check  CheckPackage `json:"check"`
+	//Возвращенное количество и сумма по позициям (индекс как в Check.Positions.FiscalString)
+	Returned       []float64 `json:"returned"`
+	ReturnedAmount []float64 `json:"returnedAmount"`
+	//Номера ФД чеков возврата
+	Returns []int `json:"returns"`
+	//Время последнего изменения записи, по нему удаляются устаревшие записи
+	Saved time.Time `json:"saved"`
+}
+
+//ReturnPosition позиция к возврату: номер позиции исходного чека (с 0) и количество
+type ReturnPosition struct {
+	Index    int     `json:"Index"`
+	Quantity float64 `json:"Quantity"`
+}
+
+//ReturnRequest запрос чека возврата по исходному чеку
+type ReturnRequest struct {
+	//Номер ФД исходного чека
+	CheckNumber   int    `json:"CheckNumber" binding:"required"`
+	CashierName   string `json:"CashierName"`
+	CashierINN    string `json:"CashierINN"`
+	CustomerEmail string `json:"CustomerEmail"`
+	CustomerPhone string `json:"CustomerPhone"`
+	//Позиции и количества к возврату, пусто - вернуть весь остаток чека
+	Positions []ReturnPosition `json:"Positions"`
+	//Оплаты возврата, не указаны - как в исходном чеке (при частичном возврате только для чека с одним видом оплаты)
+	Payments *CheckPayments `json:"Payments"`
+}
+
+//RECEIPTDAYS сколько дней хранить чек в локальном журнале после последнего изменения
+var RECEIPTDAYS = 180
+
+//vat1199 ставка НДС по коду тега 1199
+var vat1199 = map[int]string{1: "20", 2: "10", 3: "20/120", 4: "10/110", 5: "0", 6: "none"}
+
+func receiptKey(deviceID string, fd int) []byte {
+	return []byte(fmt.Sprintf("%s/%010d", deviceID, fd))
+}
+
+//initReceipts создаст хранилище журнала чеков и удалит устаревшие записи
+func initReceipts() error {
+	border := time.Now().AddDate(0, 0, -RECEIPTDAYS)
+	return DB.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("Receipts"))
+		if err != nil {
+			return err
+		}
+		var old [][]byte
+		b.ForEach(func(k, v []byte) error {
+			var rec ReceiptRecord
+			if json.Unmarshal(v, &rec) == nil && !rec.Saved.IsZero() && rec.Saved.Before(border) {
+				old = append(old, k)
+			}
+			return nil
+		})
+		for _, k := range old {
+			b.Delete(k)
+		}
+		return nil
+	})
+}
+
+func saveReceipt(rec *ReceiptRecord) error {
+	rec.Saved = time.Now()
+	v, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return DB.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("Receipts")).Put(receiptKey(rec.DeviceID, rec.CheckNumber), v)
+	})
+}
+
+//journalReceipt сохранит сформированный чек в локальный журнал для последующего возврата
+func journalReceipt(deviceID string, chk *CheckPackage, out CheckOutputParameters) {
+	rec := ReceiptRecord{DeviceID: deviceID, CheckNumber: out.CheckNumber, FiscalSign: out.FiscalSign, DateTime: out.DateTime, Source: "journal", Check: *chk}
+	if err := saveReceipt(&rec); err != nil {
+		log.Printf("журнал чеков %s: %v", deviceID, err)
+	}
+}
+
+//loadReceipt чек из локального журнала, при его отсутствии - из архива ФН, ккм должна быть занята вызывающим
+func loadReceipt(kkm *drv.KkmDrv, fd int) (ReceiptRecord, error) {
+	var rec ReceiptRecord
+	found := false
+	err := DB.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket([]byte("Receipts")).Get(receiptKey(kkm.DeviceID, fd))
+		if v == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(v, &rec)
+	})
+	if err != nil || found {
+		return rec, err
+	}
+	doctype, data, errcode, err := kkm.FNReadDocument(kkm.GetAdminPass(), uint32(fd))
+	if err != nil {
+		return rec, err
+	}
+	if errcode > 0 {
+		return rec, errors.New("ФД " + strconv.Itoa(fd) + ": " + kkm.ParseErrState(errcode))
+	}
+	if doctype != DocTypeCheck && doctype != DocTypeBSO {
+		return rec, errors.New("ФД " + strconv.Itoa(fd) + " не чек: " + tlv.DocumentTypeName(doctype))
+	}
+	rec = receiptFromFN(tlv.DecodeAll(data, kkm.TLVCodePage()))
+	rec.DeviceID = kkm.DeviceID
+	rec.CheckNumber = fd
+	rec.Check.Parameters.DocumentType = int(doctype)
+	return rec, nil
+}
+
+func fieldString(f tlv.Field) string {
+	switch v := f.Value.(type) {
+	case string:
+		return v
+	case int:
+		return strconv.Itoa(v)
+	case uint64:
+		return strconv.FormatUint(v, 10)
+	}
+	return ""
+}
+
+func fieldInt(f tlv.Field) int {
+	switch v := f.Value.(type) {
+	case int:
+		return v
+	case uint64:
+		return int(v)
+	}
+	return 0
+}
+
+func fieldFloat(f tlv.Field) float64 {
+	if v, ok := f.Value.(float64); ok {
+		return v
+	}
+	return 0
+}
+
+//receiptFromFN пакет чека по реквизитам документа из архива ФН
+func receiptFromFN(fields []tlv.Field) ReceiptRecord {
+	rec := ReceiptRecord{Source: "fn"}
+	p := &rec.Check.Parameters
+	for _, f := range fields {
+		switch f.Tag {
+		case 1012:
+			rec.DateTime = fieldString(f)
+		case 1077:
+			rec.FiscalSign = fieldString(f)
+		case 1054:
+			p.OperationType = fieldInt(f)
+		case 1055:
+			//система налогообложения в ФН - битовая маска
+			for ts := uint(0); ts <= 5; ts++ {
+				if fieldInt(f)&(1<<ts) != 0 {
+					p.TaxationSystem = int(ts)
+					break
+				}
+			}
+		case 1021:
+			p.CashierName = fieldString(f)
+		case 1203:
+			p.CashierINN = fieldString(f)
+		case 1008:
+			if strings.Contains(fieldString(f), "@") {
+				p.CustomerEmail = fieldString(f)
+			} else {
+				p.CustomerPhone = fieldString(f)
+			}
+		case 1031:
+			rec.Check.Payments.Cash = fieldFloat(f)
+		case 1081:
+			rec.Check.Payments.ElectronicPayment = fieldFloat(f)
+		case 1215:
+			rec.Check.Payments.PrePayment = fieldFloat(f)
+		case 1216:
+			rec.Check.Payments.PostPayment = fieldFloat(f)
+		case 1217:
+			rec.Check.Payments.Barter = fieldFloat(f)
+		case 1059:
+			rec.Check.Positions.FiscalString = append(rec.Check.Positions.FiscalString, positionFromFN(f.Children))
+		}
+	}
+	return rec
+}
+
+//joinPhone добавит телефон к списку через ",", как в пакете 1С
+func joinPhone(list, phone string) string {
+	if len(list) == 0 {
+		return phone
+	}
+	return list + "," + phone
+}
+
+//positionFromFN предмет расчета по реквизитам STLV 1059
+func positionFromFN(fields []tlv.Field) FiscalString {
+	var fs FiscalString
+	for _, f := range fields {
+		switch f.Tag {
+		case 1030:
+			fs.Name = fieldString(f)
+		case 1023:
+			fs.Quantity = fieldFloat(f)
+		case 1079:
+			fs.PriceWithDiscount = fieldFloat(f)
+		case 1043:
+			fs.AmountWithDiscount = fieldFloat(f)
+		case 1199:
+			fs.VATRate = vat1199[fieldInt(f)]
+		case 1200:
+			fs.VATAmount = fieldFloat(f)
+		case 1214:
+			fs.PaymentMethod = fieldInt(f)
+		case 1212:
+			fs.CalculationSubject = fieldInt(f)
+		case 1222:
+			fs.CalculationAgent = fieldInt(f)
+		case 1197:
+			fs.MeasurementUnit = fieldString(f)
+		case 1191:
+			fs.AdditionalAttribute = fieldString(f)
+		case 1229:
+			fs.ExciseAmount = fieldFloat(f)
+		case 1230:
+			fs.CountryOfOrigin = fieldString(f)
+		case 1231:
+			fs.CustomsDeclaration = fieldString(f)
+		case 1226:
+			fs.VendorData.VendorINN = fieldString(f)
+		case 1162:
+			//код товара хранится в ФН как есть, в пакете 1С - base64
+			if b, err := hex.DecodeString(fieldString(f)); err == nil {
+				fs.GoodCodeData.MarkingCode = base64.StdEncoding.EncodeToString(b)
+			}
+		case 1223:
+			for _, a := range f.Children {
+				switch a.Tag {
+				case 1044:
+					fs.AgentData.AgentOperation = fieldString(a)
+				case 1073:
+					fs.AgentData.AgentPhone = joinPhone(fs.AgentData.AgentPhone, fieldString(a))
+				case 1074:
+					fs.AgentData.PaymentProcessorPhone = joinPhone(fs.AgentData.PaymentProcessorPhone, fieldString(a))
+				case 1075:
+					fs.AgentData.AcquirerOperatorPhone = joinPhone(fs.AgentData.AcquirerOperatorPhone, fieldString(a))
+				case 1026:
+					fs.AgentData.AcquirerOperatorName = fieldString(a)
+				case 1005:
+					fs.AgentData.AcquirerOperatorAddress = fieldString(a)
+				case 1016:
+					fs.AgentData.AcquirerOperatorINN = fieldString(a)
+				}
+			}
+		case 1224:
+			for _, v := range f.Children {
+				switch v.Tag {
+				case 1171:
+					fs.VendorData.VendorPhone = joinPhone(fs.VendorData.VendorPhone, fieldString(v))
+				case 1225:
+					fs.VendorData.VendorName = fieldString(v)
+				}
+			}
+		}
+	}
+	//при формировании единица измерения дописывается к наименованию
+	if len(fs.MeasurementUnit) > 0 {
+		fs.Name = strings.TrimSuffix(fs.Name, " "+fs.MeasurementUnit)
+	}
+	return fs
+}
+
+//available количество позиции, доступное к возврату
+func (rec *ReceiptRecord) available(i int) float64 {
+	q := rec.Check.Positions.FiscalString[i].Quantity
+	if i < len(rec.Returned) {
+		q -= rec.Returned[i]
+	}
+	return math.Max(0, q)
+}
+
+//returned чек возврата fd уже учтен (повтор запроса по ключу)
+func (rec *ReceiptRecord) returned(fd int) bool {
+	for _, n := range rec.Returns {
+		if n == fd {
+			return true
+		}
+	}
+	return false
+}
+
+//returnIndexes позиции исходного чека для позиций чека возврата: совпадают наименование, цена, ставка НДС и код маркировки,
+//количество не больше еще не возвращенного. Возврат сверх проданного отклоняется
+func returnIndexes(rec *ReceiptRecord, chk *CheckPackage) ([]int, error) {
+	const eps = 1e-9
+	orig := rec.Check.Positions.FiscalString
+	optype := map[int]int{1: 2, 3: 4}[checkOperationType(&rec.Check.Parameters)]
+	if optype == 0 || optype != checkOperationType(&chk.Parameters) {
+		return nil, errors.New("ReturnOf: тип операции не является возвратом по чеку " + strconv.Itoa(rec.CheckNumber))
+	}
+	left := make([]float64, len(orig))
+	for i := range orig {
+		left[i] = rec.available(i)
+	}
+	idx := make([]int, len(chk.Positions.FiscalString))
+	for n, fs := range chk.Positions.FiscalString {
+		idx[n] = -1
+		for i, o := range orig {
+			if o.Name == fs.Name && o.VATRate == fs.VATRate && math.Abs(o.PriceWithDiscount-fs.PriceWithDiscount) < 0.005 &&
+				o.GoodCodeData.MarkingCode == fs.GoodCodeData.MarkingCode && fs.Quantity <= left[i]+eps {
+				idx[n] = i
+				left[i] -= fs.Quantity
+				break
+			}
+		}
+		if idx[n] < 0 {
+			return nil, errors.New("FiscalString[" + strconv.Itoa(n+1) + "] " + fs.Name + ": нет в чеке " + strconv.Itoa(rec.CheckNumber) +
+				" или количество больше не возвращенного")
+		}
+	}
+	return idx, nil
+}
+
+//recordReturn учтет чек возврата fd в журнале исходного чека, idx - позиции исходного чека (returnIndexes)
+func recordReturn(rec *ReceiptRecord, chk *CheckPackage, idx []int, fd int) {
+	if rec.returned(fd) {
+		return
+	}
+	n := len(rec.Check.Positions.FiscalString)
+	for len(rec.Returned) < n {
+		rec.Returned = append(rec.Returned, 0)
+		rec.ReturnedAmount = append(rec.ReturnedAmount, 0)
+	}
+	for k, i := range idx {
+		fs := chk.Positions.FiscalString[k]
+		rec.Returned[i] += fs.Quantity
+		rec.ReturnedAmount[i] = round2(rec.ReturnedAmount[i] + fs.AmountWithDiscount)
+	}
+	rec.Returns = append(rec.Returns, fd)
+	if err := saveReceipt(rec); err != nil {
+		log.Printf("журнал чеков %s: %v", rec.DeviceID, err)
+	}
+}
+
+//buildReturn пакет чека возврата по исходному чеку, суммы позиций пропорциональны количеству
+func buildReturn(rec *ReceiptRecord, req *ReturnRequest) (CheckPackage, []ReturnPosition, error) {
+	const eps = 1e-9
+	orig := rec.Check
+	optype := map[int]int{1: 2, 3: 4}[checkOperationType(&orig.Parameters)]
+	if optype == 0 {
+		return CheckPackage{}, nil, errors.New("возврат возможен только по чеку прихода или расхода")
+	}
+	positions := req.Positions
+	if len(positions) == 0 {
+		for i := range orig.Positions.FiscalString {
+			if q := rec.available(i); q > eps {
+				positions = append(positions, ReturnPosition{Index: i, Quantity: q})
+			}
+		}
+		if len(positions) == 0 {
+			return CheckPackage{}, nil, errors.New("по чеку " + strconv.Itoa(rec.CheckNumber) + " все позиции уже возвращены")
+		}
+	}
+	chk := CheckPackage{Parameters: orig.Parameters}
+	chk.Parameters.OperationType = optype
+	//возврат учитывается в журнале исходного чека при формировании (fiscalizeCheck)
+	chk.Parameters.ReturnOf = rec.CheckNumber
+	chk.Parameters.PaymentType = 0
+	if len(req.CashierName) > 0 {
+		chk.Parameters.CashierName = req.CashierName
+		chk.Parameters.CashierINN = req.CashierINN
+	}
+	if len(req.CustomerEmail) > 0 || len(req.CustomerPhone) > 0 {
+		chk.Parameters.CustomerEmail = req.CustomerEmail
+		chk.Parameters.CustomerPhone = req.CustomerPhone
+	}
+	seen := make(map[int]bool)
+	var total, origTotal float64
+	whole := true
+	for _, rp := range positions {
+		pos := "позиция " + strconv.Itoa(rp.Index) + ": "
+		if rp.Index < 0 || rp.Index >= len(orig.Positions.FiscalString) {
+			return CheckPackage{}, nil, errors.New(pos + "нет в чеке " + strconv.Itoa(rec.CheckNumber))
+		}
+		if seen[rp.Index] {
+			return CheckPackage{}, nil, errors.New(pos + "указана повторно")
+		}
+		seen[rp.Index] = true
+		fs := orig.Positions.FiscalString[rp.Index]
+		avail := rec.available(rp.Index)
+		if rp.Quantity <= 0 {
+			return CheckPackage{}, nil, errors.New(pos + "количество должно быть больше 0")
+		}
+		if rp.Quantity > avail+eps {
+			return CheckPackage{}, nil, errors.New(pos + "к возврату " + strconv.FormatFloat(rp.Quantity, 'f', -1, 64) +
+				", доступно " + strconv.FormatFloat(avail, 'f', -1, 64) + " из проданных " + strconv.FormatFloat(fs.Quantity, 'f', -1, 64))
+		}
+		if len(fs.GoodCodeData.MarkingCode) > 0 && math.Abs(rp.Quantity-fs.Quantity) > eps {
+			return CheckPackage{}, nil, errors.New(pos + "маркированный товар возвращается только целиком")
+		}
+		ret := fs
+		ret.Quantity = rp.Quantity
+		if math.Abs(rp.Quantity-avail) <= eps {
+			//остаток позиции: сумма без накопленной ошибки округления
+			ret.AmountWithDiscount = fs.AmountWithDiscount
+			if rp.Index < len(rec.ReturnedAmount) {
+				ret.AmountWithDiscount = round2(fs.AmountWithDiscount - rec.ReturnedAmount[rp.Index])
+			}
+		} else {
+			ret.AmountWithDiscount = round2(fs.AmountWithDiscount * rp.Quantity / fs.Quantity)
+		}
+		if fs.AmountWithDiscount != 0 {
+			ret.VATAmount = round2(fs.VATAmount * ret.AmountWithDiscount / fs.AmountWithDiscount)
+			ret.ExciseAmount = round2(fs.ExciseAmount * ret.AmountWithDiscount / fs.AmountWithDiscount)
+		}
+		if math.Abs(ret.AmountWithDiscount-fs.AmountWithDiscount) > eps {
+			whole = false
+		}
+		total += ret.AmountWithDiscount
+		chk.Positions.FiscalString = append(chk.Positions.FiscalString, ret)
+	}
+	for _, fs := range orig.Positions.FiscalString {
+		origTotal += fs.AmountWithDiscount
+	}
+	total = round2(total)
+	switch {
+	case req.Payments != nil:
+		chk.Payments = *req.Payments
+	case whole && len(positions) == len(orig.Positions.FiscalString) && math.Abs(total-round2(origTotal)) < 0.005:
+		chk.Payments = orig.Payments
+	default:
+		//частичный возврат тем же видом оплаты, что и исходный чек
+		var p CheckPayments
+		dst := []*float64{&p.Cash, &p.ElectronicPayment, &p.PrePayment, &p.PostPayment, &p.Barter}
+		kind := -1
+		for i, v := range []float64{orig.Payments.Cash, orig.Payments.ElectronicPayment, orig.Payments.PrePayment, orig.Payments.PostPayment, orig.Payments.Barter} {
+			if v > 0 {
+				if kind >= 0 {
+					return CheckPackage{}, nil, errors.New("исходный чек оплачен несколькими видами оплаты, укажите Payments возврата")
+				}
+				kind = i
+			}
+		}
+		if kind < 0 {
+			kind = 0
+		}
+		*dst[kind] = total
+		chk.Payments = p
+	}
+	return chk, positions, nil
+}
+
+//getReturnCheck позиции исходного чека с количествами, доступными к возврату, ?CheckNumber= номер ФД
+func getReturnCheck(c *gin.Context) {
+	deviceID := c.Param("DeviceID")
+	kkm, err := KkmServ.GetDrv(deviceID)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"error": true, "message": "deviceID не зарегистрирован"})
+		return
+	}
+	fd, err := getIntParam(c, "CheckNumber", 0)
+	if err != nil || fd <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": true, "message": "не указан CheckNumber (номер ФД чека)"})
+		return
+	}
+	if kkm.ChkBusy(0) {
+		c.JSON(http.StatusOK, gin.H{"error": true, "message": "ККТ занята"})
+		return
+	}
+	//займем ккм
+	procid := int(time.Now().Unix())
+	kkm.SetBusy(procid)
+	//освободим по завершению
+	defer kkm.SetBusy(0)
+
+	rec, err := loadReceipt(kkm, fd)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"error": true, "message": err.Error()})
+		return
+	}
+	avail := make([]float64, len(rec.Check.Positions.FiscalString))
+	for i := range avail {
+		avail[i] = rec.available(i)
+	}
+	c.JSON(http.StatusOK, gin.H{"error": false, "message": "ok", "receipt": rec, "available": avail})
+}
+
+//returnCheck чек возврата по исходному чеку (номер ФД) с теми же ставками НДС, кодами маркировки и данными агента
+func returnCheck(c *gin.Context) {
+	/*
+		{"CheckNumber":125,"CashierName":"Иванов И.П.","Positions":[{"Index":0,"Quantity":1}]}
+		Positions не указаны - возврат всего остатка чека; Payments не указаны - как в исходном чеке
+	*/
+	var req ReturnRequest
+	deviceID := c.Param("DeviceID")
+	kkm, err := KkmServ.GetDrv(deviceID)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"error": true, "message": "deviceID не зарегистрирован"})
+		return
+	}
+	if err = c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": true, "message": "bad request " + err.Error()})
+		return
+	}
+	key := requestKey(c)
+	if len(key) > 0 {
+		//повтор запроса: вернем прежний результат до проверки остатков
+		if r, found, _ := loadCheckRequest(deviceID, key); found && r.State == CheckRequestDone {
+			c.JSON(http.StatusOK, gin.H{"error": false, "message": "ok", "ReturnOf": req.CheckNumber, "CheckNumber": r.Result.CheckNumber,
+				"FiscalSign": r.Result.FiscalSign, "DateTime": r.Result.DateTime, "ShiftNumber": r.Result.ShiftNumber})
+			return
+		}
+	}
+	if kkm.ChkBusy(0) {
+		c.JSON(http.StatusOK, gin.H{"error": true, "message": "ККТ занята"})
+		return
+	}
+	//займем ккм
+	procid := int(time.Now().Unix())
+	kkm.SetBusy(procid)
+	//освободим по завершению
+	defer kkm.SetBusy(0)
+
+	rec, err := loadReceipt(kkm, req.CheckNumber)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"error": true, "message": err.Error()})
+		return
+	}
+	chk, positions, err := buildReturn(&rec, &req)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"error": true, "message": err.Error()})
+		return
+	}
+	out, err := fiscalizeOnce(kkm, key, &chk)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"error": true, "message": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"error": false, "message": "ok", "ReturnOf": rec.CheckNumber, "CheckNumber": out.CheckNumber,
+		"FiscalSign": out.FiscalSign, "DateTime": out.DateTime, "ShiftNumber": out.ShiftNumber, "Positions": positions})
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"math"
+)
+
+//Политика округления суммы чека, округление всегда в пользу покупателя (вниз)
+const (
+	//RoundNone без округления
+	RoundNone = "none"
+	//RoundRuble до рубля
+	RoundRuble = "ruble"
+	//Round10 до 10 копеек
+	Round10 = "10"
+	//Round50 до 50 копеек
+	Round50 = "50"
+)
+
+//roundSteps шаг округления в копейках
+var roundSteps = map[string]int64{RoundNone: 0, "": 0, RoundRuble: 100, Round10: 10, Round50: 50}
+
+//roundingPolicy политика округления: из пакета чека, иначе из настройки ККТ
+func roundingPolicy(deviceID string, p *CheckParameters) string {
+	if len(p.Rounding) > 0 {
+		return p.Rounding
+	}
+	if kkm, err := KkmServ.GetDrv(deviceID); err == nil {
+		return kkm.GetParam().Rounding
+	}
+	return RoundNone
+}
+
+//checkRounding скидка округления суммы чека total в рублях.
+//ФН проверяет, что подытог (сумма тегов 1043) в рублях равен тегу 1020 в рублях, поэтому скидка меньше рубля.
+//Если безналичные оплаты покрывают сумму после округления, чек не округляется.
+func checkRounding(policy string, total float64, pay CheckPayments) (float64, error) {
+	step, ok := roundSteps[policy]
+	if !ok {
+		return 0, errors.New("Rounding: политика округления должна быть none, ruble, 10 или 50")
+	}
+	if step == 0 {
+		return 0, nil
+	}
+	kop := int64(math.Round(total * 100))
+	rnd := kop % step
+	cashless := int64(math.Round((pay.ElectronicPayment + pay.PrePayment + pay.PostPayment + pay.Barter) * 100))
+	if rnd == 0 || cashless > kop-rnd {
+		return 0, nil
+	}
+	return float64(rnd) / 100, nil
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"kkm-shtrih/drv"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	bolt "go.etcd.io/bbolt"
+)
+
+//SHIFTCHECKINTERVAL интервал проверки расписания закрытия смен
+var SHIFTCHECKINTERVAL = 30 * time.Second
+
+//SHIFTRETRYINTERVAL пауза перед повтором закрытия смены по расписанию после ошибки
+var SHIFTRETRYINTERVAL = 15 * time.Minute
+
+//Действие при обнаружении истекшей смены перед чеком
+const (
+	//ShiftExpiredAlert только сообщить, чек не формируется
+	ShiftExpiredAlert = "alert"
+	//ShiftExpiredReopen закрыть истекшую смену и открыть новую
+	ShiftExpiredReopen = "reopen"
+)
+
+//ShiftPolicy политика автоматической работы со сменой ККТ
+type ShiftPolicy struct {
+	DeviceID string `json:"deviceID"`
+	//Действие при истекшей смене перед чеком: alert, reopen
+	OnExpired string `json:"onExpired"`
+	//Время автоматического закрытия смены ЧЧ:ММ местного времени, пусто - не закрывать
+	CloseAt string `json:"closeAt"`
+	//Кассир для автоматических отчетов
+	CashierName string `json:"cashierName"`
+	CashierINN  string `json:"cashierINN"`
+	//Дата последнего закрытия по расписанию ГГГГ-ММ-ДД
+	LastScheduled string `json:"lastScheduled"`
+	//Повтор закрытия по расписанию после ошибки не раньше RetryAt, ошибка пишется в журнал раз в день FailedOn
+	RetryAt  time.Time `json:"retryAt"`
+	FailedOn string    `json:"failedOn"`
+}
+
+//ShiftEvent запись журнала автоматических действий со сменой
+type ShiftEvent struct {
+	Time     time.Time `json:"time"`
+	DeviceID string    `json:"deviceID"`
+	//Причина: schedule - расписание, expired - истекшая смена перед чеком
+	Trigger string `json:"trigger"`
+	//Действие: close, open, alert
+	Action         string `json:"action"`
+	ShiftNumber    int    `json:"shiftNumber"`
+	DocumentNumber int    `json:"documentNumber"`
+	Error          bool   `json:"error"`
+	Message        string `json:"message"`
+}
+
+//ShiftPolicies политики смен всех ККТ
+type ShiftPolicies struct {
+	mu  sync.Mutex
+	pol map[string]ShiftPolicy
+}
+
+//ShiftPol экземпляр политик смен
+var ShiftPol = ShiftPolicies{pol: make(map[string]ShiftPolicy)}
+
+//Load читает политики смен из базы
+func (p *ShiftPolicies) Load() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return DB.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists([]byte("ShiftEvents")); err != nil {
+			return err
+		}
+		b, err := tx.CreateBucketIfNotExists([]byte("ShiftPolicy"))
+		if err != nil {
+			return err
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var sp ShiftPolicy
+			if err := json.Unmarshal(v, &sp); err != nil {
+				return err
+			}
+			p.pol[string(k)] = sp
+			return nil
+		})
+	})
+}
+
+//Get вернет политику смены ККТ, по умолчанию только сообщение об истекшей смене
+func (p *ShiftPolicies) Get(deviceID string) ShiftPolicy {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	sp, ok := p.pol[deviceID]
+	if !ok {
+		sp = ShiftPolicy{DeviceID: deviceID, OnExpired: ShiftExpiredAlert}
+	}
+	return sp
+}
+
+//Set сохранит политику смены ККТ
+func (p *ShiftPolicies) Set(sp ShiftPolicy) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	v, err := json.Marshal(sp)
+	if err != nil {
+		return err
+	}
+	err = DB.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("ShiftPolicy")).Put([]byte(sp.DeviceID), v)
+	})
+	if err != nil {
+		return err
+	}
+	p.pol[sp.DeviceID] = sp
+	return nil
+}
+
+//putEvent запишет событие в журнал bucket и удалит записи старше EVENTDAYS дней,
+//ключ - время UTC RFC3339Nano и deviceID, поэтому старые записи идут первыми
+func putEvent(b *bolt.Bucket, t time.Time, deviceID string, v []byte) error {
+	border := []byte(t.AddDate(0, 0, -EVENTDAYS).UTC().Format(time.RFC3339Nano))
+	var old [][]byte
+	c := b.Cursor()
+	for k, _ := c.First(); k != nil && bytes.Compare(k, border) < 0; k, _ = c.Next() {
+		old = append(old, k)
+	}
+	for _, k := range old {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+	return b.Put([]byte(t.UTC().Format(time.RFC3339Nano)+" "+deviceID), v)
+}
+
+//recordShiftEvent запишет автоматическое действие в журнал
+func recordShiftEvent(ev ShiftEvent) {
+	ev.Time = time.Now()
+	log.Printf("смена %s [%s/%s]: %s", ev.DeviceID, ev.Trigger, ev.Action, ev.Message)
+	v, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	err = DB.Update(func(tx *bolt.Tx) error {
+		return putEvent(tx.Bucket([]byte("ShiftEvents")), ev.Time, ev.DeviceID, v)
+	})
+	if err != nil {
+		log.Printf("журнал смен: %v", err)
+	}
+}
+
+//autoCloseShift закроет смену и запишет результат в журнал, ккм должна быть занята вызывающим
+func autoCloseShift(kkm *drv.KkmDrv, sp ShiftPolicy, trigger string) error {
+	res, _, err := kkm.FNCloseShift(kkm.GetAdminPass(), sp.CashierName, sp.CashierINN)
+	ev := ShiftEvent{DeviceID: kkm.DeviceID, Trigger: trigger, Action: "close", ShiftNumber: int(res.ShiftNumber), DocumentNumber: int(res.DocumentNumber)}
+	if err != nil {
+		ev.Error = true
+		ev.Message = "ошибка закрытия смены: " + err.Error()
+	} else {
+		ev.Message = "смена " + strconv.Itoa(ev.ShiftNumber) + " закрыта, ФД " + strconv.Itoa(ev.DocumentNumber)
+	}
+	recordShiftEvent(ev)
+	return err
+}
+
+//autoOpenShift откроет смену и запишет результат в журнал, ккм должна быть занята вызывающим
+func autoOpenShift(kkm *drv.KkmDrv, sp ShiftPolicy, trigger string) error {
+	res, _, err := kkm.FNOpenShift(kkm.GetAdminPass(), sp.CashierName, sp.CashierINN)
+	ev := ShiftEvent{DeviceID: kkm.DeviceID, Trigger: trigger, Action: "open", ShiftNumber: int(res.ShiftNumber), DocumentNumber: int(res.DocumentNumber)}
+	if err != nil {
+		ev.Error = true
+		ev.Message = "ошибка открытия смены: " + err.Error()
+	} else {
+		ev.Message = "смена " + strconv.Itoa(ev.ShiftNumber) + " открыта, ФД " + strconv.Itoa(ev.DocumentNumber)
+	}
+	recordShiftEvent(ev)
+	return err
+}
+
+//handleExpiredShift обработает истекшую смену перед чеком по политике ККТ
+func handleExpiredShift(kkm *drv.KkmDrv) error {
+	sp := ShiftPol.Get(kkm.DeviceID)
+	if sp.OnExpired != ShiftExpiredReopen {
+		recordShiftEvent(ShiftEvent{DeviceID: kkm.DeviceID, Trigger: "expired", Action: "alert", Error: true, Message: "смена истекла, чек не сформирован"})
+		return errors.New("Смена истекла, необходимо закрытие")
+	}
+	if err := autoCloseShift(kkm, sp, "expired"); err != nil {
+		return err
+	}
+	return autoOpenShift(kkm, sp, "expired")
+}
+
+//shiftExpired проверит режим ККТ: открытая смена, 24 часа кончились
+func shiftExpired(kkm *drv.KkmDrv) bool {
+	state, err := kkm.GetStatus()
+	return err == nil && state == 3
+}
+
+//scheduledClose закроет смену по расписанию, если время наступило и ККТ свободна
+func scheduledClose(sp ShiftPolicy, now time.Time) {
+	at, err := time.ParseInLocation("15:04", sp.CloseAt, time.Local)
+	if err != nil {
+		return
+	}
+	today := now.Format("2006-01-02")
+	if sp.LastScheduled == today || now.Hour()*60+now.Minute() < at.Hour()*60+at.Minute() || now.Before(sp.RetryAt) {
+		return
+	}
+	kkm, err := KkmServ.GetDrv(sp.DeviceID)
+	if err != nil || kkm.ChkBusy(0) {
+		//ККТ занята, попробуем при следующей проверке
+		return
+	}
+	//займем ккм
+	procid := int(time.Now().Unix())
+	kkm.SetBusy(procid)
+	//освободим по завершению
+	defer kkm.SetBusy(0)
+	if errcode, err := kkm.FNGetStatus(); err != nil || errcode > 0 {
+		if sp.FailedOn != today {
+			recordShiftEvent(ShiftEvent{DeviceID: sp.DeviceID, Trigger: "schedule", Action: "close", Error: true, Message: "нет связи с ФН, закрытие смены отложено"})
+		}
+		scheduleRetry(sp, now)
+		return
+	}
+	if kkm.FNGetFNState().FNSessionState == 0 {
+		recordShiftEvent(ShiftEvent{DeviceID: sp.DeviceID, Trigger: "schedule", Action: "close", Message: "смена уже закрыта"})
+	} else if err := autoCloseShift(kkm, sp, "schedule"); err != nil {
+		scheduleRetry(sp, now)
+		return
+	}
+	sp.LastScheduled = today
+	sp.RetryAt, sp.FailedOn = time.Time{}, ""
+	if err := ShiftPol.Set(sp); err != nil {
+		log.Printf("политика смены %s: %v", sp.DeviceID, err)
+	}
+}
+
+//scheduleRetry отложит повтор закрытия смены по расписанию на SHIFTRETRYINTERVAL
+func scheduleRetry(sp ShiftPolicy, now time.Time) {
+	sp.RetryAt = now.Add(SHIFTRETRYINTERVAL)
+	sp.FailedOn = now.Format("2006-01-02")
+	if err := ShiftPol.Set(sp); err != nil {
+		log.Printf("политика смены %s: %v", sp.DeviceID, err)
+	}
+}
+
+//runShiftScheduler фоновое закрытие смен по расписанию
+func runShiftScheduler() {
+	for {
+		now := time.Now()
+		ShiftPol.mu.Lock()
+		list := make([]ShiftPolicy, 0, len(ShiftPol.pol))
+		for _, sp := range ShiftPol.pol {
+			if len(sp.CloseAt) > 0 {
+				list = append(list, sp)
+			}
+		}
+		ShiftPol.mu.Unlock()
+		for _, sp := range list {
+			scheduledClose(sp, now)
+		}
+		time.Sleep(SHIFTCHECKINTERVAL)
+	}
+}
+
+//getShiftPolicy политика смены ККТ
+func getShiftPolicy(c *gin.Context) {
+	deviceID := c.Param("DeviceID")
+	if _, err := KkmServ.GetDrv(deviceID); err != nil {
+		c.JSON(http.StatusOK, gin.H{"error": true, "message": "deviceID не зарегистрирован"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"error": false, "policy": ShiftPol.Get(deviceID)})
+}
+
+//setShiftPolicy установка политики смены ККТ
+func setShiftPolicy(c *gin.Context) {
+	/*
+		PUT ShiftPolicy/<DeviceID>
+		{"onExpired":"reopen","closeAt":"23:50","cashierName":"Администратор"}
+		onExpired: alert - только сообщение (по умолчанию), reopen - закрыть истекшую смену и открыть новую перед чеком
+		closeAt: время ежедневного закрытия смены (Z-отчет), пусто - не закрывать
+	*/
+	deviceID := c.Param("DeviceID")
+	kkm, err := KkmServ.GetDrv(deviceID)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"error": true, "message": "deviceID не зарегистрирован"})
+		return
+	}
+	var sp ShiftPolicy
+	if err := c.ShouldBindJSON(&sp); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": true, "message": "bad request " + err.Error()})
+		return
+	}
+	sp.DeviceID = deviceID
+	switch sp.OnExpired {
+	case "":
+		sp.OnExpired = ShiftExpiredAlert
+	case ShiftExpiredAlert, ShiftExpiredReopen:
+	default:
+		c.JSON(http.StatusOK, gin.H{"error": true, "message": "onExpired должен быть alert или reopen"})
+		return
+	}
+	if len(sp.CloseAt) > 0 {
+		if _, err := time.Parse("15:04", sp.CloseAt); err != nil {
+			c.JSON(http.StatusOK, gin.H{"error": true, "message": "closeAt должно быть в формате ЧЧ:ММ"})
+			return
+		}
+	}
+	//кассир передается в отчеты смены без участия клиента, проверим его заранее в кодировке ККТ
+	if err = checkCashierTags(kkm, sp.CashierName, sp.CashierINN); err != nil {
+		c.JSON(http.StatusOK, gin.H{"error": true, "message": err.Error()})
+		return
+	}
+	sp.LastScheduled = ShiftPol.Get(deviceID).LastScheduled
+	if err := ShiftPol.Set(sp); err != nil {
+		c.JSON(http.StatusOK, gin.H{"error": true, "message": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"error": false, "message": "ok", "policy": sp})
+}
+
+//getShiftEvents журнал автоматических действий со сменами, ?DeviceID= фильтр, ?limit= количество последних записей
+func getShiftEvents(c *gin.Context) {
+	deviceID := c.Query("DeviceID")
+	limit, err := getIntParam(c, "limit", 100)
+	if err != nil || limit <= 0 {
+		limit = 100
+	}
+	events := make([]ShiftEvent, 0, limit)
+	err = DB.View(func(tx *bolt.Tx) error {
+		cur := tx.Bucket([]byte("ShiftEvents")).Cursor()
+		for k, v := cur.Last(); k != nil && len(events) < limit; k, v = cur.Prev() {
+			var ev ShiftEvent
+			if err := json.Unmarshal(v, &ev); err != nil {
+				continue
+			}
+			if len(deviceID) == 0 || ev.DeviceID == deviceID {
+				events = append(events, ev)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"error": true, "message": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"error": false, "events": events})
+}
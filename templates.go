@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	bolt "go.etcd.io/bbolt"
+)
+
+/*
+	Шаблоны печати ККТ (text/template), результат - текст с разметкой (textmarkup.go).
+	Действия шаблона в скобках [[ ]], а не {{ }}: "{{" в разметке - символ "{".
+	header - печатается после открытия чека и в начале текстового документа,
+	footer - перед закрытием чека и в конце текстового документа,
+	остальные имена - макеты текстовых документов (PrintTextDocument Template="<имя>").
+	Данные шаблона: .DeviceID .Time .Cashier .CashierINN .Customer .Total, .Data.<Name> - TemplateData запроса.
+	Функции: money - сумма с 2 знаками, date - дата и время ДД.ММ.ГГГГ ЧЧ:ММ.
+	Данные запроса печатаются как текст: "{" в них не начинает директиву, перевод строки заменяется пробелом.
+	Пример: {b}{c}ЗАКАЗ [[.Data.OrderNumber]]\n{sep}\nБаллы: [[.Data.Bonus]]
+*/
+
+//Имена шаблонов, печатаемых вокруг документов
+const (
+	//TemplateHeader шаблон заголовка
+	TemplateHeader = "header"
+	//TemplateFooter шаблон подвала
+	TemplateFooter = "footer"
+)
+
+//PrintTemplate шаблон печати ККТ
+type PrintTemplate struct {
+	DeviceID string    `json:"deviceID"`
+	Name     string    `json:"name"`
+	Text     string    `json:"text"`
+	Updated  time.Time `json:"updated"`
+}
+
+//TemplateValue значение данных шаблона из запроса
+type TemplateValue struct {
+	Name  string `xml:"Name,attr" json:"Name"`
+	Value string `xml:"Value,attr" json:"Value"`
+}
+
+//TemplateContext данные для заполнения шаблона
+type TemplateContext struct {
+	DeviceID   string
+	Time       time.Time
+	Cashier    string
+	CashierINN string
+	//Email или телефон покупателя
+	Customer string
+	Total    float64
+	Data     map[string]string
+}
+
+var templateFuncs = template.FuncMap{
+	"money": func(v float64) string { return strconv.FormatFloat(v, 'f', 2, 64) },
+	"date":  func(t time.Time) string { return t.Format("02.01.2006 15:04") },
+}
+
+//initTemplates создаст хранилище шаблонов
+func initTemplates() error {
+	return DB.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte("Templates"))
+		return err
+	})
+}
+
+func templateKey(deviceID, name string) []byte {
+	return []byte(deviceID + "/" + name)
+}
+
+func loadTemplate(deviceID, name string) (PrintTemplate, bool, error) {
+	var t PrintTemplate
+	found := false
+	err := DB.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket([]byte("Templates")).Get(templateKey(deviceID, name))
+		if v == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(v, &t)
+	})
+	return t, found, err
+}
+
+//parseTemplate разбор шаблона с разделителями [[ ]], чтобы "{{" оставалось экранированием разметки
+func parseTemplate(name, text string) (*template.Template, error) {
+	return template.New(name).Delims("[[", "]]").Funcs(templateFuncs).Option("missingkey=zero").Parse(text)
+}
+
+//newTemplateContext данные шаблона: значения запроса и время печати
+func newTemplateContext(deviceID string, values []TemplateValue) TemplateContext {
+	ctx := TemplateContext{DeviceID: deviceID, Time: time.Now(), Data: make(map[string]string, len(values))}
+	for _, v := range values {
+		ctx.Data[v.Name] = v.Value
+	}
+	return ctx
+}
+
+//checkTemplateContext данные шаблона чека
+func checkTemplateContext(deviceID string, chk *CheckPackage, total float64) TemplateContext {
+	p := &chk.Parameters
+	ctx := newTemplateContext(deviceID, p.TemplateData)
+	ctx.Cashier = p.CashierName
+	ctx.CashierINN = p.CashierINN
+	ctx.Customer = p.CustomerEmail
+	if len(ctx.Customer) == 0 {
+		ctx.Customer = p.CustomerPhone
+	}
+	ctx.Total = total
+	return ctx
+}
+
+//renderTemplate заполнит шаблон ККТ и разберет разметку, шаблона нет - пустой результат
+func renderTemplate(deviceID, name string, ctx TemplateContext) ([]TextLine, error) {
+	t, found, err := loadTemplate(deviceID, name)
+	if err != nil || !found {
+		return nil, err
+	}
+	tpl, err := parseTemplate(name, t.Text)
+	if err != nil {
+		return nil, errors.New("шаблон " + name + ": " + err.Error())
+	}
+	var buf bytes.Buffer
+	if err = tpl.Execute(&buf, escapeContext(ctx)); err != nil {
+		return nil, errors.New("шаблон " + name + ": " + err.Error())
+	}
+	lines, err := parseMarkup(strings.TrimRight(buf.String(), "\r\n"))
+	if err != nil {
+		return nil, errors.New("шаблон " + name + ": " + err.Error())
+	}
+	for i := range lines {
+		lines[i].Text = strings.Replace(lines[i].Text, markupBrace, "{", -1)
+	}
+	return lines, nil
+}
+
+//markupBrace замена "{" в данных шаблона на время разбора разметки (символ из области частного использования)
+const markupBrace = "\uE07B"
+
+//escapeMarkup данные запроса как текст: без директив разметки и переводов строк
+func escapeMarkup(s string) string {
+	s = strings.Replace(s, "{", markupBrace, -1)
+	return strings.NewReplacer("\r\n", " ", "\n", " ", "\r", " ").Replace(s)
+}
+
+//escapeContext копия данных шаблона с экранированными значениями запроса
+func escapeContext(ctx TemplateContext) TemplateContext {
+	data := make(map[string]string, len(ctx.Data))
+	for k, v := range ctx.Data {
+		data[k] = escapeMarkup(v)
+	}
+	ctx.Data = data
+	ctx.Cashier = escapeMarkup(ctx.Cashier)
+	ctx.CashierINN = escapeMarkup(ctx.CashierINN)
+	ctx.Customer = escapeMarkup(ctx.Customer)
+	return ctx
+}
+
+//getTemplates шаблоны печати ККТ
+func getTemplates(c *gin.Context) {
+	deviceID := c.Param("DeviceID")
+	templates := make([]PrintTemplate, 0)
+	err := DB.View(func(tx *bolt.Tx) error {
+		cur := tx.Bucket([]byte("Templates")).Cursor()
+		prefix := templateKey(deviceID, "")
+		for k, v := cur.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = cur.Next() {
+			var t PrintTemplate
+			if json.Unmarshal(v, &t) == nil {
+				templates = append(templates, t)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"error": true, "message": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"error": false, "message": "ok", "templates": templates})
+}
+
+//setTemplate сохранит шаблон печати ККТ, тело запроса - текст шаблона
+func setTemplate(c *gin.Context) {
+	deviceID := c.Param("DeviceID")
+	if _, err := KkmServ.GetDrv(deviceID); err != nil {
+		c.JSON(http.StatusOK, gin.H{"error": true, "message": "deviceID не зарегистрирован"})
+		return
+	}
+	name := c.Param("Name")
+	text, err := c.GetRawData()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": true, "message": err.Error()})
+		return
+	}
+	//проверим шаблон на пустых данных
+	tpl, err := parseTemplate(name, string(text))
+	if err == nil {
+		var buf bytes.Buffer
+		if err = tpl.Execute(&buf, newTemplateContext(deviceID, nil)); err == nil {
+			_, err = parseMarkup(strings.TrimRight(buf.String(), "\r\n"))
+		}
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": true, "message": err.Error()})
+		return
+	}
+	t := PrintTemplate{DeviceID: deviceID, Name: name, Text: string(text), Updated: time.Now()}
+	v, err := json.Marshal(t)
+	if err == nil {
+		err = DB.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket([]byte("Templates")).Put(templateKey(deviceID, name), v)
+		})
+	}
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"error": true, "message": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"error": false, "message": "ok", "template": t})
+}
+
+//deleteTemplate удалит шаблон печати ККТ
+func deleteTemplate(c *gin.Context) {
+	deviceID := c.Param("DeviceID")
+	name := c.Param("Name")
+	_, found, err := loadTemplate(deviceID, name)
+	if err == nil && !found {
+		err = errors.New("шаблон " + name + " не найден")
+	}
+	if err == nil {
+		err = DB.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket([]byte("Templates")).Delete(templateKey(deviceID, name))
+		})
+	}
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"error": true, "message": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"error": false, "message": "ok"})
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"errors"
+	"kkm-shtrih/drv"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+/*
+	Разметка текста нефискальных документов (PrintTextDocument, PrintString).
+	Директивы в фигурных скобках в начале строки, остаток строки - текст:
+		{b}				жирный шрифт kkmparam fontbold; если он не задан, отдельного жирного начертания нет
+						и строка печатается командой 12H (жирная строка ККТ Штрих - это двойная ширина)
+		{dw}			двойная ширина (команда 12H)
+		{dh}			двойная высота - шрифт kkmparam fontdh, если не задан - двойная ширина
+		{f N}			шрифт N (команда 2FH)
+		{l} {c} {r}		выравнивание влево, по центру, вправо
+	Директивы всей строки, текст после них не печатается:
+		{sep} {sep =}	разделитель на всю ширину строки (по умолчанию "-")
+		{cut} {cut partial}	полная или неполная отрезка
+		{feed N}		протяжка на N строк
+	Символ "{" в начале текста - "{{" (в шаблонах действия text/template в скобках [[ ]], templates.go). Пример: "{b}{c}ЗАКАЗ 15"
+*/
+
+//TextLine строка текста с разметкой
+type TextLine struct {
+	//text, sep, cut, feed
+	Kind string
+	Text string
+	//Шрифт двойной ширины
+	Wide         bool
+	Bold         bool
+	DoubleHeight bool
+	Font         int
+	//l, c, r
+	Align string
+	//Количество строк протяжки, для отрезки 1 - неполная
+	Count int
+}
+
+//tapeFlags лента печати: receipt - чековая, control - контрольная, both или не указано - обе
+func tapeFlags(tape string) (byte, error) {
+	switch tape {
+	case "", "both":
+		return drv.TapeBoth, nil
+	case "receipt":
+		return drv.TapeReceipt, nil
+	case "control":
+		return drv.TapeControl, nil
+	}
+	return 0, errors.New("Tape: лента должна быть receipt, control или both")
+}
+
+//parseMarkup разбор текста с разметкой, строки разделяются переводом строки
+func parseMarkup(s string) ([]TextLine, error) {
+	var lines []TextLine
+	for _, src := range strings.Split(strings.Replace(s, "\r\n", "\n", -1), "\n") {
+		l := TextLine{Kind: "text"}
+		rest := src
+		for strings.HasPrefix(rest, "{") && !strings.HasPrefix(rest, "{{") {
+			end := strings.Index(rest, "}")
+			if end < 0 {
+				return nil, errors.New("незакрытая директива разметки: " + src)
+			}
+			d := strings.Fields(rest[1:end])
+			rest = rest[end+1:]
+			if len(d) == 0 {
+				return nil, errors.New("пустая директива разметки: " + src)
+			}
+			arg := ""
+			if len(d) > 1 {
+				arg = d[1]
+			}
+			switch d[0] {
+			case "b":
+				l.Bold = true
+			case "dw":
+				l.Wide = true
+			case "dh":
+				l.DoubleHeight = true
+			case "f":
+				n, err := strconv.Atoi(arg)
+				if err != nil || n < 1 || n > 255 {
+					return nil, errors.New("номер шрифта должен быть 1..255: " + src)
+				}
+				l.Font = n
+			case "l", "c", "r":
+				l.Align = d[0]
+			case "sep":
+				l.Kind = "sep"
+				l.Text = "-"
+				if len(arg) > 0 {
+					l.Text = arg
+				}
+			case "cut":
+				l.Kind = "cut"
+				if arg == "partial" {
+					l.Count = 1
+				}
+			case "feed":
+				l.Kind = "feed"
+				l.Count = 1
+				if len(arg) > 0 {
+					n, err := strconv.Atoi(arg)
+					if err != nil || n < 1 || n > 255 {
+						return nil, errors.New("протяжка должна быть 1..255 строк: " + src)
+					}
+					l.Count = n
+				}
+			default:
+				return nil, errors.New("неизвестная директива разметки {" + d[0] + "}: " + src)
+			}
+		}
+		if l.Kind == "text" {
+			if strings.HasPrefix(rest, "{{") {
+				rest = rest[1:]
+			}
+			l.Text = rest
+		}
+		lines = append(lines, l)
+	}
+	return lines, nil
+}
+
+//alignText перенос текста по ширине width и выравнивание
+func alignText(s, align string, width int) []string {
+	if width < 1 {
+		//ширина строки неизвестна: текст без переноса и выравнивания
+		return []string{s}
+	}
+	if utf8.RuneCountInString(s) <= width && align != "c" && align != "r" {
+		return []string{s}
+	}
+	lines := drv.WrapText(s, width)
+	if len(lines) == 0 {
+		return []string{""}
+	}
+	for i, l := range lines {
+		switch align {
+		case "c":
+			lines[i] = centerLine(l, width)
+		case "r":
+			if n := width - utf8.RuneCountInString(l); n > 0 {
+				lines[i] = strings.Repeat(" ", n) + l
+			}
+		}
+	}
+	return lines
+}
+
+//markupOp команда печати строки разметки, разложенной по ширине строки шрифта
+type markupOp struct {
+	//line, cut, feed
+	Kind  string
+	Text  string
+	Wide  bool
+	Font  int
+	Count int
+}
+
+//layoutMarkup раскладка строк с разметкой на команды печати по длине строки шрифтов ККТ
+func layoutMarkup(kkm *drv.KkmDrv, lines []TextLine) []markupOp {
+	//width ширина строки шрифта в символах по параметрам шрифтов, прочитанным при подключении
+	width := func(font int) int {
+		if font < 1 {
+			font = 1
+		}
+		w := int(kkm.LineLength(byte(font)))
+		if w == 0 {
+			w = int(LENLINE)
+		}
+		return w
+	}
+	ops := make([]markupOp, 0, len(lines))
+	for _, l := range lines {
+		switch l.Kind {
+		case "cut", "feed":
+			ops = append(ops, markupOp{Kind: l.Kind, Count: l.Count})
+			continue
+		}
+		font, wide := l.Font, l.Wide
+		if l.Bold {
+			if fb := kkm.GetParam().FontBold; fb > 0 {
+				font = int(fb)
+			} else {
+				wide = true
+			}
+		}
+		if l.DoubleHeight {
+			if fdh := kkm.GetParam().FontDH; fdh > 0 {
+				font = int(fdh)
+			} else {
+				wide = true
+			}
+		}
+		if font < 1 {
+			font = 1
+		}
+		w := width(font)
+		if wide {
+			w = width(1) / 2
+		}
+		text := l.Text
+		if l.Kind == "sep" {
+			r := []rune(strings.Repeat(l.Text, w))
+			text = string(r[:w])
+		}
+		for _, s := range alignText(text, l.Align, w) {
+			ops = append(ops, markupOp{Kind: "line", Text: s, Wide: wide, Font: font})
+		}
+	}
+	return ops
+}
+
+//printMarkup печать строк с разметкой на ленте tape
+func printMarkup(kkm *drv.KkmDrv, pass []byte, tape byte, lines []TextLine) (byte, error) {
+	for _, op := range layoutMarkup(kkm, lines) {
+		var errcode byte
+		var err error
+		switch {
+		case op.Kind == "cut":
+			errcode, err = kkm.CutCheck(pass, byte(op.Count))
+		case op.Kind == "feed":
+			errcode, err = kkm.FeedDocument(pass, tape, byte(op.Count))
+		case op.Wide:
+			errcode, err = kkm.PrintWideLine(pass, tape, op.Text)
+		default:
+			errcode, err = kkm.PrintLine(pass, tape, byte(op.Font), op.Text)
+		}
+		if errcode > 0 || err != nil {
+			return errcode, err
+		}
+	}
+	return 0, nil
+}
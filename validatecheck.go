@@ -0,0 +1,374 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"kkm-shtrih/drv"
+	"kkm-shtrih/drv/tlv"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+//RegCache последние прочитанные параметры регистрации ККТ, для проверки чека без обращения к ККТ
+type RegCache struct {
+	mu  sync.Mutex
+	reg map[string]drv.FNRegInfo
+}
+
+//RegInfo экземпляр кэша параметров регистрации
+var RegInfo = RegCache{reg: make(map[string]drv.FNRegInfo)}
+
+//Get вернет параметры регистрации ККТ из кэша
+func (r *RegCache) Get(deviceID string) (drv.FNRegInfo, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	reg, ok := r.reg[deviceID]
+	return reg, ok
+}
+
+//Set сохранит параметры регистрации ККТ
+func (r *RegCache) Set(deviceID string, reg drv.FNRegInfo) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.reg[deviceID] = reg
+}
+
+//Delete сбросит параметры регистрации ККТ (после перерегистрации)
+func (r *RegCache) Delete(deviceID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.reg, deviceID)
+}
+
+//TaxSum итог по ставке НДС
+type TaxSum struct {
+	VATRate   string  `xml:"VATRate,attr" json:"VATRate"`
+	Amount    float64 `xml:"Amount,attr" json:"Amount"`       //Сумма расчета по ставке
+	VATAmount float64 `xml:"VATAmount,attr" json:"VATAmount"` //Сумма НДС по ставке
+}
+
+//CheckValidation результат проверки пакета чека
+type CheckValidation struct {
+	XMLName  xml.Name `xml:"CheckValidation" json:"-"`
+	Valid    bool     `xml:"Valid,attr" json:"Valid"`
+	Total    float64  `xml:"Total,attr" json:"Total"`       //Сумма чека по позициям
+	Payments float64  `xml:"Payments,attr" json:"Payments"` //Сумма оплат
+	Change   float64  `xml:"Change,attr" json:"Change"`     //Сдача
+	Rounding float64  `xml:"Rounding,attr" json:"Rounding"` //Скидка округления суммы чека
+	Taxes    []TaxSum `xml:"Tax" json:"Taxes"`
+	Errors   []string `xml:"Error" json:"Errors"`
+}
+
+//tagValue реквизит для передачи в ФН
+type tagValue struct {
+	tag uint16
+	val interface{}
+}
+
+//vatRates допустимые ставки НДС и расчетный процент, коды 1..6 - номера налогов ККТ
+var vatRates = map[string]float64{"none": 0, "0": 0, "10": 10, "18": 18, "20": 20, "10/110": 10, "18/118": 18, "20/120": 20,
+	"1": 20, "2": 10, "3": 0, "4": 0, "5": 20, "6": 10}
+
+//checkTags реквизиты чека в порядке передачи в ФН
+func checkTags(p *CheckParameters) []tagValue {
+	var tags []tagValue
+	if len(p.CustomerEmail) > 0 {
+		tags = append(tags, tagValue{1008, p.CustomerEmail})
+	} else if len(p.CustomerPhone) > 0 {
+		tags = append(tags, tagValue{1008, p.CustomerPhone})
+	}
+	if len(p.CashierINN) > 0 {
+		tags = append(tags, tagValue{1203, p.CashierINN})
+	}
+	if len(p.CashierName) > 0 {
+		tags = append(tags, tagValue{1021, p.CashierName})
+	}
+	return tags
+}
+
+//positionTags реквизиты предмета расчета в порядке передачи в ФН после FF46
+func positionTags(fs *FiscalString) []tagValue {
+	var tags []tagValue
+	if fs.CalculationSubject == 2 { //подакцизный товар
+		//«признак предмета расчета» (тег 1212 byte), «признак способа расчета» (тег 1214), «наименование предмета расчета» (тег 1030), «количество предмета расчета» (тег 1023) и «цена за единицу предмета расчета» (тег 1079)
+		tags = append(tags, tagValue{1207, 1}, tagValue{1212, fs.CalculationSubject}, tagValue{1214, fs.PaymentMethod},
+			tagValue{1030, fs.Name}, tagValue{1023, fs.Quantity}, tagValue{1079, fs.PriceWithDiscount})
+	}
+	//«данные агента» (тег 1223): «операция платежного агента» (тег 1044), телефоны (теги 1073, 1074, 1075),
+	//«наименование оператора перевода» (тег 1026), «адрес оператора перевода» (тег 1005), «ИНН оператора перевода» (тег 1016)
+	a := fs.AgentData
+	agent := []tagValue{{1044, a.AgentOperation}}
+	agent = append(agent, phoneTags(1073, a.AgentPhone)...)
+	agent = append(agent, phoneTags(1074, a.PaymentProcessorPhone)...)
+	agent = append(agent, phoneTags(1075, a.AcquirerOperatorPhone)...)
+	agent = append(agent, tagValue{1026, a.AcquirerOperatorName}, tagValue{1005, a.AcquirerOperatorAddress}, tagValue{1016, a.AcquirerOperatorINN})
+	if v := stlvValue(agent...); len(v) > 0 {
+		tags = append(tags, tagValue{1223, v})
+	}
+	if len(fs.VendorData.VendorINN) > 0 {
+		tags = append(tags, tagValue{1226, fs.VendorData.VendorINN})
+	}
+	//«данные поставщика» (тег 1224): «телефон поставщика» (тег 1171), «наименование поставщика» (тег 1225)
+	vendor := append(phoneTags(1171, fs.VendorData.VendorPhone), tagValue{1225, fs.VendorData.VendorName})
+	if v := stlvValue(vendor...); len(v) > 0 {
+		tags = append(tags, tagValue{1224, v})
+	}
+	if len(fs.MeasurementUnit) > 0 {
+		tags = append(tags, tagValue{1197, fs.MeasurementUnit})
+	}
+	//код товара (тег 1162), в пакете 1С - base64
+	if len(fs.GoodCodeData.MarkingCode) > 0 {
+		tags = append(tags, tagValue{1162, fs.GoodCodeData.MarkingCode})
+	}
+	//«акциз» (тег 1229) в рублях, «код страны происхождения товара» (тег 1230) по ОКСМ, «номер таможенной декларации» (тег 1231)
+	if fs.ExciseAmount > 0 {
+		tags = append(tags, tagValue{1229, fs.ExciseAmount})
+	}
+	if country := countryCode(fs.CountryOfOrigin); len(country) > 0 {
+		tags = append(tags, tagValue{1230, country})
+	}
+	if len(fs.CustomsDeclaration) > 0 {
+		tags = append(tags, tagValue{1231, fs.CustomsDeclaration})
+	}
+	//«дополнительный реквизит предмета расчета» (тег 1191)
+	if len(fs.AdditionalAttribute) > 0 {
+		tags = append(tags, tagValue{1191, fs.AdditionalAttribute})
+	}
+	return tags
+}
+
+//phoneTags телефоны через разделитель "," - по реквизиту на каждый
+func phoneTags(tag uint16, phones string) []tagValue {
+	var tags []tagValue
+	for _, ph := range strings.Split(phones, ",") {
+		if ph = strings.TrimSpace(ph); len(ph) > 0 {
+			tags = append(tags, tagValue{tag, ph})
+		}
+	}
+	return tags
+}
+
+//stlvValue значение составного реквизита из непустых вложенных реквизитов для tlv.Encode
+func stlvValue(children ...tagValue) []interface{} {
+	var val []interface{}
+	for _, c := range children {
+		if str, ok := c.val.(string); ok && len(str) == 0 {
+			continue
+		}
+		val = append(val, map[string]interface{}{"tag": int(c.tag), "value": c.val})
+	}
+	return val
+}
+
+//countryCode цифровой код страны по ОКСМ из 3 знаков, 1С может передать код без ведущих нулей
+func countryCode(s string) string {
+	s = strings.TrimSpace(s)
+	if len(s) > 0 && len(s) < 3 {
+		s = strings.Repeat("0", 3-len(s)) + s
+	}
+	return s
+}
+
+//round2 округление до копеек
+func round2(v float64) float64 {
+	return math.Round(v*100) / 100
+}
+
+//taxationProblem проверит систему налогообложения по параметрам регистрации из кэша
+func taxationProblem(deviceID string, ts int) string {
+	if ts < 0 || ts > 5 {
+		return "TaxationSystem: код системы налогообложения должен быть 0..5"
+	}
+	reg, ok := RegInfo.Get(deviceID)
+	if ok && reg.TaxCode != 0 && reg.TaxCode&(1<<uint(ts)) == 0 {
+		return "TaxationSystem: система налогообложения " + strconv.Itoa(ts) + " не указана при регистрации ККТ"
+	}
+	return ""
+}
+
+//validateCheck проверка пакета чека без обращения к ККТ, возвращает все найденные ошибки
+func validateCheck(deviceID string, chk *CheckPackage) CheckValidation {
+	var v CheckValidation
+	add := func(s string) {
+		v.Errors = append(v.Errors, s)
+	}
+	p := &chk.Parameters
+	doctype := p.DocumentType
+	switch doctype {
+	case 0, DocTypeCheck, DocTypeBSO, DocTypeCorrection, DocTypeBSOCorrection:
+	default:
+		add("DocumentType: неизвестный тип документа " + strconv.Itoa(doctype))
+	}
+	correction := doctype == DocTypeCorrection || doctype == DocTypeBSOCorrection
+	if checkOperationType(p) == 0 {
+		add("OperationType: тип операции должен быть 1..4")
+	}
+	if len(strings.TrimSpace(p.CashierName)) == 0 {
+		add("CashierName: не указан кассир")
+	}
+	if len(p.Logo) > 0 {
+		if _, err := loadLogo(deviceID, p.Logo); err != nil {
+			add("Logo: " + err.Error())
+		}
+	}
+	if p.Electronically && len(p.CustomerEmail) == 0 && len(p.CustomerPhone) == 0 {
+		add("Electronically: для электронного чека обязателен email или телефон покупателя")
+	}
+	for _, msg := range registrationProblems(deviceID, chk) {
+		add(msg)
+	}
+	for _, t := range checkTags(p) {
+		if _, err := tlv.Encode(t.tag, t.val); err != nil {
+			add("Parameters: " + err.Error())
+		}
+	}
+	if correction {
+		if len(p.CorrectionData.Description) == 0 || len(p.CorrectionData.Date) < 10 {
+			add("CorrectionData: для коррекции обязательны Description и Date")
+		}
+		if p.CorrectionData.Type == 1 && len(p.CorrectionData.Number) == 0 {
+			add("CorrectionData: для коррекции по предписанию обязателен Number")
+		}
+	} else if len(chk.Positions.FiscalString) == 0 {
+		add("Positions: нет ни одной фискальной строки")
+	}
+
+	taxes := make(map[string]*TaxSum)
+	var rates []string
+	for i, fs := range chk.Positions.FiscalString {
+		pos := "FiscalString[" + strconv.Itoa(i+1) + "] "
+		if len(strings.TrimSpace(fs.Name)) == 0 {
+			add(pos + "Name: не указано наименование")
+		}
+		if fs.Quantity <= 0 {
+			add(pos + "Quantity: количество должно быть больше 0")
+		}
+		if fs.PriceWithDiscount < 0 || fs.AmountWithDiscount < 0 {
+			add(pos + "цена и сумма не могут быть отрицательными")
+		}
+		if diff := math.Abs(round2(fs.PriceWithDiscount*fs.Quantity) - fs.AmountWithDiscount); diff > 0.01+1e-9 {
+			add(pos + "AmountWithDiscount " + strconv.FormatFloat(fs.AmountWithDiscount, 'f', 2, 64) + " не равна цена × количество " +
+				strconv.FormatFloat(round2(fs.PriceWithDiscount*fs.Quantity), 'f', 2, 64))
+		}
+		rate, ok := vatRates[fs.VATRate]
+		if !ok {
+			add(pos + "VATRate: неизвестная ставка НДС \"" + fs.VATRate + "\"")
+		}
+		vat := round2(fs.AmountWithDiscount * rate / (100 + rate))
+		if fs.VATAmount > 0 {
+			if math.Abs(fs.VATAmount-vat) > 0.01+1e-9 {
+				add(pos + "VATAmount " + strconv.FormatFloat(fs.VATAmount, 'f', 2, 64) + " не соответствует ставке " + fs.VATRate +
+					" (" + strconv.FormatFloat(vat, 'f', 2, 64) + ")")
+			}
+			vat = fs.VATAmount
+		}
+		if ts, ok := taxes[fs.VATRate]; ok {
+			ts.Amount = round2(ts.Amount + fs.AmountWithDiscount)
+			ts.VATAmount = round2(ts.VATAmount + vat)
+		} else {
+			taxes[fs.VATRate] = &TaxSum{VATRate: fs.VATRate, Amount: fs.AmountWithDiscount, VATAmount: vat}
+			rates = append(rates, fs.VATRate)
+		}
+		if fs.PaymentMethod < 0 || fs.PaymentMethod > 7 {
+			add(pos + "PaymentMethod: признак способа расчета должен быть 1..7")
+		}
+		if fs.CalculationSubject < 0 || fs.CalculationSubject > 26 {
+			add(pos + "CalculationSubject: признак предмета расчета должен быть 1..26")
+		}
+		if fs.Department < 0 || fs.Department > 16 {
+			add(pos + "Department: отдел должен быть 0..16")
+		}
+		for _, t := range positionTags(&fs) {
+			if _, err := tlv.Encode(t.tag, t.val); err != nil {
+				add(pos + err.Error())
+			}
+		}
+		if country := countryCode(fs.CountryOfOrigin); len(country) > 0 {
+			if _, err := strconv.Atoi(country); err != nil || len(country) != 3 {
+				add(pos + "CountryOfOrigin: код страны должен быть цифровым кодом ОКСМ из 3 знаков")
+			}
+		}
+		if fs.ExciseAmount < 0 || fs.ExciseAmount > fs.AmountWithDiscount {
+			add(pos + "ExciseAmount: сумма акциза должна быть от 0 до суммы позиции")
+		}
+		if len(fs.GoodCodeData.MarkingCode) > 0 {
+			code, err := base64.StdEncoding.DecodeString(fs.GoodCodeData.MarkingCode)
+			if err != nil || len(code) == 0 {
+				add(pos + "GoodCodeData MarkingCode: код маркировки должен быть в Base64")
+			} else if _, err = tlv.Encode(1162, code); err != nil {
+				add(pos + "GoodCodeData MarkingCode: " + err.Error())
+			}
+		}
+		v.Total = round2(v.Total + fs.AmountWithDiscount)
+	}
+	for _, r := range rates {
+		v.Taxes = append(v.Taxes, *taxes[r])
+	}
+
+	pay := chk.Payments
+	if pay.Cash < 0 || pay.ElectronicPayment < 0 || pay.PrePayment < 0 || pay.PostPayment < 0 || pay.Barter < 0 {
+		add("Payments: суммы оплат не могут быть отрицательными")
+	}
+	cashless := round2(pay.ElectronicPayment + pay.PrePayment + pay.PostPayment + pay.Barter)
+	v.Payments = round2(pay.Cash + cashless)
+	//к оплате сумма чека за вычетом округления, чек коррекции не округляется
+	due := v.Total
+	if !correction {
+		rnd, err := checkRounding(roundingPolicy(deviceID, p), v.Total, pay)
+		if err != nil {
+			add(err.Error())
+		}
+		v.Rounding = rnd
+		due = round2(v.Total - rnd)
+	}
+	if !correction || len(chk.Positions.FiscalString) > 0 {
+		if v.Payments < due {
+			add("Payments: сумма оплат " + strconv.FormatFloat(v.Payments, 'f', 2, 64) + " меньше суммы чека " + strconv.FormatFloat(due, 'f', 2, 64))
+		} else if cashless > due {
+			add("Payments: безналичные оплаты превышают сумму чека, сдача возможна только с наличных")
+		} else {
+			v.Change = round2(v.Payments - due)
+		}
+	}
+	v.Valid = len(v.Errors) == 0
+	return v
+}
+
+//validateCheckHandler проверка пакета чека без отправки в ККТ
+func validateCheckHandler(c *gin.Context) {
+	/*
+		POST ValidateCheck/<DeviceID>
+		тело CheckPackage в xml (как ProcessCheck) или json (Content-Type: application/json)
+		ответ CheckValidation: Valid, Total, Payments, Change, итоги по ставкам Tax и список ошибок Error
+	*/
+	var chk = CheckPackage{}
+	deviceID := c.Param("DeviceID")
+	isjson := c.ContentType() == "application/json" || c.Query("format") == "json"
+	reply := func(code int, obj interface{}) {
+		if isjson {
+			c.JSON(code, obj)
+		} else {
+			c.XML(code, obj)
+		}
+	}
+	if _, err := KkmServ.GetDrv(deviceID); err != nil {
+		reply(http.StatusOK, gin.H{"error": true, "message": "deviceID не зарегистрирован"})
+		return
+	}
+	var err error
+	if c.ContentType() == "application/json" {
+		err = c.ShouldBindJSON(&chk)
+	} else {
+		err = c.ShouldBindXML(&chk)
+	}
+	if err != nil {
+		reply(http.StatusBadRequest, gin.H{"error": true, "message": "bad request " + err.Error()})
+		return
+	}
+	reply(http.StatusOK, validateCheck(deviceID, &chk))
+}